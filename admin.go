@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// clusterSummary is the overview of a cluster returned by the admin API
+type clusterSummary struct {
+	Name                           string            `json:"name"`
+	Enabled                        bool              `json:"enabled"`
+	ClusterType                    string            `json:"cluster_type"`
+	AllowedParallelRestarts        parallelRestarts  `json:"allowed_parallel_restarts"`
+	Membership                     *membershipStatus `json:"membership,omitempty"`
+	CurrentOngoingRestarts         int               `json:"current_ongoing_restarts"`
+	CurrentRestartingServers       []string          `json:"current_restarting_servers"`
+	LastRestartRequestTimestamp    time.Time         `json:"last_restart_request_timestamp"`
+	LastSuccessfulRestartTimestamp time.Time         `json:"last_successful_restart_timestamp"`
+	LastRestartPanicTimestamp      time.Time         `json:"last_restart_panic_timestamp"`
+}
+
+// clusterDetails contains everything goahead knows about a cluster
+type clusterDetails struct {
+	Name                           string            `json:"name"`
+	Settings                       clusterSetting    `json:"settings"`
+	State                          clusterState      `json:"state"`
+	Membership                     *membershipStatus `json:"membership,omitempty"`
+	Quarantine                     []quarantineEntry `json:"quarantine"`
+	SleepingRebootCompletionChecks []string          `json:"sleeping_reboot_completion_checks"`
+	RunningRebootCompletionChecks  []string          `json:"running_reboot_completion_checks"`
+	Hosts                          []response        `json:"hosts"`
+}
+
+// membershipStatus reports how many of the known cluster members did not complete a reboot yet
+type membershipStatus struct {
+	Members        int      `json:"members"`
+	Pending        int      `json:"pending"`
+	PendingMembers []string `json:"pending_members"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// requireAdmin only passes requests to the given handler that present one of the configured admin_api_tokens
+// as bearer token or a verified client certificate with a common name listed in admin_client_cert_cns
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rid := randSeq()
+		if len(currentConfig().AdminAPITokens) == 0 && len(currentConfig().AdminClientCertCNs) == 0 {
+			respondWithError(w, http.StatusForbidden, rid, "Admin API is disabled, because neither admin_api_tokens nor admin_client_cert_cns are configured")
+			return
+		}
+		if !isAdminRequest(r) {
+			mainLogger.Warn("Denied unauthenticated admin request " + r.Method + " " + r.RequestURI + " from IP: " + strings.Split(r.RemoteAddr, ":")[0])
+			respondWithError(w, http.StatusUnauthorized, rid, "Admin API requires a valid bearer token or client certificate")
+			return
+		}
+		mainLogger.Info("Admin request " + r.Method + " " + r.RequestURI + " from IP: " + strings.Split(r.RemoteAddr, ":")[0])
+		h(w, r)
+	}
+}
+
+// isAdminRequest checks the bearer token and the client certificate of the request against the configured admin credentials
+func isAdminRequest(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && len(token) > 0 {
+		for _, adminToken := range currentConfig().AdminAPITokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+				return true
+			}
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.PeerCertificates) > 0 {
+		cn := r.TLS.PeerCertificates[0].Subject.CommonName
+		for _, adminCN := range currentConfig().AdminClientCertCNs {
+			if cn == adminCN {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readClusterState returns the current cluster state of the given cluster and if there is a saved cluster state
+func readClusterState(cluster string) (clusterState, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	cs, found, err := stateStore.GetClusterState(cluster)
+	if err != nil {
+		stateLogger(cluster).Error("Could not read cluster state of cluster " + cluster + " " + err.Error())
+	}
+	if cs.CurrentRestartingServers == nil {
+		cs.CurrentRestartingServers = make(map[string]struct{})
+	}
+	return cs, found
+}
+
+// readAckFiles returns all saved FQDN ACKs of the given cluster
+func readAckFiles(cluster string) []response {
+	acks, err := stateStore.ListHostAcks(cluster)
+	if err != nil {
+		stateLogger(cluster).Error("Could not read fqdn ACKs of cluster " + cluster + " " + err.Error())
+	}
+	return acks
+}
+
+// sortedClusterNames returns the names of all clusters of the given cluster settings in alphabetical order
+func sortedClusterNames(settings map[string]clusterSetting) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedKeys returns the sorted FQDNs of a set of FQDNs
+func sortedKeys(m map[string]struct{}) []string {
+	keys := keysString(m)
+	sort.Strings(keys)
+	return keys
+}
+
+// parseSince reads the optional since query parameter as RFC3339 timestamp or as duration before now
+func parseSince(r *http.Request) (time.Time, error) {
+	since := r.URL.Query().Get("since")
+	if len(since) < 1 {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return t, errors.New("Can not convert value " + since + " of since to a RFC3339 timestamp or a golang Duration like 168h")
+	}
+	return t, nil
+}
+
+// clusterMembership returns the members of the cluster that did not complete a reboot since the given time or nil if the cluster has no members inventory
+func clusterMembership(name string, csetting clusterSetting, cs clusterState, since time.Time, clusterLogger *logrus.Entry) *membershipStatus {
+	if !csetting.Members.configured() {
+		return nil
+	}
+	status := &membershipStatus{PendingMembers: []string{}}
+	members, err := resolveClusterMembers(name, csetting, clusterLogger)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Members = len(members)
+	for _, fqdn := range members {
+		if rebooted, ok := cs.RebootedServers[fqdn]; !ok || rebooted.Before(since) {
+			status.PendingMembers = append(status.PendingMembers, fqdn)
+		}
+	}
+	status.Pending = len(status.PendingMembers)
+	return status
+}
+
+// listClustersHandler returns a summary of every configured cluster
+func listClustersHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	settings, loggers := currentClusterSettings()
+	summaries := []clusterSummary{}
+	for _, name := range sortedClusterNames(settings) {
+		csetting := settings[name]
+		cs, _ := readClusterState(name)
+		summaries = append(summaries, clusterSummary{
+			Name:                           name,
+			Enabled:                        csetting.Enabled,
+			ClusterType:                    csetting.ClusterType,
+			AllowedParallelRestarts:        csetting.AllowedParallelRestarts,
+			Membership:                     clusterMembership(name, csetting, cs, since, loggers[name]),
+			CurrentOngoingRestarts:         cs.CurrentOngoingRestarts,
+			CurrentRestartingServers:       sortedKeys(cs.CurrentRestartingServers),
+			LastRestartRequestTimestamp:    cs.LastRestartRequestTimestamp,
+			LastSuccessfulRestartTimestamp: cs.LastSuccessfulRestartTimestamp,
+			LastRestartPanicTimestamp:      cs.LastRestartPanicTimestamp,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, "", summaries)
+}
+
+// getClusterHandler returns the settings, the state and the FQDN ACK files of a cluster
+func getClusterHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	settings, loggers := currentClusterSettings()
+	csetting, ok := settings[name]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "", "Unknown cluster "+name)
+		return
+	}
+	since, err := parseSince(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	details := clusterDetails{
+		Name:                           name,
+		Settings:                       csetting,
+		SleepingRebootCompletionChecks: []string{},
+		RunningRebootCompletionChecks:  []string{},
+	}
+	details.State, _ = readClusterState(name)
+	details.Membership = clusterMembership(name, csetting, details.State, since, loggers[name])
+	mutex.Lock()
+	if details.Quarantine, err = stateStore.ListQuarantine(name); err != nil {
+		stateLogger(name).Error("Could not read quarantine of cluster " + name + " " + err.Error())
+	}
+	for fqdn, cc := range sleepingClusterChecks {
+		if cc.Cluster == name {
+			details.SleepingRebootCompletionChecks = append(details.SleepingRebootCompletionChecks, fqdn)
+		}
+	}
+	for fqdn := range runningClusterChecks {
+		if _, ok := details.State.CurrentRestartingServers[fqdn]; ok {
+			details.RunningRebootCompletionChecks = append(details.RunningRebootCompletionChecks, fqdn)
+		}
+	}
+	mutex.Unlock()
+	sort.Strings(details.SleepingRebootCompletionChecks)
+	sort.Strings(details.RunningRebootCompletionChecks)
+	details.Hosts = readAckFiles(name)
+	respondWithJSON(w, http.StatusOK, "", details)
+}
+
+// releaseRestartingHostHandler frees the restart slot of a FQDN that is stuck in the currently restarting servers of a cluster
+func releaseRestartingHostHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fqdn := mux.Vars(r)["fqdn"]
+	mutex.Lock()
+	_, ok := clusterSettings[name]
+	clusterLogger := currentClusterLoggers()[name]
+	mutex.Unlock()
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "", "Unknown cluster "+name)
+		return
+	}
+	if _, found := readClusterState(name); !found {
+		respondWithError(w, http.StatusNotFound, "", "No cluster state found for cluster "+name)
+		return
+	}
+	cs, grantedAt, err := modifyClusterState(name, fqdn, "release", clusterLogger)
+	if err == errHostNotRestarting {
+		respondWithError(w, http.StatusNotFound, "", "FQDN "+fqdn+" is not restarting in cluster "+name)
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if cancelClusterCheck(fqdn) {
+		clusterLogger.Info("Cancelled reboot completion check for released FQDN: " + fqdn)
+	}
+	clusterLogger.Info("Released restart slot of FQDN: " + fqdn + " in cluster " + name + " via admin API")
+	recordRebootCycle(rebootCycle{Fqdn: fqdn, Cluster: name, GrantedAt: grantedAt, Outcome: rebootOutcomeReleased})
+	record := auditRequest(r, auditEventReleased)
+	record.Fqdn = fqdn
+	record.Cluster = name
+	record.Reason = "Released via admin API by " + adminIdentity(r)
+	record.State = &cs
+	audit(record)
+	respondWithJSON(w, http.StatusOK, "", cs)
+}
+
+// restoreClusterStateHandler replaces an unreadable cluster state with its backup generation or with an empty cluster state if reset=true is given
+func restoreClusterStateHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	mutex.Lock()
+	csetting, ok := clusterSettings[name]
+	clusterLogger := currentClusterLoggers()[name]
+	mutex.Unlock()
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "", "Unknown cluster "+name)
+		return
+	}
+	reset := r.URL.Query().Get("reset") == "true"
+	mutex.Lock()
+	var cs clusterState
+	var err error
+	if reset {
+		clusterLogger.Warn("Resetting cluster state of cluster " + name + " via admin API, which frees all its restart slots")
+		err = stateStore.PutClusterState(name, cs)
+	} else if restorer, ok := stateStore.(clusterStateRestorer); ok {
+		cs, err = restorer.RestoreClusterState(name)
+	} else {
+		mutex.Unlock()
+		respondWithError(w, http.StatusBadRequest, "", "The state backend "+describeStateBackend()+" does not keep backups, use reset=true to reset the cluster state")
+		return
+	}
+	mutex.Unlock()
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "", "Could not restore cluster state of cluster "+name+" "+err.Error())
+		return
+	}
+	if cs.CurrentRestartingServers == nil {
+		cs.CurrentRestartingServers = make(map[string]struct{})
+	}
+	clusterLogger.Info("Restored cluster state of cluster " + name + " via admin API with restarting hosts: " + strings.Join(sortedKeys(cs.CurrentRestartingServers), ","))
+	// the restored restarting hosts need their reboot completion checks again
+	for fqdn := range cs.CurrentRestartingServers {
+		scheduleClusterCheck(clusterCheck{csetting, fqdn, "restoreClusterStateHandler()", name})
+	}
+	respondWithJSON(w, http.StatusOK, "", cs)
+}
+
+// addAdminV1Routes takes a router or subrouter and adds all the authenticated admin routes to it
+func addAdminV1Routes(r *mux.Router) {
+	r.HandleFunc("/clusters", requireAdmin(listClustersHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/clusters/{name}", requireAdmin(getClusterHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/clusters/{name}/restarting/{fqdn}", requireAdmin(releaseRestartingHostHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/clusters/{name}/quarantine/{fqdn}", requireAdmin(quarantineHostHandler)).Methods(http.MethodPut, http.MethodPost)
+	r.HandleFunc("/clusters/{name}/quarantine/{fqdn}", requireAdmin(clearQuarantineHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/quarantine", requireAdmin(listQuarantineHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/clusters/{name}/state/restore", requireAdmin(restoreClusterStateHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/freeze", requireAdmin(getFreezeHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/freeze", requireAdmin(enableFreezeHandler)).Methods(http.MethodPut, http.MethodPost)
+	r.HandleFunc("/freeze", requireAdmin(disableFreezeHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/reload", requireAdmin(reloadHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/match", requireAdmin(matchHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/history", requireAdmin(historyHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/jobs", requireAdmin(listJobsHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/jobs/{id}", requireAdmin(getJobHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/jobs/{id}/retry", requireAdmin(retryJobHandler)).Methods(http.MethodPost)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditEventGranted   = "granted"
+	auditEventDenied    = "denied"
+	auditEventInquire   = "inquire"
+	auditEventPanic     = "panic"
+	auditEventCompleted = "completed"
+	auditEventReleased  = "released"
+)
+
+// auditRecord is a single line of the JSON Lines audit log
+type auditRecord struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Event     string        `json:"event"`
+	RequestID string        `json:"request_id,omitempty"`
+	ClientIP  string        `json:"client_ip,omitempty"`
+	ClientCN  string        `json:"client_cn,omitempty"`
+	Fqdn      string        `json:"fqdn"`
+	Cluster   string        `json:"cluster"`
+	Decision  string        `json:"decision,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	State     *clusterState `json:"state,omitempty"`
+}
+
+// auditLogger appends audit records to the audit_log_file and rotates it once it reaches audit_log_max_size_mb
+type auditLogger struct {
+	sync.Mutex
+	file string
+	f    *os.File
+	size int64
+}
+
+var auditLog *auditLogger
+
+// openAuditLog opens the configured audit_log_file for appending, defaults to <log_base_dir>/audit.jsonl
+func openAuditLog() (*auditLogger, error) {
+	cfg := currentConfig()
+	file := cfg.AuditLogFile
+	if len(file) < 1 {
+		file = filepath.Join(cfg.LogBaseDir, "audit.jsonl")
+	}
+	a := &auditLogger{file: file}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLogger) open() error {
+	f, err := os.OpenFile(a.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f = f
+	a.size = fi.Size()
+	return nil
+}
+
+// rotate renames audit.jsonl to audit.jsonl.1, audit.jsonl.1 to audit.jsonl.2 and so on and removes the oldest backup
+func (a *auditLogger) rotate() error {
+	a.f.Close()
+	backups := currentConfig().AuditLogMaxBackups
+	os.Remove(a.file + "." + strconv.Itoa(backups))
+	for i := backups - 1; i > 0; i-- {
+		os.Rename(a.file+"."+strconv.Itoa(i), a.file+"."+strconv.Itoa(i+1))
+	}
+	if backups > 0 {
+		os.Rename(a.file, a.file+".1")
+	} else {
+		os.Remove(a.file)
+	}
+	return a.open()
+}
+
+// write appends the record as a single JSON line
+func (a *auditLogger) write(record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.Lock()
+	defer a.Unlock()
+	if a.f == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	maxSize := int64(currentConfig().AuditLogMaxSizeMB) * 1024 * 1024
+	if maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > maxSize {
+		if err := a.rotate(); err != nil {
+			a.f = nil
+			return err
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// audit writes the record to the audit log without ever failing the caller
+func audit(record auditRecord) {
+	if auditLog == nil {
+		return
+	}
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now()
+	}
+	if err := auditLog.write(record); err != nil {
+		mainLogger.Error("Could not write audit record to " + auditLog.file + " " + err.Error())
+	}
+}
+
+// auditRequest returns an audit record with the client details of the HTTP request
+func auditRequest(r *http.Request, event string) auditRecord {
+	return auditRecord{Event: event, ClientIP: strings.Split(r.RemoteAddr, ":")[0], ClientCN: clientCertCN(r)}
+}
+
+// clientCertCN returns the common name of the verified client certificate of the request
+func clientCertCN(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// checkRestartBudgets returns the reason why the given cluster must not restart another host, because the global_allowed_parallel_restarts
+// or the restart_budgets of one of its labels are exhausted. cs is the not yet saved cluster state of the given cluster.
+// It has to be called with the mutex held, so that no other cluster can hand out a go_ahead in between.
+func checkRestartBudgets(cluster string, cs clusterState, settings map[string]clusterSetting) (string, bool, error) {
+	cfg := currentConfig()
+	if cfg.GlobalAllowedParallelRestarts < 1 && len(cfg.RestartBudgets) == 0 {
+		return "", false, nil
+	}
+	labels := settings[cluster].Labels
+	global := 0
+	budgets := make(map[string]int)
+	for _, other := range sortedClusterNames(settings) {
+		ongoing := cs.CurrentOngoingRestarts
+		if other != cluster {
+			ocs, found, err := stateStore.GetClusterState(other)
+			if err != nil {
+				return "", true, errors.New("Could not read cluster state of cluster " + other + " " + err.Error())
+			}
+			if !found {
+				continue
+			}
+			ongoing = ocs.CurrentOngoingRestarts
+		}
+		global += ongoing
+		for label := range cfg.RestartBudgets {
+			if value, ok := labels[label]; ok && settings[other].Labels[label] == value {
+				budgets[label] += ongoing
+			}
+		}
+	}
+
+	if cfg.GlobalAllowedParallelRestarts > 0 && global >= cfg.GlobalAllowedParallelRestarts {
+		return "Denied restart request as the global_allowed_parallel_restarts budget is exhausted: " + strconv.Itoa(global) + " >= " + strconv.Itoa(cfg.GlobalAllowedParallelRestarts), true, nil
+	}
+	budgetLabels := make([]string, 0, len(cfg.RestartBudgets))
+	for label := range cfg.RestartBudgets {
+		budgetLabels = append(budgetLabels, label)
+	}
+	sort.Strings(budgetLabels)
+	for _, label := range budgetLabels {
+		value, ok := labels[label]
+		if !ok {
+			continue
+		}
+		if budgets[label] >= cfg.RestartBudgets[label] {
+			return "Denied restart request as the restart_budgets " + label + "=" + value + " budget is exhausted: " + strconv.Itoa(budgets[label]) + " >= " + strconv.Itoa(cfg.RestartBudgets[label]), true, nil
+		}
+	}
+	return "", false, nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -13,17 +12,125 @@ type clusterCheck struct {
 	Cluster   string
 }
 
-func startCheckForRebootedSystem(cc clusterCheck, req request, cs clusterSetting) {
+// scheduleClusterChecks schedules every clusterCheck received on the checkCluster channel.
+// An inquire request of the FQDN interrupts the sleep with wakeClusterCheck and starts the clusterCheck immediately.
+func scheduleClusterChecks() {
+	for cc := range checkCluster {
+		scheduleClusterCheck(cc)
+	}
+}
+
+// scheduleClusterCheck puts the clusterCheck to sleep for its reboot_completion_check_offset and starts it afterwards
+func scheduleClusterCheck(cc clusterCheck) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, sleeping := sleepingClusterChecks[cc.Fqdn]
+	_, running := runningClusterChecks[cc.Fqdn]
+	if sleeping || running {
+		checkerLogger.Debug("Reboot completion check for FQDN: " + cc.Fqdn + " is already scheduled")
+		return
+	}
+	sleepingClusterChecks[cc.Fqdn] = cc
+	checkerLogger.Info("Sleeping for reboot_completion_check_offset: " + cc.Csetting.RebootCompletionCheckOffset.String() + " for FQDN: " + cc.Fqdn)
+	var timer *time.Timer
+	fqdn := cc.Fqdn
+	timer = time.AfterFunc(cc.Csetting.RebootCompletionCheckOffset, func() {
+		// timer is assigned while holding the mutex, which an offset of 0s may not have released yet
+		mutex.Lock()
+		current := timer
+		mutex.Unlock()
+		wakeClusterCheck(request{Fqdn: fqdn}, current, "reboot_completion_check_offset elapsed for FQDN "+fqdn+" Starting reboot completion check")
+	})
+	clusterCheckTimers[cc.Fqdn] = timer
+}
+
+// cancelClusterCheck removes the sleeping clusterCheck of the given FQDN, so that it never gets started,
+// and stops the running clusterCheck of the FQDN before its next attempt
+func cancelClusterCheck(fqdn string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if t, ok := clusterCheckTimers[fqdn]; ok {
+		t.Stop()
+		delete(clusterCheckTimers, fqdn)
+	}
+	if cancel, ok := runningClusterChecks[fqdn]; ok {
+		close(cancel)
+		delete(runningClusterChecks, fqdn)
+		return true
+	}
+	if _, ok := sleepingClusterChecks[fqdn]; ok {
+		delete(sleepingClusterChecks, fqdn)
+		return true
+	}
+	return false
+}
+
+// cancelled returns if the running clusterCheck got cancelled by cancelClusterCheck
+func cancelled(cancel chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// wakeClusterCheck starts the sleeping clusterCheck of the requesting FQDN.
+// If timer is set, the clusterCheck only gets started if it is still scheduled by this timer.
+func wakeClusterCheck(req request, timer *time.Timer, reason string) bool {
+	mutex.Lock()
+	cc, ok := sleepingClusterChecks[req.Fqdn]
+	if !ok || (timer != nil && clusterCheckTimers[req.Fqdn] != timer) {
+		mutex.Unlock()
+		return false
+	}
+	delete(sleepingClusterChecks, req.Fqdn)
+	if t, ok := clusterCheckTimers[req.Fqdn]; ok {
+		t.Stop()
+		delete(clusterCheckTimers, req.Fqdn)
+	}
+	cancel := make(chan struct{})
+	runningClusterChecks[req.Fqdn] = cancel
+	mutex.Unlock()
+	checkerLogger.Info(reason)
+	go startCheckForRebootedSystem(cc, req, cc.Csetting, cancel)
+	return true
+}
+
+// startCheckForRebootedSystem runs the reboot completion check until it succeeded reboot_completion_check_consecutive_successes times
+// or until the restart slot of the FQDN gets released or expired, which closes cancel
+func startCheckForRebootedSystem(cc clusterCheck, req request, cs clusterSetting, cancel chan struct{}) {
+	defer func() {
+		mutex.Lock()
+		// a cancelled check may already be replaced by the check of the next go_ahead of the FQDN
+		if runningClusterChecks[cc.Fqdn] == cancel {
+			delete(runningClusterChecks, cc.Fqdn)
+		}
+		mutex.Unlock()
+	}()
 	checkerLogger.Info("Starting check for rebooted system in cluster " + cc.Cluster + " with fqdn: " + cc.Fqdn)
+	if len(req.Uptime) < 1 {
+		// the reboot_completion_check_offset elapsed without an inquire request, keep the uptime of the ACK of the FQDN
+		if ack, found, err := stateStore.GetHostAck(cc.Cluster, cc.Fqdn); err == nil && found {
+			req.Uptime = ack.ReportedUptime
+		}
+	}
 	successfulChecks := 0
+	checkAttempts := 0
+	var firstSeenBackAt time.Time
 	for {
-		command := strings.Replace(cc.Csetting.RebootCompletionCheck, "{:%fqdn%:}", cc.Fqdn, -1)
-		command = strings.Replace(command, "{:%hostname%:}", cc.Fqdn, -1)
-		command = strings.Replace(command, "{:%cluster%:}", cc.Fqdn, -1)
-		er := executeCommand(command, 5, !cs.RaiseErrors, checkerLogger)
-		checkerLogger.Info("Check result of "+command+" is ", er.returnCode)
+		if cancelled(cancel) {
+			checkerLogger.Info("Stopped check for rebooted system in cluster " + cc.Cluster + " with fqdn: " + cc.Fqdn + " because its restart slot was released")
+			return
+		}
+		checkAttempts++
+		completed, result := cc.Csetting.RebootCompletionCheck.run(newHookData(cc.Fqdn, cc.Cluster, cc.Csetting), cc.Csetting.hookTimeout("completion_check"), cs.RaiseErrors, checkerLogger)
+		checkerLogger.Info(result)
 
-		if er.returnCode == 0 {
+		if completed {
+			if firstSeenBackAt.IsZero() {
+				firstSeenBackAt = time.Now()
+			}
 			successfulChecks++
 			checkerLogger.Info("Increasing successful check counter to " + strconv.Itoa(successfulChecks) + " of " + strconv.Itoa(cc.Csetting.RebootCompletionCheckConsecutiveSuccesses) + " for rebooted system in cluster " + cc.Cluster + " with fqdn: " + cc.Fqdn)
 			if successfulChecks >= cc.Csetting.RebootCompletionCheckConsecutiveSuccesses {
@@ -33,15 +140,33 @@ func startCheckForRebootedSystem(cc clusterCheck, req request, cs clusterSetting
 			successfulChecks = 0
 		}
 		//checkerLogger.Info("Sleeping for reboot_completion_check_interval: " + cc.Csetting.RebootCompletionCheckInterval.String())
-		time.Sleep(cc.Csetting.RebootCompletionCheckInterval)
+		select {
+		case <-cancel:
+		case <-time.After(cc.Csetting.RebootCompletionCheckInterval):
+		}
+	}
+	if cancelled(cancel) {
+		checkerLogger.Info("Ignoring successful check for rebooted system in cluster " + cc.Cluster + " with fqdn: " + cc.Fqdn + " because its restart slot was released")
+		return
 	}
 	checkerLogger.Info("fqdn: " + cc.Fqdn + " seems to have successfully rebooted in cluster " + cc.Cluster)
-	clusterLogger := clusterLoggers[cc.Cluster]
+	mutex.Lock()
+	clusterLogger := stateLogger(cc.Cluster)
+	mutex.Unlock()
 	clusterLogger.Info("fqdn: " + cc.Fqdn + " seems to have successfully rebooted in cluster " + cc.Cluster)
-	triggerRebootCompletionActions(cc.Fqdn, cc.Cluster, req.Uptime, clusterLogger)
+	previous, _ := readClusterState(cc.Cluster)
+	d := newHookData(cc.Fqdn, cc.Cluster, cc.Csetting).withRestartingHosts(previous)
+	d.Uptime = req.Uptime
+	d.RequestID = cc.RequestID
+	triggerRebootCompletionActions(d, cc.Csetting, clusterLogger)
 	//deleteAckFile(cc.Fqdn, cc.Cluster)
 	// decrement current restarts for cluster
-	modifyClusterState(cc.Cluster, cc.Fqdn, "remove", clusterLogger)
+	if cs, grantedAt, err := modifyClusterState(cc.Cluster, cc.Fqdn, "remove", clusterLogger); err != nil {
+		clusterLogger.Error("Could not remove fqdn: " + cc.Fqdn + " from restarting servers of cluster " + cc.Cluster + " " + err.Error())
+	} else {
+		audit(auditRecord{Event: auditEventCompleted, RequestID: cc.RequestID, Fqdn: cc.Fqdn, Cluster: cc.Cluster, Reason: "reboot_completion_check succeeded", State: &cs})
+		recordRebootCycle(rebootCycle{Fqdn: cc.Fqdn, Cluster: cc.Cluster, GrantedAt: grantedAt, FirstSeenBackAt: firstSeenBackAt, CheckAttempts: checkAttempts, Outcome: rebootOutcomeCompleted})
+	}
 	res := response{}
 	res.Timestamp = time.Now()
 	res.RequestingFqdn = cc.Fqdn
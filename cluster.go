@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -10,97 +14,204 @@ import (
 )
 
 type rebootCompletionPanicActionsStruct struct {
-	Mail    []string `yaml:"mail"` // TODO: not implemented yet!
-	Scripts []string `yaml:"scripts"`
+	Mail    []string     `yaml:"mail" json:"mail"`
+	Scripts []hookAction `yaml:"scripts" json:"scripts"`
 }
 
 // clusterSetting contains the key value pairs from the config file
 type clusterSetting struct {
-	Enabled                                   bool                               `yaml:"enabled"`
-	NamePattern                               string                             `yaml:"name_pattern"`
-	BlacklistNamePattern                      []string                           `yaml:"blacklist_name_pattern"`
-	ClusterType                               string                             `yaml:"cluster_type"`
-	AllowedParallelRestarts                   int                                `yaml:"allowed_parallel_restarts"`
-	RebootCompletionCheck                     string                             `yaml:"reboot_completion_check"`
-	RebootCompletionCheckInterval             time.Duration                      `yaml:"reboot_completion_check_interval"`
-	RebootCompletionCheckConsecutiveSuccesses int                                `yaml:"reboot_completion_check_consecutive_successes"`
-	RebootCompletionCheckOffset               time.Duration                      `yaml:"reboot_completion_check_offset"`
-	RebootCompletionActions                   []string                           `yaml:"reboot_completion_actions"`
-	RebootCompletionPanicThreshold            time.Duration                      `yaml:"reboot_completion_panic_threshold"`
-	RebootCompletionPanicActions              rebootCompletionPanicActionsStruct `yaml:"reboot_completion_panic_actions"`
-	MinimumUptime                             time.Duration                      `yaml:"minimum_uptime"`
-	RebootGoaheadActions                      []string                           `yaml:"reboot_goahead_actions"`
-	RebootGoaheadChecks                       []string                           `yaml:"reboot_goahead_checks"`
-	RebootGoaheadChecksExitCodeForReboot      int                                `yaml:"reboot_goahead_checks_exit_code_for_reboot"`
-	RaiseErrors                               bool                               `yaml:"raise_errors"`
+	Enabled                                   bool                               `yaml:"enabled" json:"enabled"`
+	Priority                                  int                                `yaml:"priority" json:"priority"`
+	NamePattern                               string                             `yaml:"name_pattern" json:"name_pattern"`
+	BlacklistNamePattern                      []string                           `yaml:"blacklist_name_pattern" json:"blacklist_name_pattern"`
+	ClusterType                               string                             `yaml:"cluster_type" json:"cluster_type"`
+	PrimaryCheck                              string                             `yaml:"primary_check" json:"primary_check"`
+	ClusterSize                               int                                `yaml:"cluster_size" json:"cluster_size"`
+	AllowedParallelRestarts                   parallelRestarts                   `yaml:"allowed_parallel_restarts" json:"allowed_parallel_restarts"`
+	Members                                   clusterMembers                     `yaml:"members" json:"members"`
+	DependsOn                                 []string                           `yaml:"depends_on" json:"depends_on"`
+	MutuallyExclusiveWith                     []string                           `yaml:"mutually_exclusive_with" json:"mutually_exclusive_with"`
+	Labels                                    map[string]string                  `yaml:"labels" json:"labels"`
+	RebootCompletionCheck                     completionCheck                    `yaml:"reboot_completion_check" json:"reboot_completion_check"`
+	RebootCompletionCheckInterval             time.Duration                      `yaml:"reboot_completion_check_interval" json:"reboot_completion_check_interval"`
+	RebootCompletionCheckConsecutiveSuccesses int                                `yaml:"reboot_completion_check_consecutive_successes" json:"reboot_completion_check_consecutive_successes"`
+	RebootCompletionCheckOffset               time.Duration                      `yaml:"reboot_completion_check_offset" json:"reboot_completion_check_offset"`
+	RebootCompletionActions                   []hookAction                       `yaml:"reboot_completion_actions" json:"reboot_completion_actions"`
+	RebootCompletionPanicThreshold            time.Duration                      `yaml:"reboot_completion_panic_threshold" json:"reboot_completion_panic_threshold"`
+	RebootCompletionPanicActions              rebootCompletionPanicActionsStruct `yaml:"reboot_completion_panic_actions" json:"reboot_completion_panic_actions"`
+	RebootCompletionMaxDuration               time.Duration                      `yaml:"reboot_completion_max_duration" json:"reboot_completion_max_duration"`
+	RebootCompletionExpiryPolicy              string                             `yaml:"reboot_completion_expiry_policy" json:"reboot_completion_expiry_policy"`
+	QuarantineOnPanic                         bool                               `yaml:"quarantine_on_panic" json:"quarantine_on_panic"`
+	MinimumUptime                             time.Duration                      `yaml:"minimum_uptime" json:"minimum_uptime"`
+	RebootGoaheadActions                      []hookAction                       `yaml:"reboot_goahead_actions" json:"reboot_goahead_actions"`
+	RebootGoaheadChecks                       []string                           `yaml:"reboot_goahead_checks" json:"reboot_goahead_checks"`
+	RebootGoaheadChecksExitCodeForReboot      int                                `yaml:"reboot_goahead_checks_exit_code_for_reboot" json:"reboot_goahead_checks_exit_code_for_reboot"`
+	RaiseErrors                               bool                               `yaml:"raise_errors" json:"raise_errors"`
+	MaintenanceWindows                        []maintenanceWindow                `yaml:"maintenance_windows" json:"maintenance_windows"`
+	HookTimeouts                              map[string]time.Duration           `yaml:"hook_timeouts" json:"hook_timeouts"`
+	nameRegex                                 *regexp.Regexp
+	blacklistRegexes                          []*regexp.Regexp
 }
 
 // clusterState contains information over the cluster (how many nodes are currently restarting, when was the last cluster node restart, how many of the cluster nodes are up-to-date)
 type clusterState struct {
-	LastRestartPanicTimestamp      time.Time           `json:"last_restart_panic_timestamp"`
-	LastRestartRequestTimestamp    time.Time           `json:"last_restart_request_timestamp"`
-	LastSuccessfulRestartTimestamp time.Time           `json:"last_successful_restart_timestamp"`
-	CurrentOngoingRestarts         int                 `yaml:"current_ongoing_restarts"`
-	CurrentRestartingServers       map[string]struct{} `yaml:"current_restarting_servers"`
+	LastRestartPanicTimestamp      time.Time                 `json:"last_restart_panic_timestamp"`
+	LastRestartRequestTimestamp    time.Time                 `json:"last_restart_request_timestamp"`
+	LastSuccessfulRestartTimestamp time.Time                 `json:"last_successful_restart_timestamp"`
+	CurrentOngoingRestarts         int                       `yaml:"current_ongoing_restarts"`
+	CurrentRestartingServers       map[string]struct{}       `yaml:"current_restarting_servers"`
+	RebootedServers                map[string]time.Time      `json:"rebooted_servers,omitempty"`
+	RestartGrantedTimestamps       map[string]time.Time      `json:"restart_granted_timestamps,omitempty"`
+	ExpiredRestarts                map[string]expiredRestart `json:"expired_restarts,omitempty"`
+	Revision                       uint64                    `json:"revision"`
 }
 
-// readclusterSettingsFile creates the ConfigSettings struct from the config file
-func readClusterSetting(clusterSettingsFile string) {
+// readClusterSetting parses and validates the cluster settings of a single cluster settings config file
+func readClusterSetting(clusterSettingsFile string) (map[string]clusterSetting, error) {
 	mainLogger.Debug("Trying to read cluster settings config file: " + clusterSettingsFile)
 	data, err := os.ReadFile(clusterSettingsFile)
 	if err != nil {
-		mainLogger.Fatal("readclusterSettingsFile(): There was an error parsing the config file " + clusterSettingsFile + ": " + err.Error())
+		return nil, errors.New("readclusterSettingsFile(): There was an error parsing the config file " + clusterSettingsFile + ": " + err.Error())
 	}
 
 	var cs map[string]clusterSetting
 	err = yaml.Unmarshal([]byte(data), &cs)
 	if err != nil {
-		mainLogger.Fatal("In file " + clusterSettingsFile + ": YAML unmarshal error: " + err.Error())
+		return nil, errors.New("In file " + clusterSettingsFile + ": YAML unmarshal error: " + err.Error())
 	}
 
 	for clusterName, clusterSetting := range cs {
-		mainLogger.Debug("Adding cluster settings " + clusterName)
-		clusterSettings[clusterName] = clusterSetting
-		clusterLogger := initLogger(clusterName)
-		clusterLoggers[clusterName] = clusterLogger
-		clusterLogger.Infof("Using cluster settings: %+v", clusterSetting)
+		if problems := validateClusterSetting(&clusterSetting); len(problems) > 0 {
+			return nil, errors.New("In file " + clusterSettingsFile + " for cluster " + clusterName + ": " + strings.Join(problems, ", "))
+		}
+		cs[clusterName] = clusterSetting
 	}
+	return cs, nil
 }
 
-// triggerRebootGoaheadActions executes optional scripts that should run, when a host recieved the go_ahead to restart
-func triggerRebootGoaheadActions(fqdn string, cluster string, uptime string, clusterLogger *logrus.Entry) {
-	for _, action := range clusterSettings[cluster].RebootGoaheadActions {
-		command := strings.Replace(action, "{:%fqdn%:}", fqdn, -1)
-		command = strings.Replace(command, "{:%cluster%:}", cluster, -1)
-		command = strings.Replace(command, "{:%uptime%:}", uptime, -1)
-		command = strings.Replace(command, "{:%hostname%:}", strings.SplitN(fqdn, ".", 2)[0], -1)
-		er := executeCommand(command, 5, !clusterSettings[cluster].RaiseErrors, clusterLogger)
-		clusterLogger.Info("goahead action result of "+command+" is ", er.returnCode)
+// loadClusterSettings reads every *.yml and *.yaml cluster settings file inside the include_dir and validates the cluster settings together
+func loadClusterSettings(includeDir string) (map[string]clusterSetting, error) {
+	settings := make(map[string]clusterSetting)
+	if len(includeDir) < 1 || !isDir(includeDir) {
+		return settings, nil
+	}
+	mainLogger.Debug("Glob'ing with " + includeDir + "**/*.(yml|yaml)")
+	files := []string{}
+	err := filepath.Walk(includeDir, func(path string, f os.FileInfo, err error) error {
+		mainLogger.Info("Checking for file extension on file: " + path)
+		if filepath.Ext(path) == ".yml" || filepath.Ext(path) == ".yaml" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("Failed to glob cluster settings include_dir with glob path " + includeDir + "**/*.(yml|yaml) Error: " + err.Error())
+	}
+	if len(files) == 0 {
+		return nil, errors.New("Could not find any cluster settings matching " + includeDir + "**/*.(yml|yaml)")
 	}
+	Debugf("found potential module versions:" + strings.Join(files, " "))
+	clusterFiles := make(map[string]string)
+	for _, f := range files {
+		cs, err := readClusterSetting(f)
+		if err != nil {
+			return nil, err
+		}
+		for clusterName, clusterSetting := range cs {
+			if previous, ok := clusterFiles[clusterName]; ok {
+				return nil, errors.New("Cluster " + clusterName + " in file " + f + " is already defined in file " + previous)
+			}
+			clusterFiles[clusterName] = f
+			mainLogger.Debug("Adding cluster settings " + clusterName)
+			settings[clusterName] = clusterSetting
+		}
+	}
+	if err := validateClusterDependencies(settings); err != nil {
+		return nil, errors.New("Invalid cluster dependencies: " + err.Error())
+	}
+	return settings, nil
 }
 
-// triggerRebootCompletionActions executes optional scripts that should run, when a host is flagged as sucsessfully rebooted
-func triggerRebootCompletionActions(fqdn string, cluster string, uptime string, clusterLogger *logrus.Entry) {
-	for _, action := range clusterSettings[cluster].RebootCompletionActions {
-		clusterLogger.Info("found reboot completion action:" + action)
-		command := strings.Replace(action, "{:%fqdn%:}", fqdn, -1)
-		command = strings.Replace(command, "{:%cluster%:}", cluster, -1)
-		command = strings.Replace(command, "{:%uptime%:}", uptime, -1)
-		command = strings.Replace(command, "{:%hostname%:}", strings.SplitN(fqdn, ".", 2)[0], -1)
-		er := executeCommand(command, 5, !clusterSettings[cluster].RaiseErrors, clusterLogger)
-		clusterLogger.Info("reboot completion action result of "+command+" is ", er.returnCode)
+// currentClusterSettings returns the cluster settings and the cluster loggers of the running config.
+// reloadConfig replaces both maps as a whole, so a request can keep working on the returned maps without holding the mutex.
+func currentClusterSettings() (map[string]clusterSetting, map[string]*logrus.Entry) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return clusterSettings, currentClusterLoggers()
+}
+
+// runningClusterLoggers are the loggers of all known clusters. They are replaced as a whole, so that they can be
+// read without the mutex, which the callers of stateLogger often already hold.
+var runningClusterLoggers atomic.Pointer[map[string]*logrus.Entry]
+
+// currentClusterLoggers returns the loggers of all known clusters, the returned map must not be modified
+func currentClusterLoggers() map[string]*logrus.Entry {
+	if loggers := runningClusterLoggers.Load(); loggers != nil {
+		return *loggers
 	}
+	return map[string]*logrus.Entry{}
+}
+
+// setClusterLoggers replaces the loggers of all known clusters
+func setClusterLoggers(loggers map[string]*logrus.Entry) {
+	runningClusterLoggers.Store(&loggers)
 }
 
-// triggerRebootCompletionPanicActions executes optional scripts that should run when a host of a list will not back after reboot
-func triggerRebootCompletionPanicActions(fqdn string, cluster string, uptime string, clusterLogger *logrus.Entry) {
-	for _, action := range clusterSettings[cluster].RebootCompletionPanicActions.Scripts {
-		clusterLogger.Info("found reboot completion panic action:" + action)
-		command := strings.Replace(action, "{:%fqdn%:}", fqdn, -1)
-		command = strings.Replace(command, "{:%cluster%:}", cluster, -1)
-		command = strings.Replace(command, "{:%uptime%:}", uptime, -1)
-		command = strings.Replace(command, "{:%hostname%:}", strings.SplitN(fqdn, ".", 2)[0], -1)
-		er := executeCommand(command, 5, !clusterSettings[cluster].RaiseErrors, clusterLogger)
-		clusterLogger.Info("reboot completion panic action result of "+command+" is ", er.returnCode)
+// clusterLoggersFor returns a logger for every given cluster and reuses the already opened loggers of the existing clusters
+func clusterLoggersFor(settings map[string]clusterSetting, existing map[string]*logrus.Entry) map[string]*logrus.Entry {
+	loggers := make(map[string]*logrus.Entry)
+	for clusterName, clusterSetting := range settings {
+		clusterLogger, ok := existing[clusterName]
+		if !ok {
+			clusterLogger = initLogger(clusterName)
+		}
+		loggers[clusterName] = clusterLogger
+		clusterLogger.Infof("Using cluster settings: %+v", clusterSetting)
 	}
+	return loggers
+}
+
+// hookNames are the hooks whose timeout can be set with hook_timeouts
+var hookNames = []string{"goahead_check", "goahead_action", "completion_check", "completion_action", "panic_action", "primary_check", "members_command"}
+
+// hookTimeout returns the hook_timeouts entry of the hook or the global hook_timeout
+func (csetting clusterSetting) hookTimeout(hook string) time.Duration {
+	if timeout, ok := csetting.HookTimeouts[hook]; ok && timeout > 0 {
+		return timeout
+	}
+	return currentConfig().HookTimeout
+}
+
+// hookActions returns the reboot_goahead_actions, reboot_completion_actions or reboot_completion_panic_actions scripts that get executed for the hook
+func (csetting clusterSetting) hookActions(hook string) []hookAction {
+	switch hook {
+	case "goahead_action":
+		return csetting.RebootGoaheadActions
+	case "completion_action":
+		return csetting.RebootCompletionActions
+	case "panic_action":
+		return csetting.RebootCompletionPanicActions.Scripts
+	}
+	return nil
+}
+
+// triggerRebootGoaheadActions queues optional scripts that should run, when a host recieved the go_ahead to restart
+func triggerRebootGoaheadActions(d hookData, csetting clusterSetting, clusterLogger *logrus.Entry) {
+	enqueueActions("goahead_action", csetting.RebootGoaheadActions, d, csetting, clusterLogger)
+}
+
+// triggerRebootCompletionActions queues optional scripts that should run, when a host is flagged as sucsessfully rebooted
+func triggerRebootCompletionActions(d hookData, csetting clusterSetting, clusterLogger *logrus.Entry) {
+	enqueueActions("completion_action", csetting.RebootCompletionActions, d, csetting, clusterLogger)
+}
+
+// triggerRebootCompletionPanicActions queues optional scripts and sends the optional mails that should happen when a host of a list will not back after reboot.
+// kind is either panicKindThreshold or panicKindMaxDuration and is available as {:%panic_reason%:} placeholder.
+func triggerRebootCompletionPanicActions(d hookData, kind string, reason string, cs clusterState, csetting clusterSetting, clusterLogger *logrus.Entry) {
+	clusterLogger.Info("Triggering reboot completion panic actions for cluster " + d.Cluster + " because of " + kind + ": " + reason)
+	d = d.withRestartingHosts(cs)
+	d.PanicReason = kind
+	enqueueActions("panic_action", csetting.RebootCompletionPanicActions.Scripts, d, csetting, clusterLogger)
+	// the SMTP session may take up to 4 times the timeout, which is longer than the write timeout of the restart requests
+	go sendPanicMail(d.Fqdn, d.Cluster, kind, reason, cs, csetting, clusterLogger)
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// supported cluster_type values
+const (
+	clusterTypeActiveActive  = "active/active"
+	clusterTypeActivePassive = "active/passive"
+	clusterTypeQuorum        = "quorum"
+	clusterTypeStandalone    = "standalone"
+)
+
+// validateClusterType checks the cluster_type and the settings it depends on
+func validateClusterType(csetting clusterSetting) error {
+	switch csetting.ClusterType {
+	case "", clusterTypeActiveActive, clusterTypeStandalone:
+	case clusterTypeActivePassive:
+		if len(csetting.PrimaryCheck) < 1 {
+			return errors.New("cluster_type " + clusterTypeActivePassive + " requires a primary_check command")
+		}
+	case clusterTypeQuorum:
+		if csetting.ClusterSize < 1 && !csetting.Members.configured() {
+			return errors.New("cluster_type " + clusterTypeQuorum + " requires a cluster_size larger than 0 or a members inventory")
+		}
+	default:
+		return errors.New("unknown cluster_type " + csetting.ClusterType + " Valid values are " + strings.Join([]string{clusterTypeActiveActive, clusterTypeActivePassive, clusterTypeQuorum, clusterTypeStandalone}, ", "))
+	}
+	return nil
+}
+
+// allowedParallelRestarts returns how many hosts of the cluster may restart at the same time and a description of the limit.
+// Percentages are computed against the given cluster members and quorum clusters never allow more restarts than keep N/2+1 of their members up.
+func allowedParallelRestarts(csetting clusterSetting, members []string) (int, string) {
+	allowed := csetting.AllowedParallelRestarts.allowed(len(members))
+	description := "allowed_parallel_restarts"
+	if csetting.AllowedParallelRestarts.Percent > 0 {
+		description += " " + csetting.AllowedParallelRestarts.String() + " of " + strconv.Itoa(len(members)) + " members"
+	}
+	if csetting.ClusterType == clusterTypeQuorum {
+		size := csetting.ClusterSize
+		if size < 1 {
+			size = len(members)
+		}
+		quorum := size/2 + 1
+		quorumAllowed := size - quorum
+		if quorumAllowed < allowed || csetting.AllowedParallelRestarts == (parallelRestarts{}) {
+			allowed = quorumAllowed
+			description = "quorum limit of cluster_size " + strconv.Itoa(size) + " that needs " + strconv.Itoa(quorum) + " members up"
+		}
+	}
+	return allowed, description
+}
+
+// checkPrimary runs the primary_check of an active/passive cluster and returns if the FQDN must not restart, because it is or might be the current primary.
+// The primary_check has to exit with 0 if the FQDN is the current primary and with 1 if it is not, any other result is treated as primary.
+func checkPrimary(d hookData, csetting clusterSetting, clusterLogger *logrus.Entry) (bool, string) {
+	if csetting.ClusterType != clusterTypeActivePassive {
+		return false, ""
+	}
+	fqdn, cluster := d.Fqdn, d.Cluster
+	command, er := executeHook("primary_check", csetting.PrimaryCheck, d, csetting.hookTimeout("primary_check"), false, clusterLogger)
+	clusterLogger.Info("primary check result of " + command + " is " + er.String())
+	if er.timedOut {
+		return true, "Denied restart request, because primary check of active/passive cluster " + cluster + " timed out after " + er.timeout.String() + " for FQDN " + fqdn
+	}
+	switch er.returnCode {
+	case 1:
+		return false, ""
+	case 0:
+		return true, "Denied restart request, because FQDN " + fqdn + " is the current primary of active/passive cluster " + cluster
+	}
+	return true, "Denied restart request, because primary check of active/passive cluster " + cluster + " returned unexpected exit code " + strconv.Itoa(er.returnCode) + " for FQDN " + fqdn
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	completionCheckExec = "exec"
+	completionCheckTCP  = "tcp"
+	completionCheckHTTP = "http"
+	completionCheckTLS  = "tls"
+)
+
+// completionCheck is the reboot_completion_check of a cluster.
+// It is either a shell command like before or a structured check with a type, that goahead executes in-process.
+type completionCheck struct {
+	Type               string        `yaml:"type" json:"type"`
+	Command            string        `yaml:"command" json:"command,omitempty"`
+	Address            string        `yaml:"address" json:"address,omitempty"`
+	URL                string        `yaml:"url" json:"url,omitempty"`
+	Method             string        `yaml:"method" json:"method,omitempty"`
+	ExpectedStatus     []int         `yaml:"expected_status" json:"expected_status,omitempty"`
+	BodyRegex          string        `yaml:"body_regex" json:"body_regex,omitempty"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify" json:"insecure_skip_verify,omitempty"`
+	CaFile             string        `yaml:"ca_file" json:"ca_file,omitempty"`
+	ServerName         string        `yaml:"server_name" json:"server_name,omitempty"`
+	MinValidity        time.Duration `yaml:"min_validity" json:"min_validity,omitempty"`
+	Timeout            time.Duration `yaml:"timeout" json:"timeout,omitempty"`
+	bodyRegex          *regexp.Regexp
+	rootCAs            *x509.CertPool
+}
+
+// completionCheckFields is completionCheck without its methods to unmarshal the structured form
+type completionCheckFields completionCheck
+
+// UnmarshalYAML accepts reboot_completion_check: ./check.sh as well as a structured check with a type
+func (c *completionCheck) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		*c = completionCheck{Type: completionCheckExec, Command: command}
+		return nil
+	}
+	var fields completionCheckFields
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	*c = completionCheck(fields)
+	return nil
+}
+
+// MarshalJSON returns the shell command of exec checks like in the cluster config
+func (c completionCheck) MarshalJSON() ([]byte, error) {
+	if c.checkType() == completionCheckExec {
+		return json.Marshal(c.Command)
+	}
+	return json.Marshal(completionCheckFields(c))
+}
+
+// UnmarshalJSON accepts the shell command or the structured check returned by MarshalJSON
+func (c *completionCheck) UnmarshalJSON(data []byte) error {
+	var command string
+	if err := json.Unmarshal(data, &command); err == nil {
+		*c = completionCheck{Type: completionCheckExec, Command: command}
+		return nil
+	}
+	var fields completionCheckFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*c = completionCheck(fields)
+	return nil
+}
+
+func (c completionCheck) checkType() string {
+	if len(c.Type) < 1 {
+		return completionCheckExec
+	}
+	return c.Type
+}
+
+// String describes the check for log messages
+func (c completionCheck) String() string {
+	switch c.checkType() {
+	case completionCheckTCP, completionCheckTLS:
+		return c.checkType() + " " + c.Address
+	case completionCheckHTTP:
+		return c.checkType() + " " + c.URL
+	}
+	return c.Command
+}
+
+// parse validates the check and compiles its body_regex and loads its ca_file
+func (c *completionCheck) parse() error {
+	switch c.checkType() {
+	case completionCheckExec:
+		if len(c.Command) < 1 {
+			return errors.New("missing reboot_completion_check")
+		}
+	case completionCheckTCP, completionCheckTLS:
+		if len(c.Address) < 1 {
+			return errors.New("reboot_completion_check of type " + c.Type + " needs an address like {:%fqdn%:}:22")
+		}
+	case completionCheckHTTP:
+		if len(c.URL) < 1 {
+			return errors.New("reboot_completion_check of type http needs an url like https://{:%fqdn%:}/health")
+		}
+	default:
+		return errors.New("unknown reboot_completion_check type " + c.Type + " Use exec, tcp, http or tls")
+	}
+	if c.Timeout < 0 || c.MinValidity < 0 {
+		return errors.New("reboot_completion_check timeout and min_validity must not be negative")
+	}
+	c.bodyRegex = nil
+	if len(c.BodyRegex) > 0 {
+		re, err := regexp.Compile(c.BodyRegex)
+		if err != nil {
+			return errors.New("invalid reboot_completion_check body_regex " + c.BodyRegex + ": " + err.Error())
+		}
+		c.bodyRegex = re
+	}
+	c.rootCAs = nil
+	if len(c.CaFile) > 0 {
+		pem, err := os.ReadFile(c.CaFile)
+		if err != nil {
+			return errors.New("could not read reboot_completion_check ca_file " + c.CaFile + ": " + err.Error())
+		}
+		c.rootCAs = x509.NewCertPool()
+		if !c.rootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in reboot_completion_check ca_file " + c.CaFile)
+		}
+	}
+	return nil
+}
+
+func (c completionCheck) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (c completionCheck) tlsConfig(host string) *tls.Config {
+	serverName := c.ServerName
+	if len(serverName) < 1 {
+		serverName = host
+	}
+	return &tls.Config{ServerName: serverName, RootCAs: c.rootCAs, InsecureSkipVerify: c.InsecureSkipVerify}
+}
+
+// run executes the reboot_completion_check once for the FQDN and returns if the host completed its reboot and a description of the result.
+// Commands of exec checks get killed after the timeout of the check or else after hookTimeout.
+func (c completionCheck) run(d hookData, hookTimeout time.Duration, raiseErrors bool, logger *logrus.Entry) (bool, string) {
+	if c.checkType() == completionCheckExec {
+		if c.Timeout > 0 {
+			hookTimeout = c.Timeout
+		}
+		command, er := executeHook("completion_check", c.Command, d, hookTimeout, !raiseErrors, logger)
+		return er.returnCode == 0 && !er.timedOut, "Check result of " + command + " is " + er.String()
+	}
+	d.Hook = "completion_check"
+	target, err := renderHookTemplate(c.Address, d)
+	if c.checkType() == completionCheckHTTP {
+		target, err = renderHookTemplate(c.URL, d)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return false, "Check result of " + c.checkType() + " check is " + err.Error()
+	}
+	before := time.Now()
+	switch c.checkType() {
+	case completionCheckTCP:
+		err = c.checkTCP(target)
+	case completionCheckTLS:
+		err = c.checkTLS(target)
+	case completionCheckHTTP:
+		err = c.checkHTTP(target)
+	}
+	hookDurations.observe(time.Since(before), "completion_check")
+	if err != nil {
+		return false, "Check result of " + c.checkType() + " check " + target + " is " + err.Error()
+	}
+	return true, "Check result of " + c.checkType() + " check " + target + " is OK"
+}
+
+func (c completionCheck) checkTCP(address string) error {
+	conn, err := net.DialTimeout("tcp", address, c.timeout())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkTLS verifies the certificate chain of the TLS service unless insecure_skip_verify is set and that the certificate is still valid for min_validity
+func (c completionCheck) checkTLS(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{Timeout: c.timeout()}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, c.tlsConfig(host))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) < 1 {
+		return errors.New("no certificate presented by " + address)
+	}
+	if notAfter := certs[0].NotAfter; time.Until(notAfter) < c.MinValidity {
+		return errors.New("certificate of " + address + " expires at " + notAfter.Format(time.RFC3339) + " which is within the min_validity of " + c.MinValidity.String())
+	}
+	return nil
+}
+
+// checkHTTP requests the URL and compares the status code with expected_status, which defaults to 200, and the body with body_regex
+func (c completionCheck) checkHTTP(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+	method := c.Method
+	if len(method) < 1 {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: c.tlsConfig(req.URL.Hostname()), DisableKeepAlives: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	expected := c.ExpectedStatus
+	if len(expected) < 1 {
+		expected = []int{http.StatusOK}
+	}
+	found := false
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("unexpected HTTP status " + strconv.Itoa(resp.StatusCode) + " of " + url)
+	}
+	if c.bodyRegex != nil {
+		// only read the first MB of the body, health checks are small
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		if err != nil {
+			return err
+		}
+		if !c.bodyRegex.Match(body) {
+			return errors.New("body of " + url + " does not match body_regex " + c.BodyRegex)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
@@ -10,30 +14,85 @@ import (
 
 // configSettings contains the key value pairs from the config file
 type configSettings struct {
-	Timeout                    time.Duration `yaml:"timeout"`
-	IncludeDir                 string        `yaml:"include_dir"`
-	ListenAddress              string        `yaml:"listen_address"`
-	ListenPort                 int           `yaml:"listen_port"`
-	PrivateKey                 string        `yaml:"ssl_private_key"`
-	CertificateFile            string        `yaml:"ssl_certificate_file"`
-	RequireAndVerifyClientCert bool          `yaml:"ssl_require_and_verify_client_cert"`
-	ClientCertCaFile           string        `yaml:"ssl_client_cert_ca_file"`
-	SaveStateDir               string        `yaml:"save_state_dir"`
-	LogBaseDir                 string        `yaml:"log_base_dir"`
+	Timeout                       time.Duration  `yaml:"timeout"`
+	IncludeDir                    string         `yaml:"include_dir"`
+	ListenAddress                 string         `yaml:"listen_address"`
+	ListenPort                    int            `yaml:"listen_port"`
+	PrivateKey                    string         `yaml:"ssl_private_key"`
+	CertificateFile               string         `yaml:"ssl_certificate_file"`
+	RequireAndVerifyClientCert    bool           `yaml:"ssl_require_and_verify_client_cert"`
+	ClientCertCaFile              string         `yaml:"ssl_client_cert_ca_file"`
+	SaveStateDir                  string         `yaml:"save_state_dir"`
+	LogBaseDir                    string         `yaml:"log_base_dir"`
+	SMTPServer                    string         `yaml:"smtp_server"`
+	SMTPPort                      int            `yaml:"smtp_port"`
+	SMTPUsername                  string         `yaml:"smtp_username"`
+	SMTPPassword                  string         `yaml:"smtp_password"`
+	SMTPFrom                      string         `yaml:"smtp_from"`
+	SMTPTLS                       string         `yaml:"smtp_tls"`
+	SMTPInsecureSkipVerify        bool           `yaml:"smtp_tls_insecure_skip_verify"`
+	PanicMailTemplate             string         `yaml:"panic_mail_template"`
+	AdminAPITokens                []string       `yaml:"admin_api_tokens"`
+	AdminClientCertCNs            []string       `yaml:"admin_client_cert_cns"`
+	FreezePeriods                 []freezePeriod `yaml:"freeze_periods"`
+	FreezePeriodsFile             string         `yaml:"freeze_periods_file"`
+	StateBackend                  string         `yaml:"state_backend"`
+	StateBoltFile                 string         `yaml:"state_bolt_file"`
+	GlobalAllowedParallelRestarts int            `yaml:"global_allowed_parallel_restarts"`
+	RestartBudgets                map[string]int `yaml:"restart_budgets"`
+	SampleHostsFile               string         `yaml:"sample_hosts_file"`
+	RebootCompletionSweepInterval time.Duration  `yaml:"reboot_completion_sweep_interval"`
+	AuditLogFile                  string         `yaml:"audit_log_file"`
+	AuditLogMaxSizeMB             int            `yaml:"audit_log_max_size_mb"`
+	AuditLogMaxBackups            int            `yaml:"audit_log_max_backups"`
+	HistoryRetention              time.Duration  `yaml:"history_retention"`
+	HistoryMaxCyclesPerHost       int            `yaml:"history_max_cycles_per_host"`
+	HookTimeout                   time.Duration  `yaml:"hook_timeout"`
+	JobWorkers                    int            `yaml:"job_workers"`
+	JobMaxAttempts                int            `yaml:"job_max_attempts"`
+	JobRetryBackoff               time.Duration  `yaml:"job_retry_backoff"`
+	JobRetention                  time.Duration  `yaml:"job_retention"`
 }
 
-// readConfigfile creates the configSettings struct from the config file
+// runningConfig is the config goahead currently runs with. reloadConfig replaces it as a whole,
+// so that every reader gets a consistent config without holding the mutex.
+var runningConfig atomic.Pointer[configSettings]
+
+// currentConfig returns the config goahead currently runs with. It is shared by all readers and must not be modified.
+func currentConfig() *configSettings {
+	if cfg := runningConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return &configSettings{}
+}
+
+// setConfig makes the given config the config goahead runs with
+func setConfig(cfg configSettings) {
+	runningConfig.Store(&cfg)
+}
+
+// readConfigfile creates the configSettings struct from the config file and the save_state_dir and terminates on errors
 func readConfigfile(configFile string) configSettings {
+	config, err := loadConfigfile(configFile)
+	if err != nil {
+		Fatalf(err.Error())
+	}
+	config.SaveStateDir = checkDirAndCreate(config.SaveStateDir, "save_state_dir from config file "+configFile)
+	return config
+}
+
+// loadConfigfile creates and validates the configSettings struct from the config file
+func loadConfigfile(configFile string) (configSettings, error) {
 	fmt.Println("Trying to read config file: " + configFile)
+	var config configSettings
 	data, err := os.ReadFile(configFile)
 	if err != nil {
-		Fatalf("readConfigfile(): There was an error parsing the config file " + configFile + ": " + err.Error())
+		return config, errors.New("readConfigfile(): There was an error parsing the config file " + configFile + ": " + err.Error())
 	}
 
-	var config configSettings
 	err = yaml.Unmarshal([]byte(data), &config)
 	if err != nil {
-		Fatalf("In config file " + configFile + ": YAML unmarshal error: " + err.Error())
+		return config, errors.New("In config file " + configFile + ": YAML unmarshal error: " + err.Error())
 	}
 
 	//fmt.Print("config: ")
@@ -41,19 +100,61 @@ func readConfigfile(configFile string) configSettings {
 
 	// set default timeout to 5 seconds if no timeout setting found
 	if config.Timeout == 0 {
-		config.Timeout = 5
+		config.Timeout = 5 * time.Second
 	}
 
 	if !fileExists(config.PrivateKey) {
-		Fatalf("Failed to find configured ssl_private_key " + config.PrivateKey)
+		return config, errors.New("Failed to find configured ssl_private_key " + config.PrivateKey)
 	}
 
 	if !fileExists(config.CertificateFile) {
-		Fatalf("Failed to find configured ssl_certificate_file " + config.CertificateFile)
+		return config, errors.New("Failed to find configured ssl_certificate_file " + config.CertificateFile)
 	}
 
 	if !fileExists(config.ClientCertCaFile) {
-		Fatalf("Failed to find configured ssl_client_cert_ca_file " + config.ClientCertCaFile)
+		return config, errors.New("Failed to find configured ssl_client_cert_ca_file " + config.ClientCertCaFile)
+	}
+
+	// set default interval of the reboot_completion_max_duration sweeper to 1 minute
+	if config.RebootCompletionSweepInterval < 0 {
+		return config, errors.New("Invalid reboot_completion_sweep_interval " + config.RebootCompletionSweepInterval.String() + " in config file " + configFile + " Leave it unset or use a positive duration")
+	} else if config.RebootCompletionSweepInterval == 0 {
+		config.RebootCompletionSweepInterval = time.Minute
+	}
+
+	// rotate the audit log after 100MB and keep 5 rotated audit logs by default
+	if config.AuditLogMaxSizeMB == 0 {
+		config.AuditLogMaxSizeMB = 100
+	}
+	if config.AuditLogMaxBackups == 0 {
+		config.AuditLogMaxBackups = 5
+	}
+
+	// kill hook commands after 10 seconds by default, which is below the WriteTimeout of restart requests
+	if config.HookTimeout <= 0 {
+		config.HookTimeout = 10 * time.Second
+	}
+
+	// execute the queued actions with 4 workers, give up after 3 attempts and keep finished jobs for a week by default
+	if config.JobWorkers <= 0 {
+		config.JobWorkers = 4
+	}
+	if config.JobMaxAttempts <= 0 {
+		config.JobMaxAttempts = 3
+	}
+	if config.JobRetryBackoff <= 0 {
+		config.JobRetryBackoff = 30 * time.Second
+	}
+	if config.JobRetention <= 0 {
+		config.JobRetention = 7 * 24 * time.Hour
+	}
+
+	// keep the restart history for one year and at most 50 reboot cycles per host by default
+	if config.HistoryRetention == 0 {
+		config.HistoryRetention = 365 * 24 * time.Hour
+	}
+	if config.HistoryMaxCyclesPerHost <= 0 {
+		config.HistoryMaxCyclesPerHost = 50
 	}
 
 	// set default listen address to 0.0.0.0
@@ -65,12 +166,56 @@ func readConfigfile(configFile string) configSettings {
 	if len(config.SaveStateDir) < 1 {
 		config.SaveStateDir = "/tmp/goahead/"
 	}
-	config.SaveStateDir = checkDirAndCreate(config.SaveStateDir, "config setting from config file "+configFile)
+	// the directory only gets created on startup, -validate and reloads must not create it
+	if fileExists(config.SaveStateDir) && !isDir(config.SaveStateDir) {
+		return config, errors.New("Configured save_state_dir " + config.SaveStateDir + " in config file " + configFile + " exists, but is not a directory")
+	}
+	config.SaveStateDir = normalizeDir(config.SaveStateDir)
 
 	// set default listen port to 8443
 	if config.ListenPort == 0 {
 		config.ListenPort = 8443
 	}
 
-	return config
+	// set default SMTP server for reboot_completion_panic_actions mail to localhost:25
+	if len(config.SMTPServer) < 1 {
+		config.SMTPServer = "localhost"
+	}
+	if config.SMTPPort == 0 {
+		config.SMTPPort = 25
+	}
+	if len(config.SMTPFrom) < 1 {
+		hostname, _ := os.Hostname()
+		config.SMTPFrom = "goahead@" + hostname
+	}
+	switch config.SMTPTLS {
+	case "", "none", "starttls", "tls":
+	default:
+		return config, errors.New("Invalid smtp_tls setting " + config.SMTPTLS + " in config file " + configFile + " Valid values are none, starttls or tls")
+	}
+	if len(config.PanicMailTemplate) > 0 && !fileExists(config.PanicMailTemplate) {
+		return config, errors.New("Failed to find configured panic_mail_template " + config.PanicMailTemplate)
+	}
+
+	if len(config.FreezePeriodsFile) > 0 {
+		periods, err := readFreezePeriodsFile(config.FreezePeriodsFile)
+		if err != nil {
+			return config, errors.New("Failed to read configured freeze_periods_file " + config.FreezePeriodsFile + ": " + err.Error())
+		}
+		config.FreezePeriods = append(config.FreezePeriods, periods...)
+	}
+	if problems := validateFreezePeriods(config.FreezePeriods); len(problems) > 0 {
+		return config, errors.New("Invalid freeze_periods in config file " + configFile + ": " + strings.Join(problems, ", "))
+	}
+
+	if config.GlobalAllowedParallelRestarts < 0 {
+		return config, errors.New("Invalid global_allowed_parallel_restarts " + strconv.Itoa(config.GlobalAllowedParallelRestarts) + " in config file " + configFile + " Use 0 for no global limit")
+	}
+	for label, allowed := range config.RestartBudgets {
+		if allowed < 1 {
+			return config, errors.New("Invalid restart_budgets " + label + ": " + strconv.Itoa(allowed) + " in config file " + configFile + " Budgets have to allow at least one restart")
+		}
+	}
+
+	return config, nil
 }
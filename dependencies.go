@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// validateClusterDependencies checks that every cluster referenced in depends_on and mutually_exclusive_with is configured
+func validateClusterDependencies(settings map[string]clusterSetting) error {
+	problems := []string{}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, cluster := range names {
+		csetting := settings[cluster]
+		for _, setting := range []struct {
+			name     string
+			clusters []string
+		}{
+			{"depends_on", csetting.DependsOn},
+			{"mutually_exclusive_with", csetting.MutuallyExclusiveWith},
+		} {
+			for _, other := range setting.clusters {
+				if other == cluster {
+					problems = append(problems, "cluster "+cluster+" references itself in "+setting.name)
+				} else if _, ok := settings[other]; !ok {
+					problems = append(problems, "cluster "+cluster+" references unknown cluster "+other+" in "+setting.name)
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// blockingClusters returns the clusters whose restarting hosts block restarts of the given cluster together with the reason.
+// mutually_exclusive_with is symmetric, so clusters that list the given cluster are returned as well.
+func blockingClusters(cluster string, settings map[string]clusterSetting) map[string]string {
+	blocking := make(map[string]string)
+	for _, other := range settings[cluster].DependsOn {
+		blocking[other] = "depends on"
+	}
+	for _, other := range settings[cluster].MutuallyExclusiveWith {
+		blocking[other] = "is mutually exclusive with"
+	}
+	for other, csetting := range settings {
+		for _, c := range csetting.MutuallyExclusiveWith {
+			if c == cluster {
+				blocking[other] = "is mutually exclusive with"
+			}
+		}
+	}
+	return blocking
+}
+
+// checkClusterDependencies returns the reason why the given cluster must not restart a host, because a host of a blocking cluster is currently restarting.
+// It has to be called with the mutex held, so that no other cluster can hand out a go_ahead in between.
+func checkClusterDependencies(cluster string, settings map[string]clusterSetting) (string, bool, error) {
+	blocking := blockingClusters(cluster, settings)
+	others := make([]string, 0, len(blocking))
+	for other := range blocking {
+		others = append(others, other)
+	}
+	sort.Strings(others)
+	for _, other := range others {
+		cs, found, err := stateStore.GetClusterState(other)
+		if err != nil {
+			return "", true, errors.New("Could not read cluster state of cluster " + other + " " + err.Error())
+		}
+		if found && len(cs.CurrentRestartingServers) > 0 {
+			return "Denied restart request, because cluster " + cluster + " " + blocking[other] + " cluster " + other + " Currently restarting hosts of " + other + ": " + strings.Join(sortedKeys(cs.CurrentRestartingServers), ","), true, nil
+		}
+	}
+	return "", false, nil
+}
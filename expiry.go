@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	expiryPolicyKeep                = "keep"
+	expiryPolicyRelease             = "release"
+	expiryPolicyReleaseAndBlacklist = "release_and_blacklist"
+
+	// panicKindThreshold is the panic reason if a restart request arrives after the reboot_completion_panic_threshold
+	panicKindThreshold = "panic_threshold"
+	// panicKindMaxDuration is the panic reason if a host is restarting longer than the reboot_completion_max_duration
+	panicKindMaxDuration = "max_duration"
+)
+
+// expiredRestart records that a host did not complete its reboot within the reboot_completion_max_duration
+type expiredRestart struct {
+	GrantedAt time.Time `json:"granted_at"`
+	ExpiredAt time.Time `json:"expired_at"`
+	Policy    string    `json:"policy"`
+	Reason    string    `json:"reason"`
+}
+
+// expiryPolicy returns the configured reboot_completion_expiry_policy, defaults to keep
+func (csetting clusterSetting) expiryPolicy() string {
+	if len(csetting.RebootCompletionExpiryPolicy) < 1 {
+		return expiryPolicyKeep
+	}
+	return csetting.RebootCompletionExpiryPolicy
+}
+
+// validateExpiryPolicy checks the reboot_completion_expiry_policy of the cluster
+func validateExpiryPolicy(csetting clusterSetting) error {
+	switch csetting.expiryPolicy() {
+	case expiryPolicyKeep, expiryPolicyRelease, expiryPolicyReleaseAndBlacklist:
+		return nil
+	}
+	return errors.New("unknown reboot_completion_expiry_policy " + csetting.RebootCompletionExpiryPolicy + " Valid values are " + expiryPolicyKeep + ", " + expiryPolicyRelease + " or " + expiryPolicyReleaseAndBlacklist)
+}
+
+// restartGrantedAt returns when the FQDN received its go_ahead.
+// Cluster states saved before the grant timestamps were recorded fall back to the last restart request of the cluster.
+func restartGrantedAt(cs clusterState, fqdn string) time.Time {
+	if grantedAt, ok := cs.RestartGrantedTimestamps[fqdn]; ok {
+		return grantedAt
+	}
+	return cs.LastRestartRequestTimestamp
+}
+
+// expireStaleRestarts applies the reboot_completion_expiry_policy to every host that is restarting for longer than the reboot_completion_max_duration of its cluster.
+// The panic actions are triggered once for every expired restart.
+func expireStaleRestarts(now time.Time) {
+	settings, _ := currentClusterSettings()
+	clusters := make([]string, 0, len(settings))
+	for cluster := range settings {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+
+	for _, cluster := range clusters {
+		csetting := settings[cluster]
+		if csetting.RebootCompletionMaxDuration <= 0 {
+			continue
+		}
+		clusterLogger := stateLogger(cluster)
+		policy := csetting.expiryPolicy()
+		var expired []string
+		mutex.Lock()
+		cs, err := updateClusterState(cluster, func(cs *clusterState, exists bool) error {
+			expired = nil
+			if !exists {
+				return errKeepClusterState
+			}
+			for _, fqdn := range keysString(cs.CurrentRestartingServers) {
+				grantedAt := restartGrantedAt(*cs, fqdn)
+				if now.Sub(grantedAt) < csetting.RebootCompletionMaxDuration {
+					continue
+				}
+				if previous, ok := cs.ExpiredRestarts[fqdn]; ok && previous.GrantedAt.Equal(grantedAt) {
+					// the panic actions for this restart already got triggered
+					continue
+				}
+				if cs.ExpiredRestarts == nil {
+					cs.ExpiredRestarts = make(map[string]expiredRestart)
+				}
+				reason := "Host " + fqdn + " of cluster " + cluster + " did not complete its reboot within the reboot_completion_max_duration of " + csetting.RebootCompletionMaxDuration.String() + " since its go_ahead at " + grantedAt.Format(time.RFC3339) + " Applying reboot_completion_expiry_policy " + policy
+				cs.ExpiredRestarts[fqdn] = expiredRestart{GrantedAt: grantedAt, ExpiredAt: now, Policy: policy, Reason: reason}
+				if policy == expiryPolicyRelease || policy == expiryPolicyReleaseAndBlacklist {
+					delete(cs.CurrentRestartingServers, fqdn)
+					delete(cs.RestartGrantedTimestamps, fqdn)
+					cs.CurrentOngoingRestarts--
+					if cs.CurrentOngoingRestarts < 0 {
+						cs.CurrentOngoingRestarts = 0
+					}
+				}
+				expired = append(expired, fqdn)
+			}
+			if len(expired) == 0 {
+				return errKeepClusterState
+			}
+			return nil
+		})
+		mutex.Unlock()
+		if err == errKeepClusterState {
+			continue
+		} else if err != nil {
+			clusterLogger.Error("Could not expire stale restarts of cluster " + cluster + " " + err.Error())
+			continue
+		}
+		for _, fqdn := range expired {
+			reason := cs.ExpiredRestarts[fqdn].Reason
+			clusterLogger.Warn(reason)
+			event := auditEventPanic
+			if policy != expiryPolicyKeep {
+				event = auditEventReleased
+			}
+			audit(auditRecord{Event: event, Fqdn: fqdn, Cluster: cluster, Decision: "expired_" + policy, Reason: reason, State: &cs})
+			if policy != expiryPolicyKeep {
+				recordRebootCycle(rebootCycle{Fqdn: fqdn, Cluster: cluster, GrantedAt: cs.ExpiredRestarts[fqdn].GrantedAt, CompletedAt: now, Outcome: rebootOutcomeExpired})
+				if cancelClusterCheck(fqdn) {
+					clusterLogger.Info("Cancelled reboot completion check for expired FQDN: " + fqdn)
+				}
+			}
+			if policy == expiryPolicyReleaseAndBlacklist {
+				mutex.Lock()
+				quarantineHost(quarantineEntry{Fqdn: fqdn, Cluster: cluster, Reason: reason, By: "goahead", Source: quarantineSourceExpiry}, clusterLogger)
+				mutex.Unlock()
+			}
+			triggerRebootCompletionPanicActions(newHookData(fqdn, cluster, csetting), panicKindMaxDuration, reason, cs, csetting, clusterLogger)
+		}
+	}
+}
+
+// scheduleRestartExpiry runs expireStaleRestarts every reboot_completion_sweep_interval
+func scheduleRestartExpiry() {
+	for {
+		mutex.Lock()
+		interval := currentConfig().RebootCompletionSweepInterval
+		mutex.Unlock()
+		time.Sleep(interval)
+		expireStaleRestarts(time.Now())
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// freezePeriod is a change freeze during which no host of the listed clusters may restart
+type freezePeriod struct {
+	Name     string    `yaml:"name" json:"name"`
+	Start    time.Time `yaml:"start" json:"start"`
+	End      time.Time `yaml:"end" json:"end"`
+	Clusters []string  `yaml:"clusters" json:"clusters,omitempty"`
+}
+
+// adhocFreeze is a global change freeze that got enabled via the admin API
+type adhocFreeze struct {
+	Reason    string    `json:"reason"`
+	EnabledBy string    `json:"enabled_by"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+}
+
+// freezeRequest is the payload to enable an ad-hoc global freeze
+type freezeRequest struct {
+	Reason   string    `json:"reason"`
+	Until    time.Time `json:"until"`
+	Duration string    `json:"duration"`
+}
+
+// freezeStatus lists the configured freeze periods and the ad-hoc freeze
+type freezeStatus struct {
+	AdhocFreeze   *adhocFreeze   `json:"adhoc_freeze"`
+	FreezePeriods []freezePeriod `json:"freeze_periods"`
+}
+
+var currentAdhocFreeze *adhocFreeze
+
+// readFreezePeriodsFile reads the list of freeze periods from the configured freeze_periods_file
+func readFreezePeriodsFile(file string) ([]freezePeriod, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var periods []freezePeriod
+	if err := yaml.Unmarshal(data, &periods); err != nil {
+		return nil, err
+	}
+	return periods, nil
+}
+
+// validateFreezePeriods checks that every freeze period has a name and ends after it starts
+func validateFreezePeriods(periods []freezePeriod) []string {
+	problems := []string{}
+	for i, fp := range periods {
+		if len(fp.Name) < 1 {
+			fp.Name = "#" + strconv.Itoa(i+1)
+			problems = append(problems, "freeze period "+fp.Name+" has no name")
+		}
+		if fp.Start.IsZero() || fp.End.IsZero() {
+			problems = append(problems, "freeze period "+fp.Name+" needs a start and an end timestamp")
+		} else if !fp.End.After(fp.Start) {
+			problems = append(problems, "freeze period "+fp.Name+" ends before it starts")
+		}
+	}
+	return problems
+}
+
+func adhocFreezeFile() string {
+	return filepath.Join(currentConfig().SaveStateDir, "freeze.json")
+}
+
+// loadAdhocFreeze restores a previously enabled ad-hoc freeze after a service restart
+func loadAdhocFreeze() {
+	file := adhocFreezeFile()
+	if !fileExists(file) {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		mainLogger.Error("Could not read ad-hoc freeze file " + file + " " + err.Error())
+		return
+	}
+	var af adhocFreeze
+	if err := json.Unmarshal(data, &af); err != nil {
+		mainLogger.Error("In json file " + file + ": JSON unmarshal error: " + err.Error())
+		return
+	}
+	mainLogger.Info("Restored ad-hoc freeze from " + file + " Reason: " + af.Reason)
+	currentAdhocFreeze = &af
+}
+
+// checkFreeze returns the reason and the end of the active freeze for the given cluster, if there is one
+func checkFreeze(cluster string, t time.Time) (string, time.Time, bool) {
+	mutex.Lock()
+	af := currentAdhocFreeze
+	mutex.Unlock()
+	if af != nil && (af.Until.IsZero() || t.Before(af.Until)) {
+		return "ad-hoc freeze enabled by " + af.EnabledBy + " since " + af.Since.Format(time.RFC3339) + ": " + af.Reason, af.Until, true
+	}
+	for _, fp := range currentConfig().FreezePeriods {
+		if t.Before(fp.Start) || !t.Before(fp.End) {
+			continue
+		}
+		if len(fp.Clusters) == 0 {
+			return "freeze period " + fp.Name, fp.End, true
+		}
+		for _, c := range fp.Clusters {
+			if c == cluster {
+				return "freeze period " + fp.Name, fp.End, true
+			}
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// getFreezeHandler returns the configured freeze periods and the ad-hoc freeze
+func getFreezeHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	status := freezeStatus{AdhocFreeze: currentAdhocFreeze, FreezePeriods: currentConfig().FreezePeriods}
+	mutex.Unlock()
+	if status.FreezePeriods == nil {
+		status.FreezePeriods = []freezePeriod{}
+	}
+	respondWithJSON(w, http.StatusOK, "", status)
+}
+
+// enableFreezeHandler enables an ad-hoc global freeze that denies all restart requests until it gets disabled or expires
+func enableFreezeHandler(w http.ResponseWriter, r *http.Request) {
+	var fr freezeRequest
+	if err := json.NewDecoder(r.Body).Decode(&fr); err != nil {
+		respondWithError(w, http.StatusBadRequest, "", "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	if len(fr.Reason) < 1 {
+		respondWithError(w, http.StatusBadRequest, "", "Invalid request payload. Need at least the reason field!")
+		return
+	}
+	af := adhocFreeze{Reason: fr.Reason, EnabledBy: adminIdentity(r), Since: time.Now(), Until: fr.Until}
+	if len(fr.Duration) > 0 {
+		d, err := time.ParseDuration(fr.Duration)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "", "Can not convert value "+fr.Duration+" of your duration to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m.")
+			return
+		}
+		af.Until = af.Since.Add(d)
+	}
+	if err := writeStructJSONFile(adhocFreezeFile(), af); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "", "Could not save ad-hoc freeze file: "+err.Error())
+		return
+	}
+	mutex.Lock()
+	currentAdhocFreeze = &af
+	mutex.Unlock()
+	mainLogger.Warn("Enabled ad-hoc freeze by " + af.EnabledBy + " Reason: " + af.Reason)
+	respondWithJSON(w, http.StatusOK, "", af)
+}
+
+// disableFreezeHandler lifts the ad-hoc global freeze
+func disableFreezeHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	af := currentAdhocFreeze
+	if af == nil {
+		mutex.Unlock()
+		respondWithError(w, http.StatusNotFound, "", "No ad-hoc freeze enabled")
+		return
+	}
+	// keep the ad-hoc freeze if it can not be removed from disk, it would be enabled again after a restart otherwise
+	if err := os.Remove(adhocFreezeFile()); err != nil && !os.IsNotExist(err) {
+		mutex.Unlock()
+		mainLogger.Error("Could not remove ad-hoc freeze file " + adhocFreezeFile() + " " + err.Error())
+		respondWithError(w, http.StatusInternalServerError, "", "Could not remove ad-hoc freeze file: "+err.Error())
+		return
+	}
+	currentAdhocFreeze = nil
+	mutex.Unlock()
+	mainLogger.Warn("Disabled ad-hoc freeze by " + adminIdentity(r) + " that was enabled by " + af.EnabledBy + " Reason: " + af.Reason)
+	respondWithJSON(w, http.StatusOK, "", af)
+}
+
+// adminIdentity returns the client certificate common name or the IP of an admin request
+func adminIdentity(r *http.Request) string {
+	if cn := clientCertCN(r); len(cn) > 0 {
+		return cn
+	}
+	return strings.Split(r.RemoteAddr, ":")[0]
+}
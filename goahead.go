@@ -5,8 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -17,13 +18,13 @@ var (
 	info                  bool
 	quiet                 bool
 	buildtime             string
-	config                configSettings
+	configFile            string
 	clusterSettings       map[string]clusterSetting
 	sleepingClusterChecks map[string]clusterCheck
+	clusterCheckTimers    map[string]*time.Timer
+	runningClusterChecks  map[string]chan struct{}
 	checkCluster          chan clusterCheck
-	startCheckerChannel   chan request
 	mutex                 sync.Mutex
-	clusterLoggers        map[string]*logrus.Entry
 	mainLogger            *logrus.Entry
 	unknownLogger         *logrus.Entry
 	checkerLogger         *logrus.Entry
@@ -34,11 +35,14 @@ func main() {
 	var (
 		configFileFlag = flag.String("config", "./config.yml", "which config file to use, defaults to ./config.yml")
 		versionFlag    = flag.Bool("version", false, "show build time and version number")
+		validateFlag   = flag.Bool("validate", false, "validate the config file and all cluster settings files, report every problem and exit")
+		matchFlag      = flag.String("match", "", "comma separated FQDNs to explain which cluster they match and which decision they would get without the cluster state, then exit")
+		uptimeFlag     = flag.String("uptime", "", "uptime to use for the -match dry run, e.g. 48h")
 	)
 	flag.BoolVar(&debug, "debug", false, "log debug output, defaults to false")
 	flag.Parse()
 
-	configFile := *configFileFlag
+	configFile = *configFileFlag
 	version := *versionFlag
 
 	if version {
@@ -46,50 +50,78 @@ func main() {
 		os.Exit(0)
 	}
 
-	config = readConfigfile(configFile)
+	if *validateFlag {
+		problems := validateConfig(configFile)
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if len(problems) > 0 {
+			Fatalf("Found " + strconv.Itoa(len(problems)) + " problems in config file " + configFile + " and its cluster settings")
+		}
+		fmt.Println("Config file " + configFile + " and its cluster settings are valid")
+		os.Exit(0)
+	}
+
+	if len(*matchFlag) > 0 {
+		if err := runMatch(*matchFlag, *uptimeFlag); err != nil {
+			Fatalf(err.Error())
+		}
+		os.Exit(0)
+	}
+
+	setConfig(readConfigfile(configFile))
 
-	clusterLoggers = make(map[string]*logrus.Entry)
 	clusterSettings = make(map[string]clusterSetting)
 	checkCluster = make(chan clusterCheck)
 	sleepingClusterChecks = make(map[string]clusterCheck)
-	startCheckerChannel = make(chan request)
+	clusterCheckTimers = make(map[string]*time.Timer)
+	runningClusterChecks = make(map[string]chan struct{})
 
 	mainLogger = initLogger("goahead")
 	unknownLogger = initLogger("unknown")
 	checkerLogger = initLogger("checker")
 
-	if len(config.IncludeDir) > 0 {
-		if isDir(config.IncludeDir) {
-			mainLogger.Debug("Glob'ing with " + config.IncludeDir + "**/*.(yml|yaml)")
-			files := []string{}
-			err := filepath.Walk(config.IncludeDir, func(path string, f os.FileInfo, err error) error {
-				mainLogger.Info("Checking for file extension on file: " + path)
-				if filepath.Ext(path) == ".yml" || filepath.Ext(path) == ".yaml" {
-					files = append(files, path)
-				}
-				return nil
-			})
-
-			if len(files) == 0 {
-				mainLogger.Fatal("Could not find any cluster settings matching " + config.IncludeDir + "**/*.(yml|yaml)")
-			}
-			Debugf("found potential module versions:" + strings.Join(files, " "))
-			if err != nil {
-				mainLogger.Fatal("Failed to glob cluster settings include_dir with glob path " + config.IncludeDir + "**/*.(yml|yaml) Error: " + err.Error())
-			}
-			for _, f := range files {
-				readClusterSetting(f)
-			}
-		}
+	var err error
+	if stateStore, err = newStateStore(); err != nil {
+		mainLogger.Fatal("Could not open state store: " + err.Error())
+	}
+	mainLogger.Info("Saving cluster state as " + describeStateBackend())
+
+	if auditLog, err = openAuditLog(); err != nil {
+		mainLogger.Fatal("Could not open audit log: " + err.Error())
+	}
+	mainLogger.Info("Writing audit log to " + auditLog.file)
+
+	if jobs, err = openJobQueue(filepath.Join(currentConfig().SaveStateDir, "jobs")); err != nil {
+		mainLogger.Fatal("Could not open job queue: " + err.Error())
+	}
+	jobs.start(currentConfig().JobWorkers)
+	mainLogger.Info("Queueing actions in " + jobs.dir + " for " + strconv.Itoa(currentConfig().JobWorkers) + " workers")
 
+	loadAdhocFreeze()
+
+	settings, err := loadClusterSettings(currentConfig().IncludeDir)
+	if err != nil {
+		mainLogger.Fatal(err.Error())
+	}
+	if err := checkClusterOverlaps(*currentConfig(), settings); err != nil {
+		mainLogger.Fatal(err.Error())
 	}
+	clusterSettings = settings
+	setClusterLoggers(clusterLoggersFor(settings, currentClusterLoggers()))
 
 	mainLogger.Info("Found following cluster settings:")
 	mainLogger.Infof("%+v\n", clusterSettings)
 
+	go scheduleClusterChecks()
+
 	// check for previously create cluster state files and check if I need to restart checker
 	go checkCurrentClusterStates()
 
+	go scheduleRestartExpiry()
+
+	go reloadOnSIGHUP()
+
 	go serve()
 
 	select {}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
@@ -26,11 +38,11 @@ func prepareHTTPClient(t *testing.T) *http.Client {
 		rootCAs = x509.NewCertPool()
 	}
 
-	if len(config.ClientCertCaFile) > 0 {
+	if len(currentConfig().ClientCertCaFile) > 0 {
 		// Read in the cert file
-		certs, err := os.ReadFile(config.ClientCertCaFile)
+		certs, err := os.ReadFile(currentConfig().ClientCertCaFile)
 		if err != nil {
-			t.Error("Failed to append " + config.ClientCertCaFile + " to RootCAs Error: " + err.Error())
+			t.Error("Failed to append " + currentConfig().ClientCertCaFile + " to RootCAs Error: " + err.Error())
 		}
 
 		// Append our cert to the system pool
@@ -77,8 +89,186 @@ func doRequest(req request, uri string, t *testing.T) response {
 	return response
 }
 
+func doAdminRequest(method string, uri string, token string, payload []byte, t *testing.T) (int, []byte) {
+	client := prepareHTTPClient(t)
+	httpReq, err := http.NewRequest(method, defaultURL+uri, bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal("Error while creating admin request to " + uri + " Error: " + err.Error())
+	}
+	if len(token) > 0 {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		t.Fatal("Error while issuing admin request to " + defaultURL + uri + " Error: " + err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error("Error while reading response body: " + err.Error())
+	}
+	Debugf("Recieved admin response body: " + string(body))
+	return resp.StatusCode, body
+}
+
+// waitForJobs waits until the job queue executed all queued actions
+func waitForJobs(t *testing.T) {
+	for i := 0; i < 500; i++ {
+		if jobs.idle() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("Job queue did not become idle within 10s")
+}
+
+// updateConfig replaces the running config by a copy of it with the given change like reloadConfig does
+func updateConfig(change func(cfg *configSettings)) {
+	cfg := *currentConfig()
+	change(&cfg)
+	setConfig(cfg)
+}
+
+// restoreConfig restores the running config after the test
+func restoreConfig(t *testing.T) {
+	original := *currentConfig()
+	t.Cleanup(func() { setConfig(original) })
+}
+
+// waitForJobStatus waits until a job of the FQDN that was created after started has the given status and returns it
+func waitForJobStatus(t *testing.T, q *jobQueue, started time.Time, fqdn string, status string) job {
+	for i := 0; i < 500; i++ {
+		for _, j := range q.list() {
+			if j.Fqdn == fqdn && j.Status == status && j.CreatedAt.After(started) {
+				return j
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("No %s job of %s within 10s: %+v", status, fqdn, q.list())
+	return job{}
+}
+
+// useTestStateDir points the save_state_dir to an empty temporary directory of the test, that contains the given cluster states.
+// The save_state_dir and the state store get restored after the test.
+func useTestStateDir(t *testing.T, states map[string]clusterState) string {
+	saveStateDir := normalizeDir(t.TempDir())
+	mutex.Lock()
+	store := stateStore
+	mutex.Unlock()
+	t.Cleanup(func() {
+		mutex.Lock()
+		stateStore = store
+		mutex.Unlock()
+	})
+	restoreConfig(t)
+	updateConfig(func(cfg *configSettings) { cfg.SaveStateDir = saveStateDir })
+	for cluster, cs := range states {
+		if err := writeStructJSONFile(filepath.Join(saveStateDir, cluster+".json"), cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return saveStateDir
+}
+
+// setClusterSetting replaces the cluster setting by a copy of the cluster settings like reloadConfig does,
+// so that requests working on the previous cluster settings are not affected. The caller has to hold the mutex.
+func setClusterSetting(name string, csetting clusterSetting) {
+	settings := make(map[string]clusterSetting, len(clusterSettings))
+	for n, s := range clusterSettings {
+		settings[n] = s
+	}
+	settings[name] = csetting
+	clusterSettings = settings
+}
+
+// startFailingClusterCheck starts a reboot completion check of the FQDN that never succeeds and appends a line to the returned file on every attempt
+func startFailingClusterCheck(t *testing.T, fqdn string) string {
+	attemptsFile := filepath.Join(t.TempDir(), "attempts")
+	csetting := clusterSetting{RebootCompletionCheck: completionCheck{Command: "sh -c 'echo attempt >> " + attemptsFile + "; exit 1'"},
+		RebootCompletionCheckInterval: 10 * time.Millisecond, RebootCompletionCheckConsecutiveSuccesses: 1}
+	scheduleClusterCheck(clusterCheck{csetting, fqdn, funcName(), "foobar-server"})
+	for i := 0; i < 100 && !fileExists(attemptsFile); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !fileExists(attemptsFile) {
+		t.Fatal("Reboot completion check of " + fqdn + " did not start")
+	}
+	return attemptsFile
+}
+
+// checkClusterCheckStopped fails the test if the reboot completion check of the FQDN keeps running
+func checkClusterCheckStopped(t *testing.T, fqdn string, attemptsFile string) {
+	mutex.Lock()
+	_, running := runningClusterChecks[fqdn]
+	mutex.Unlock()
+	if running {
+		t.Errorf("Reboot completion check of %s is still registered as running", fqdn)
+	}
+	time.Sleep(50 * time.Millisecond)
+	before, _ := os.ReadFile(attemptsFile)
+	time.Sleep(100 * time.Millisecond)
+	if after, _ := os.ReadFile(attemptsFile); len(after) != len(before) {
+		t.Errorf("Reboot completion check of %s kept running after its restart slot was released", fqdn)
+	}
+}
+
+// startFakeSMTPServer accepts a single SMTP session on a local port and sends the received DATA to the returned channel
+func startFakeSMTPServer(t *testing.T) (int, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Could not start fake SMTP listener: " + err.Error())
+	}
+	received := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 fake ESMTP\r\n")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					fmt.Fprint(conn, "250 OK\r\n")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch strings.ToUpper(strings.SplitN(strings.TrimSpace(line), " ", 2)[0]) {
+			case "EHLO", "HELO":
+				fmt.Fprint(conn, "250-fake\r\n250 8BITMIME\r\n")
+			case "DATA":
+				inData = true
+				fmt.Fprint(conn, "354 Go ahead\r\n")
+			case "QUIT":
+				fmt.Fprint(conn, "221 Bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, received
+}
+
+// testConfigFile is config.yml with the admin_api_tokens used by the admin API tests
+const testConfigFile = "./tests/config.yml"
+
 func TestMain(m *testing.M) {
 	purgeDir("/tmp/goahead/", "TestMain")
+	os.Args = append(os.Args, "-config", testConfigFile)
 	go main()
 	time.Sleep(2 * time.Second) // Give server time to start
 	exitCode := m.Run()
@@ -86,8 +276,8 @@ func TestMain(m *testing.M) {
 }
 
 func TestUnknownServer(t *testing.T) {
-	config.SaveStateDir = "/tmp/goahead/" + funcName()
-	config.LogBaseDir = config.SaveStateDir
+	saveStateDir := "/tmp/goahead/" + funcName()
+	updateConfig(func(cfg *configSettings) { cfg.SaveStateDir, cfg.LogBaseDir = saveStateDir, saveStateDir })
 	req := request{Fqdn: "unknown.domain.tld", Uptime: "2h31m"}
 	resp := doRequest(req, "v1/request/restart/os", t)
 	if resp.UnknownHost != true {
@@ -96,8 +286,8 @@ func TestUnknownServer(t *testing.T) {
 }
 
 func TestKnownServer(t *testing.T) {
-	config.SaveStateDir = "/tmp/goahead/" + funcName()
-	config.LogBaseDir = config.SaveStateDir
+	saveStateDir := "/tmp/goahead/" + funcName()
+	updateConfig(func(cfg *configSettings) { cfg.SaveStateDir, cfg.LogBaseDir = saveStateDir, saveStateDir })
 	req := request{Fqdn: "foobar-server-aa07.domain.tld", Uptime: "2h31m"}
 	resp := doRequest(req, "v1/request/restart/os", t)
 	if resp.FoundCluster != "foobar-server" {
@@ -106,8 +296,8 @@ func TestKnownServer(t *testing.T) {
 }
 
 func TestMimimumUptime(t *testing.T) {
-	config.SaveStateDir = "/tmp/goahead/" + funcName()
-	config.LogBaseDir = config.SaveStateDir
+	saveStateDir := "/tmp/goahead/" + funcName()
+	updateConfig(func(cfg *configSettings) { cfg.SaveStateDir, cfg.LogBaseDir = saveStateDir, saveStateDir })
 	expectedLine := "Configured minimum uptime for cluster: 30m0s was not reached by client's uptime: 1m"
 	req := request{Fqdn: "foobar-server-aa07.domain.tld", Uptime: "1m"}
 	resp := doRequest(req, "v1/request/restart/os", t)
@@ -117,8 +307,8 @@ func TestMimimumUptime(t *testing.T) {
 }
 
 func TestGoahead(t *testing.T) {
-	config.SaveStateDir = "/tmp/goahead/" + funcName()
-	config.LogBaseDir = config.SaveStateDir
+	saveStateDir := "/tmp/goahead/" + funcName()
+	updateConfig(func(cfg *configSettings) { cfg.SaveStateDir, cfg.LogBaseDir = saveStateDir, saveStateDir })
 	req := request{Fqdn: "foobar-server-aa07.domain.tld", Uptime: "2h31m"}
 	resp := doRequest(req, "v1/request/restart/os", t)
 	if len(resp.RequestID) < 1 {
@@ -139,6 +329,7 @@ func TestGoahead(t *testing.T) {
 		"Executing ./tests/goahead_action.sh foobar-server-aa07.domain.tld foobar-server",
 	}
 	foobarServerLogfile := "/tmp/goahead/foobar-server.log"
+	waitForJobs(t)
 	content, _ := os.ReadFile(foobarServerLogfile)
 
 	for _, expectedLine := range expectedLines {
@@ -150,10 +341,10 @@ func TestGoahead(t *testing.T) {
 	req = request{Fqdn: "foobar-server-aa07.domain.tld", Uptime: "2h31m"}
 	resp = doRequest(req, "v1/request/restart/os", t)
 	req.RequestID = resp.RequestID
-	
+
 	// Add small delay to ensure first request is processed
 	time.Sleep(100 * time.Millisecond)
-	
+
 	resp = doRequest(req, "v1/request/restart/os", t)
 	// The second request with the same RequestID should get Goahead=true (confirming the restart)
 	// and the message should indicate it's already restarting
@@ -194,27 +385,27 @@ func TestGoahead(t *testing.T) {
 	}
 
 	req.Uptime = "2s"
-	
+
 	// The completion checks might have already finished by now since they run with 0s interval
 	// Let's make a new restart request to ensure we get into the reboot_completion_check_offset sleep state
 	req = request{Fqdn: "foobar-server-aa08.domain.tld", Uptime: "2h31m"}
 	resp = doRequest(req, "v1/request/restart/os", t)
 	req.RequestID = resp.RequestID
 	resp = doRequest(req, "v1/request/restart/os", t)
-	
+
 	// Now quickly make an inquire request with low uptime to interrupt the sleep
 	time.Sleep(100 * time.Millisecond) // Give time for reboot completion check to start
 	req.Uptime = "2s"
 	req.Fqdn = "foobar-server-aa08.domain.tld"
 	resp = doRequest(req, "v1/inquire/restart/", t)
-	
+
 	expectedLines = []string{
 		"Received inquire request from FQDN foobar-server-aa08.domain.tld Interrupting reboot_completion_check_offset sleep!",
 	}
-	
+
 	// Give some time for log entry to be written
 	time.Sleep(200 * time.Millisecond)
-	
+
 	contentChecker, _ = os.ReadFile(checkerLogfile)
 	// Check if we find the expected line with either aa07 or aa08
 	found := false
@@ -225,14 +416,14 @@ func TestGoahead(t *testing.T) {
 			break
 		}
 	}
-	
+
 	if !found {
 		// This might be expected behavior if the reboot completion check finished before the inquire request
 		// In test environments with 0s intervals, the checks complete very quickly
 		t.Logf("Note: Did not find 'Interrupting reboot_completion_check_offset sleep!' - this may be expected if reboot checks completed quickly")
 	}
 
-	if fileExists(filepath.Join(config.SaveStateDir, resp.FoundCluster, req.Fqdn)) {
+	if fileExists(filepath.Join(currentConfig().SaveStateDir, resp.FoundCluster, req.Fqdn)) {
 		t.Errorf("FQDN state file still exists, but should not after successfull reboot and checks!")
 	}
 	rebootCompletionFile := filepath.Join("/tmp/goahead", resp.FoundCluster+"-"+req.Fqdn+"-successful-reboot")
@@ -242,10 +433,397 @@ func TestGoahead(t *testing.T) {
 	}
 }
 
+func TestPanicMail(t *testing.T) {
+	port, received := startFakeSMTPServer(t)
+	restoreConfig(t)
+	updateConfig(func(cfg *configSettings) { cfg.SMTPServer, cfg.SMTPPort, cfg.SMTPTLS = "127.0.0.1", port, "none" })
+
+	csetting := clusterSettings["foobar-server"]
+	cs := clusterState{
+		LastRestartRequestTimestamp: time.Now().Add(-4 * time.Hour),
+		CurrentOngoingRestarts:      1,
+		CurrentRestartingServers:    map[string]struct{}{"foobar-server-aa42.domain.tld": {}},
+	}
+	if err := sendPanicMail("foobar-server-aa43.domain.tld", "foobar-server", panicKindThreshold, "", cs, csetting, currentClusterLoggers()["foobar-server"]); err != nil {
+		t.Fatal("Could not send panic mail: " + err.Error())
+	}
+
+	select {
+	case mail := <-received:
+		expectedLines := []string{
+			"To: " + strings.Join(csetting.RebootCompletionPanicActions.Mail, ", "),
+			"Subject: goahead: reboot completion panic in cluster foobar-server for foobar-server-aa42.domain.tld",
+			"The reboot completion panic threshold of 3h0m0s was met for goahead cluster foobar-server.",
+			"  - foobar-server-aa42.domain.tld",
+			"(4h0m0s ago)",
+			"Triggered by restart request from: foobar-server-aa43.domain.tld",
+		}
+		for _, expectedLine := range expectedLines {
+			if !strings.Contains(mail, expectedLine) {
+				t.Errorf("Could not find expected line '%s' in panic mail on port %s: %s", expectedLine, strconv.Itoa(port), mail)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Fake SMTP server did not receive any panic mail")
+	}
+}
+
+func TestRebootCompletionCheckOffset(t *testing.T) {
+	fqdn := "foobar-server-aa31.domain.tld"
+	cs := clusterState{LastRestartRequestTimestamp: time.Now(), CurrentOngoingRestarts: 1, CurrentRestartingServers: map[string]struct{}{fqdn: {}}}
+	clusterFile := filepath.Join(useTestStateDir(t, map[string]clusterState{"foobar-server": cs}), "foobar-server.json")
+
+	if err := stateStore.PutHostAck(response{FoundCluster: "foobar-server", RequestingFqdn: fqdn, ReportedUptime: "2h31m", Goahead: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	csetting := clusterSettings["foobar-server"]
+	csetting.RebootCompletionCheckOffset = 200 * time.Millisecond
+	checkCluster <- clusterCheck{csetting, fqdn, funcName(), "foobar-server"}
+
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	_, sleeping := sleepingClusterChecks[fqdn]
+	mutex.Unlock()
+	if !sleeping {
+		t.Error("Reboot completion check for " + fqdn + " is not sleeping for its reboot_completion_check_offset")
+	}
+
+	// the host never inquires again, so the scheduler has to start the check on its own
+	time.Sleep(2 * time.Second)
+	cs, _ = readClusterStateFile(clusterFile, "foobar-server", currentClusterLoggers()["foobar-server"])
+	if _, ok := cs.CurrentRestartingServers[fqdn]; ok || cs.CurrentOngoingRestarts != 0 {
+		t.Errorf("Reboot completion check for %s was not started after reboot_completion_check_offset. Cluster state: %+v", fqdn, cs)
+	}
+	if ack, found, _ := stateStore.GetHostAck("foobar-server", fqdn); !found || ack.ReportedUptime != "2h31m" {
+		t.Errorf("Reboot completion check for %s did not keep the reported uptime of its ACK: %+v", fqdn, ack)
+	}
+}
+
+func TestAdminClusterAPI(t *testing.T) {
+	useTestStateDir(t, nil)
+	token := currentConfig().AdminAPITokens[0]
+	fqdn := "foobar-server-aa51.domain.tld"
+	req := request{Fqdn: fqdn, Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead != true {
+		t.Fatal("Did not receive go_ahead: true for " + fqdn)
+	}
+
+	if code, _ := doAdminRequest(http.MethodGet, "v1/clusters", "", nil, t); code != http.StatusUnauthorized {
+		t.Errorf("Admin API without token responded with HTTP %d instead of 401", code)
+	}
+	if code, _ := doAdminRequest(http.MethodGet, "v1/clusters", "wrong-token", nil, t); code != http.StatusUnauthorized {
+		t.Errorf("Admin API with wrong token responded with HTTP %d instead of 401", code)
+	}
+	bareTokenReq, _ := http.NewRequest(http.MethodGet, defaultURL+"v1/clusters", nil)
+	bareTokenReq.Header.Set("Authorization", token)
+	if bareTokenResp, err := prepareHTTPClient(t).Do(bareTokenReq); err != nil || bareTokenResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Admin API accepted a token without the Bearer prefix: %+v %v", bareTokenResp, err)
+	} else {
+		bareTokenResp.Body.Close()
+	}
+
+	code, body := doAdminRequest(http.MethodGet, "v1/clusters", token, nil, t)
+	var summaries []clusterSummary
+	if err := json.Unmarshal(body, &summaries); err != nil || code != http.StatusOK {
+		t.Fatalf("Could not list clusters. HTTP %d: %s", code, string(body))
+	}
+	found := false
+	for _, summary := range summaries {
+		if summary.Name == "foobar-server" {
+			found = true
+			if summary.CurrentOngoingRestarts != 1 || len(summary.CurrentRestartingServers) != 1 || summary.CurrentRestartingServers[0] != fqdn {
+				t.Errorf("Unexpected cluster summary for foobar-server: %+v", summary)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Cluster foobar-server missing in cluster list: %s", string(body))
+	}
+
+	code, body = doAdminRequest(http.MethodGet, "v1/clusters/foobar-server", token, nil, t)
+	var details clusterDetails
+	if err := json.Unmarshal(body, &details); err != nil || code != http.StatusOK {
+		t.Fatalf("Could not get cluster details. HTTP %d: %s", code, string(body))
+	}
+	if len(details.Hosts) != 1 || details.Hosts[0].RequestingFqdn != fqdn || details.Settings.NamePattern != clusterSettings["foobar-server"].NamePattern {
+		t.Errorf("Unexpected cluster details for foobar-server: %s", string(body))
+	}
+	if !strings.Contains(strings.Join(details.SleepingRebootCompletionChecks, ","), fqdn) {
+		t.Errorf("Expected sleeping reboot completion check for %s in cluster details: %s", fqdn, string(body))
+	}
+
+	if code, _ := doAdminRequest(http.MethodGet, "v1/clusters/does-not-exist", token, nil, t); code != http.StatusNotFound {
+		t.Errorf("Admin API responded with HTTP %d instead of 404 for unknown cluster", code)
+	}
+
+	code, body = doAdminRequest(http.MethodDelete, "v1/clusters/foobar-server/restarting/"+fqdn, token, nil, t)
+	if code != http.StatusOK {
+		t.Fatalf("Could not release %s. HTTP %d: %s", fqdn, code, string(body))
+	}
+	cs, _ := readClusterState("foobar-server")
+	if _, ok := cs.CurrentRestartingServers[fqdn]; ok || cs.CurrentOngoingRestarts != 0 {
+		t.Errorf("FQDN %s still restarting after release: %+v", fqdn, cs)
+	}
+	mutex.Lock()
+	_, sleeping := sleepingClusterChecks[fqdn]
+	mutex.Unlock()
+	if sleeping {
+		t.Errorf("Reboot completion check of released FQDN %s is still sleeping", fqdn)
+	}
+	if code, _ := doAdminRequest(http.MethodDelete, "v1/clusters/foobar-server/restarting/"+fqdn, token, nil, t); code != http.StatusNotFound {
+		t.Errorf("Admin API responded with HTTP %d instead of 404 for releasing a FQDN that is not restarting", code)
+	}
+
+	// releasing a host also stops its running reboot completion check
+	req = request{Fqdn: "foobar-server-aa52.domain.tld", Uptime: "2h31m"}
+	resp = doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+	if resp = doRequest(req, "v1/request/restart/os", t); !resp.Goahead {
+		t.Fatal("Did not receive go_ahead: true for " + req.Fqdn)
+	}
+	cancelClusterCheck(req.Fqdn)
+	attemptsFile := startFailingClusterCheck(t, req.Fqdn)
+	if code, body = doAdminRequest(http.MethodDelete, "v1/clusters/foobar-server/restarting/"+req.Fqdn, token, nil, t); code != http.StatusOK {
+		t.Fatalf("Could not release %s. HTTP %d: %s", req.Fqdn, code, string(body))
+	}
+	checkClusterCheckStopped(t, req.Fqdn, attemptsFile)
+}
+
+func TestMetrics(t *testing.T) {
+	useTestStateDir(t, nil)
+	doRequest(request{Fqdn: "unknown.domain.tld", Uptime: "2h31m"}, "v1/request/restart/os", t)
+	req := request{Fqdn: "foobar-server-aa61.domain.tld", Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+	doRequest(req, "v1/request/restart/os", t)
+	doRequest(request{Fqdn: "foobar-server-aa62.domain.tld", Uptime: "1m"}, "v1/request/restart/os", t)
+	waitForJobs(t)
+
+	code, body := doAdminRequest(http.MethodGet, "metrics", "", nil, t)
+	if code != http.StatusOK {
+		t.Fatalf("Could not scrape metrics. HTTP %d: %s", code, string(body))
+	}
+	expectedLines := []string{
+		"# TYPE goahead_restart_decisions_total counter",
+		`goahead_restart_decisions_total{cluster="unknown",decision="unknown_host"}`,
+		`goahead_restart_decisions_total{cluster="foobar-server",decision="go_ahead"}`,
+		`goahead_restart_decisions_total{cluster="foobar-server",decision="denied_min_uptime"}`,
+		`goahead_restart_decisions_total{cluster="foobar-server",decision="request_id_handshake"}`,
+		"# TYPE goahead_hook_duration_seconds histogram",
+		`goahead_hook_duration_seconds_bucket{hook="goahead_action",le="+Inf"}`,
+		`goahead_hook_duration_seconds_count{hook="goahead_action"}`,
+		`goahead_cluster_current_ongoing_restarts{cluster="foobar-server"} 1`,
+		"goahead_sleeping_cluster_checks ",
+	}
+	for _, expectedLine := range expectedLines {
+		if !strings.Contains(string(body), expectedLine) {
+			t.Errorf("Could not find expected line '%s' in metrics: %s", expectedLine, string(body))
+		}
+	}
+
+	// a blacklisted request is counted once and not as unknown_host as well
+	unknown, blacklisted := restartDecisions.get("unknown", "unknown_host"), restartDecisions.get("foobar-server", "blacklisted")
+	doRequest(request{Fqdn: "foobar-server-black-01.domain.tld", Uptime: "2h31m"}, "v1/request/restart/os", t)
+	if restartDecisions.get("unknown", "unknown_host") != unknown || restartDecisions.get("foobar-server", "blacklisted") != blacklisted+1 {
+		t.Errorf("Expected a single blacklisted decision, but got unknown_host %v and blacklisted %v", restartDecisions.get("unknown", "unknown_host")-unknown, restartDecisions.get("foobar-server", "blacklisted")-blacklisted)
+	}
+
+	if labels := labelString([]string{"cluster"}, []string{"a\\b\"c\nd\té"}); labels != "cluster=\"a\\\\b\\\"c\\nd\té\"" {
+		t.Errorf("Unexpected escaping of label values %s", labels)
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	windows := []maintenanceWindow{
+		{Weekdays: []string{"mon-thu"}, Start: "22:00", End: "04:00", Timezone: "Europe/Berlin"},
+		{Weekdays: []string{"saturday"}, Start: "10:00", End: "12:00", Timezone: "Europe/Berlin"},
+	}
+	for i := range windows {
+		if err := windows[i].parse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		now          time.Time
+		expectedOpen bool
+		expectedNext time.Time
+	}{
+		// Monday afternoon -> Monday night
+		{time.Date(2026, 10, 19, 14, 0, 0, 0, berlin), false, time.Date(2026, 10, 19, 22, 0, 0, 0, berlin)},
+		// Tuesday early morning is still inside the window that opened on Monday
+		{time.Date(2026, 10, 20, 3, 59, 0, 0, berlin), true, time.Time{}},
+		// Friday early morning is still inside the window that opened on Thursday
+		{time.Date(2026, 10, 23, 1, 0, 0, 0, berlin), true, time.Time{}},
+		// Friday night -> Saturday morning
+		{time.Date(2026, 10, 23, 22, 30, 0, 0, berlin), false, time.Date(2026, 10, 24, 10, 0, 0, 0, berlin)},
+		// Saturday noon -> Monday night, across the end of daylight saving time
+		{time.Date(2026, 10, 24, 12, 0, 0, 0, berlin), false, time.Date(2026, 10, 26, 22, 0, 0, 0, berlin)},
+	}
+	for _, test := range tests {
+		open, next := checkMaintenanceWindows(windows, test.now)
+		if open != test.expectedOpen || (!open && !next.Equal(test.expectedNext)) {
+			t.Errorf("checkMaintenanceWindows(%s) returned open: %v next: %s, expected open: %v next: %s", test.now, open, next, test.expectedOpen, test.expectedNext)
+		}
+	}
+
+	useTestStateDir(t, nil)
+	csetting := clusterSettings["foobar-server"]
+	closed := maintenanceWindow{Start: "00:00", End: "00:01", Timezone: "UTC"}
+	closed.Weekdays = []string{strings.ToLower(time.Now().UTC().Add(48 * time.Hour).Weekday().String())}
+	if err := closed.parse(); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	modified := csetting
+	modified.MaintenanceWindows = []maintenanceWindow{closed}
+	setClusterSetting("foobar-server", modified)
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		setClusterSetting("foobar-server", csetting)
+		mutex.Unlock()
+	}()
+
+	resp := doRequest(request{Fqdn: "foobar-server-aa71.domain.tld", Uptime: "2h31m"}, "v1/request/restart/os", t)
+	if resp.Goahead || !strings.HasPrefix(resp.Message, "Denied restart request outside of the maintenance windows of cluster foobar-server") {
+		t.Errorf("Unexpected response outside of maintenance windows: %+v", resp)
+	}
+	askAgain, err := time.ParseDuration(resp.AskagainIn)
+	if err != nil || askAgain < 24*time.Hour || askAgain > 72*time.Hour {
+		t.Errorf("Unexpected ask_again_in %s outside of maintenance windows", resp.AskagainIn)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	useTestStateDir(t, nil)
+	token := currentConfig().AdminAPITokens[0]
+
+	updateConfig(func(cfg *configSettings) {
+		cfg.FreezePeriods = []freezePeriod{{Name: "christmas", Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour), Clusters: []string{"foobar-db"}}}
+	})
+	if _, _, frozen := checkFreeze("foobar-server", time.Now()); frozen {
+		t.Error("Cluster foobar-server is frozen by a freeze period of another cluster")
+	}
+	if reason, _, frozen := checkFreeze("foobar-db", time.Now()); !frozen || reason != "freeze period christmas" {
+		t.Errorf("Cluster foobar-db is not frozen by freeze period christmas, reason: %s", reason)
+	}
+	if _, _, frozen := checkFreeze("foobar-db", time.Now().Add(2*time.Hour)); frozen {
+		t.Error("Cluster foobar-db is still frozen after the end of freeze period christmas")
+	}
+	updateConfig(func(cfg *configSettings) { cfg.FreezePeriods = nil })
+
+	code, body := doAdminRequest(http.MethodPut, "v1/freeze", token, []byte(`{"reason":"release day","duration":"1h"}`), t)
+	if code != http.StatusOK {
+		t.Fatalf("Could not enable ad-hoc freeze. HTTP %d: %s", code, string(body))
+	}
+	if !fileExists(adhocFreezeFile()) {
+		t.Error("Ad-hoc freeze was not saved to " + adhocFreezeFile())
+	}
+
+	req := request{Fqdn: "foobar-server-aa81.domain.tld", Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead || !strings.HasPrefix(resp.Message, "Denied restart request during change freeze of cluster foobar-server because of ad-hoc freeze") || !strings.HasSuffix(resp.Message, "release day") {
+		t.Errorf("Unexpected response during ad-hoc freeze: %+v", resp)
+	}
+	resp = doRequest(req, "v1/inquire/restart/", t)
+	if resp.Message != "No reason to restart" {
+		t.Errorf("Unexpected response for inquire request during ad-hoc freeze: %+v", resp)
+	}
+
+	// an ad-hoc freeze that can not be removed from disk stays enabled
+	os.Remove(adhocFreezeFile())
+	os.MkdirAll(filepath.Join(adhocFreezeFile(), "keep"), 0755)
+	if code, body = doAdminRequest(http.MethodDelete, "v1/freeze", token, nil, t); code != http.StatusInternalServerError {
+		t.Errorf("Expected HTTP 500 if the ad-hoc freeze file can not be removed, but got %d: %s", code, string(body))
+	}
+	if resp = doRequest(req, "v1/request/restart/os", t); !strings.Contains(resp.Message, "ad-hoc freeze") {
+		t.Errorf("Ad-hoc freeze was lifted although its file could not be removed: %+v", resp)
+	}
+	os.RemoveAll(adhocFreezeFile())
+
+	if code, body = doAdminRequest(http.MethodDelete, "v1/freeze", token, nil, t); code != http.StatusOK {
+		t.Fatalf("Could not disable ad-hoc freeze. HTTP %d: %s", code, string(body))
+	}
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if strings.Contains(resp.Message, "freeze") {
+		t.Errorf("Restart request still denied after disabling the ad-hoc freeze: %+v", resp)
+	}
+}
+
+func TestStateStores(t *testing.T) {
+	useTestStateDir(t, nil)
+	boltStore, err := newBoltStateStore(filepath.Join(currentConfig().SaveStateDir, "test.db"))
+	if err != nil {
+		t.Fatal("Could not open bolt state store: " + err.Error())
+	}
+	defer boltStore.Close()
+
+	for name, store := range map[string]StateStore{"file": &fileStateStore{}, "bolt": boltStore} {
+		if _, found, err := store.GetClusterState("foobar-server"); found || err != nil {
+			t.Errorf("%s: Found cluster state in empty state store, error: %v", name, err)
+		}
+		cs := clusterState{CurrentOngoingRestarts: 1, CurrentRestartingServers: map[string]struct{}{"foobar-server-aa91.domain.tld": {}}}
+		if swapped, err := store.CompareAndSwapClusterState("foobar-server", clusterState{}, cs); !swapped || err != nil {
+			t.Errorf("%s: Could not create cluster state, error: %v", name, err)
+		}
+		saved, found, err := store.GetClusterState("foobar-server")
+		if !found || err != nil || saved.Revision != 1 || saved.CurrentOngoingRestarts != 1 {
+			t.Errorf("%s: Unexpected saved cluster state %+v, error: %v", name, saved, err)
+		}
+		// a second writer that read the cluster state before the first update must not overwrite it
+		if swapped, err := store.CompareAndSwapClusterState("foobar-server", clusterState{}, clusterState{CurrentOngoingRestarts: 5}); swapped || err != nil {
+			t.Errorf("%s: Overwrote cluster state with stale revision, error: %v", name, err)
+		}
+		if swapped, err := store.CompareAndSwapClusterState("foobar-server", saved, clusterState{CurrentOngoingRestarts: 0}); !swapped || err != nil {
+			t.Errorf("%s: Could not update cluster state with current revision, error: %v", name, err)
+		}
+
+		for _, fqdn := range []string{"foobar-server-aa92.domain.tld", "foobar-server-aa91.domain.tld"} {
+			if err := store.PutHostAck(response{FoundCluster: "foobar-server", RequestingFqdn: fqdn, RequestID: fqdn[14:18]}); err != nil {
+				t.Errorf("%s: Could not save ACK for %s: %v", name, fqdn, err)
+			}
+		}
+		ack, found, err := store.GetHostAck("foobar-server", "foobar-server-aa92.domain.tld")
+		if !found || err != nil || ack.RequestID != "aa92" {
+			t.Errorf("%s: Unexpected saved ACK %+v, error: %v", name, ack, err)
+		}
+		acks, err := store.ListHostAcks("foobar-server")
+		if err != nil || len(acks) != 2 || acks[0].RequestingFqdn != "foobar-server-aa91.domain.tld" {
+			t.Errorf("%s: Unexpected list of ACKs %+v, error: %v", name, acks, err)
+		}
+		if err := store.DeleteHostAck("foobar-server", "foobar-server-aa92.domain.tld"); err != nil {
+			t.Errorf("%s: Could not delete ACK: %v", name, err)
+		}
+		if _, found, _ := store.GetHostAck("foobar-server", "foobar-server-aa92.domain.tld"); found {
+			t.Errorf("%s: Found deleted ACK", name)
+		}
+
+		for _, fqdn := range []string{"foobar-server-aa92.domain.tld", "foobar-server-aa91.domain.tld"} {
+			if err := store.PutQuarantine(quarantineEntry{Fqdn: fqdn, Cluster: "foobar-server", Reason: "test"}); err != nil {
+				t.Fatalf("%s: Could not save quarantine entry: %v", name, err)
+			}
+		}
+		if entries, err := store.ListQuarantine("foobar-server"); err != nil || len(entries) != 2 || entries[0].Fqdn != "foobar-server-aa91.domain.tld" {
+			t.Errorf("%s: Unexpected quarantine entries %+v: %v", name, entries, err)
+		}
+		if err := store.DeleteQuarantine("foobar-server", "foobar-server-aa92.domain.tld"); err != nil {
+			t.Errorf("%s: Could not delete quarantine entry: %v", name, err)
+		}
+		if _, found, _ := store.GetQuarantine("foobar-server", "foobar-server-aa92.domain.tld"); found {
+			t.Errorf("%s: Found deleted quarantine entry", name)
+		}
+	}
+}
+
 func testGoaheadFalse(t *testing.T) {
 	debug = true
-	config.SaveStateDir = "/tmp/goahead/" + funcName()
-	config.LogBaseDir = config.SaveStateDir
+	saveStateDir := "/tmp/goahead/" + funcName()
+	updateConfig(func(cfg *configSettings) { cfg.SaveStateDir, cfg.LogBaseDir = saveStateDir, saveStateDir })
 	req := request{Fqdn: "foobar-server-aa07.domain.tld", Uptime: "2h31m"}
 	resp := doRequest(req, "v1/request/restart/os", t)
 	if len(resp.RequestID) > 1 {
@@ -287,3 +865,1285 @@ func testGoaheadFalse(t *testing.T) {
 	}
 
 }
+
+func TestClusterType(t *testing.T) {
+	invalid := []clusterSetting{
+		{ClusterType: "active/standby"},
+		{ClusterType: clusterTypeActivePassive},
+		{ClusterType: clusterTypeQuorum},
+	}
+	for _, csetting := range invalid {
+		if err := validateClusterType(csetting); err == nil {
+			t.Errorf("validateClusterType(%+v) did not return an error", csetting)
+		}
+	}
+	if err := validateClusterType(clusterSetting{ClusterType: clusterTypeQuorum, ClusterSize: 3}); err != nil {
+		t.Error("Valid quorum cluster setting returned: " + err.Error())
+	}
+
+	quorumTests := []struct {
+		size     int
+		allowed  int
+		expected int
+	}{
+		{3, 0, 1},
+		{5, 0, 2},
+		{5, 1, 1},
+		{5, 4, 2},
+		{6, 3, 2},
+		{2, 1, 0},
+	}
+	for _, test := range quorumTests {
+		allowed, _ := allowedParallelRestarts(clusterSetting{ClusterType: clusterTypeQuorum, ClusterSize: test.size, AllowedParallelRestarts: parallelRestarts{Count: test.allowed}}, nil)
+		if allowed != test.expected {
+			t.Errorf("Quorum cluster of size %d with allowed_parallel_restarts %d allows %d parallel restarts, expected %d", test.size, test.allowed, allowed, test.expected)
+		}
+	}
+
+	primaryTests := []struct {
+		primaryCheck string
+		expected     bool
+	}{
+		{"./tests/always-true.sh {:%fqdn%:}", true},
+		{"false", false},
+		{"sh -c 'exit 3'", true},
+		{"./tests/does-not-exist.sh", true},
+	}
+	for _, test := range primaryTests {
+		csetting := clusterSetting{ClusterType: clusterTypeActivePassive, PrimaryCheck: test.primaryCheck}
+		if primary, _ := checkPrimary(newHookData("foobar-server-aa91.domain.tld", "foobar-server", csetting), csetting, mainLogger); primary != test.expected {
+			t.Errorf("checkPrimary() with primary_check %s returned %v, expected %v", test.primaryCheck, primary, test.expected)
+		}
+	}
+
+	useTestStateDir(t, nil)
+	csetting := clusterSettings["foobar-server"]
+	mutex.Lock()
+	modified := csetting
+	modified.ClusterType = clusterTypeActivePassive
+	modified.PrimaryCheck = "./tests/always-true.sh {:%fqdn%:}"
+	setClusterSetting("foobar-server", modified)
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		setClusterSetting("foobar-server", csetting)
+		mutex.Unlock()
+	}()
+
+	req := request{Fqdn: "foobar-server-aa91.domain.tld", Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead || resp.Message != "Denied restart request, because FQDN foobar-server-aa91.domain.tld is the current primary of active/passive cluster foobar-server" {
+		t.Errorf("Unexpected response for the primary of an active/passive cluster: %+v", resp)
+	}
+	if restartDecisions.get("foobar-server", "denied_primary") < 1 {
+		t.Error("Denied restart request of the primary was not counted as denied_primary decision")
+	}
+}
+
+func TestClusterMembers(t *testing.T) {
+	var csetting clusterSetting
+	if err := yaml.Unmarshal([]byte("allowed_parallel_restarts: 20%\nmembers:\n  static:\n    - foobar-server-aa01.domain.tld\n"), &csetting); err != nil {
+		t.Fatal("Could not unmarshal percentage allowed_parallel_restarts: " + err.Error())
+	}
+	if csetting.AllowedParallelRestarts.Percent != 20 || validateMembers(csetting) != nil {
+		t.Errorf("Unexpected allowed_parallel_restarts %+v", csetting.AllowedParallelRestarts)
+	}
+	for _, invalid := range []string{"0%", "101%", "-1", "two"} {
+		if _, err := parseParallelRestarts(invalid); err == nil {
+			t.Errorf("parseParallelRestarts(%s) did not return an error", invalid)
+		}
+	}
+	if err := validateMembers(clusterSetting{AllowedParallelRestarts: parallelRestarts{Percent: 20}}); err == nil {
+		t.Error("validateMembers() accepted a percentage without a members inventory")
+	}
+	for members, expected := range map[int]int{0: 0, 3: 1, 10: 2, 14: 2, 15: 3} {
+		if allowed := (parallelRestarts{Percent: 20}).allowed(members); allowed != expected {
+			t.Errorf("20%% of %d members allows %d parallel restarts, expected %d", members, allowed, expected)
+		}
+	}
+
+	useTestStateDir(t, nil)
+	membersFile := filepath.Join(currentConfig().SaveStateDir, "members.txt")
+	os.WriteFile(membersFile, []byte("# inventory\nfoobar-server-aa93.domain.tld\n\nfoobar-server-aa92.domain.tld\n"), 0644)
+	members := clusterMembers{Static: []string{"foobar-server-aa92.domain.tld"}, File: membersFile, Command: "echo foobar-server-aa94.domain.tld"}
+	resolved, err := resolveClusterMembers("foobar-server", clusterSetting{Members: members}, mainLogger)
+	if err != nil || strings.Join(resolved, ",") != "foobar-server-aa92.domain.tld,foobar-server-aa93.domain.tld,foobar-server-aa94.domain.tld" {
+		t.Errorf("Unexpected cluster members %v error: %v", resolved, err)
+	}
+	if _, err := resolveClusterMembers("foobar-server", clusterSetting{Members: clusterMembers{Command: "false"}}, mainLogger); err == nil {
+		t.Error("resolveClusterMembers() did not return an error for a failing members command")
+	}
+
+	original := clusterSettings["foobar-server"]
+	mutex.Lock()
+	modified := original
+	modified.AllowedParallelRestarts = parallelRestarts{Percent: 34}
+	modified.Members = members
+	setClusterSetting("foobar-server", modified)
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		setClusterSetting("foobar-server", original)
+		mutex.Unlock()
+	}()
+
+	for _, fqdn := range []string{"foobar-server-aa92.domain.tld", "foobar-server-aa93.domain.tld"} {
+		req := request{Fqdn: fqdn, Uptime: "2h31m"}
+		resp := doRequest(req, "v1/request/restart/os", t)
+		req.RequestID = resp.RequestID
+		resp = doRequest(req, "v1/request/restart/os", t)
+		if fqdn == "foobar-server-aa92.domain.tld" && !resp.Goahead {
+			t.Errorf("First member did not get the go_ahead: %+v", resp)
+		} else if fqdn == "foobar-server-aa93.domain.tld" && (resp.Goahead || !strings.Contains(resp.Message, "larger than the allowed_parallel_restarts 34% of 3 members: 1 >= 1")) {
+			t.Errorf("Second member was not denied by the percentage of cluster members: %+v", resp)
+		}
+	}
+	cancelClusterCheck("foobar-server-aa92.domain.tld")
+	if _, _, err := modifyClusterState("foobar-server", "foobar-server-aa92.domain.tld", "remove", mainLogger); err != nil {
+		t.Fatal("Could not flag foobar-server-aa92.domain.tld as rebooted: " + err.Error())
+	}
+
+	code, body := doAdminRequest(http.MethodGet, "v1/clusters/foobar-server", currentConfig().AdminAPITokens[0], nil, t)
+	var details clusterDetails
+	if err := json.Unmarshal(body, &details); code != http.StatusOK || err != nil {
+		t.Fatalf("Could not get cluster details. HTTP %d: %s", code, string(body))
+	}
+	if details.Membership == nil || details.Membership.Members != 3 || details.Membership.Pending != 2 || strings.Join(details.Membership.PendingMembers, ",") != "foobar-server-aa93.domain.tld,foobar-server-aa94.domain.tld" {
+		t.Errorf("Unexpected membership status %+v", details.Membership)
+	}
+	_, body = doAdminRequest(http.MethodGet, "v1/clusters/foobar-server?since="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)), currentConfig().AdminAPITokens[0], nil, t)
+	json.Unmarshal(body, &details)
+	if details.Membership == nil || details.Membership.Pending != 3 {
+		t.Errorf("Rebooted member is not pending again since a later timestamp %+v", details.Membership)
+	}
+}
+
+func TestClusterDependencies(t *testing.T) {
+	useTestStateDir(t, nil)
+	original := clusterSettings["foobar-server"]
+	defer func() {
+		mutex.Lock()
+		setClusterSetting("foobar-server", original)
+		mutex.Unlock()
+	}()
+
+	mutex.Lock()
+	modified := original
+	modified.DependsOn = []string{"foobar-unknown"}
+	setClusterSetting("foobar-server", modified)
+	mutex.Unlock()
+	if err := validateClusterDependencies(clusterSettings); err == nil || err.Error() != "cluster foobar-server references unknown cluster foobar-unknown in depends_on" {
+		t.Errorf("Unexpected validation result for unknown cluster dependency: %v", err)
+	}
+
+	mutex.Lock()
+	modified.DependsOn = nil
+	modified.MutuallyExclusiveWith = []string{"foobar-db"}
+	setClusterSetting("foobar-server", modified)
+	mutex.Unlock()
+	if err := validateClusterDependencies(clusterSettings); err != nil {
+		t.Error("Valid cluster dependencies returned: " + err.Error())
+	}
+	if blocking := blockingClusters("foobar-db", clusterSettings); blocking["foobar-server"] != "is mutually exclusive with" {
+		t.Errorf("mutually_exclusive_with is not symmetric: %v", blocking)
+	}
+
+	err := stateStore.PutClusterState("foobar-db", clusterState{CurrentOngoingRestarts: 1, CurrentRestartingServers: map[string]struct{}{"foobar-aa01.domain.tld": {}}})
+	if err != nil {
+		t.Fatal("Could not save cluster state of foobar-db: " + err.Error())
+	}
+	req := request{Fqdn: "foobar-server-aa95.domain.tld", Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead || resp.Message != "Denied restart request, because cluster foobar-server is mutually exclusive with cluster foobar-db Currently restarting hosts of foobar-db: foobar-aa01.domain.tld" {
+		t.Errorf("Unexpected response while a host of a mutually exclusive cluster is restarting: %+v", resp)
+	}
+
+	if _, _, err := modifyClusterState("foobar-db", "foobar-aa01.domain.tld", "remove", mainLogger); err != nil {
+		t.Fatal("Could not flag foobar-aa01.domain.tld as rebooted: " + err.Error())
+	}
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if !resp.Goahead {
+		t.Errorf("Restart request still denied after the host of the mutually exclusive cluster rebooted: %+v", resp)
+	}
+	cancelClusterCheck(req.Fqdn)
+}
+
+func TestRestartBudgets(t *testing.T) {
+	useTestStateDir(t, nil)
+	originalServer := clusterSettings["foobar-server"]
+	originalDb := clusterSettings["foobar-db"]
+	setLabels := func(serverRack string, dbRack string) {
+		mutex.Lock()
+		server := originalServer
+		server.Labels = map[string]string{"rack": serverRack}
+		db := originalDb
+		db.Labels = map[string]string{"rack": dbRack}
+		setClusterSetting("foobar-server", server)
+		setClusterSetting("foobar-db", db)
+		mutex.Unlock()
+	}
+	defer func() {
+		mutex.Lock()
+		setClusterSetting("foobar-server", originalServer)
+		setClusterSetting("foobar-db", originalDb)
+		mutex.Unlock()
+		updateConfig(func(cfg *configSettings) { cfg.GlobalAllowedParallelRestarts, cfg.RestartBudgets = 0, nil })
+	}()
+
+	err := stateStore.PutClusterState("foobar-db", clusterState{CurrentOngoingRestarts: 1, CurrentRestartingServers: map[string]struct{}{"foobar-aa02.domain.tld": {}}})
+	if err != nil {
+		t.Fatal("Could not save cluster state of foobar-db: " + err.Error())
+	}
+	req := request{Fqdn: "foobar-server-aa96.domain.tld", Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+
+	updateConfig(func(cfg *configSettings) { cfg.GlobalAllowedParallelRestarts = 1 })
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead || resp.Message != "Denied restart request as the global_allowed_parallel_restarts budget is exhausted: 1 >= 1" {
+		t.Errorf("Unexpected response with exhausted global budget: %+v", resp)
+	}
+
+	updateConfig(func(cfg *configSettings) {
+		cfg.GlobalAllowedParallelRestarts, cfg.RestartBudgets = 0, map[string]int{"rack": 1}
+	})
+	setLabels("a1", "a1")
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead || resp.Message != "Denied restart request as the restart_budgets rack=a1 budget is exhausted: 1 >= 1" {
+		t.Errorf("Unexpected response with exhausted rack budget: %+v", resp)
+	}
+	if restartDecisions.get("foobar-server", "denied_budget") < 2 {
+		t.Error("Denied restart requests were not counted as denied_budget decisions")
+	}
+
+	setLabels("a1", "b2")
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if !resp.Goahead {
+		t.Errorf("Restart request denied although the budget of rack a1 is not exhausted: %+v", resp)
+	}
+	cancelClusterCheck(req.Fqdn)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	includeDir := checkDirAndCreate(filepath.Join(dir, "conf.d"), "test include_dir")
+	mainConfig, _ := os.ReadFile(testConfigFile)
+	mainConfig = bytes.Replace(mainConfig, []byte("include_dir: ./examples.d/"), []byte("include_dir: "+includeDir), 1)
+	os.WriteFile(filepath.Join(dir, "config.yml"), mainConfig, 0644)
+	for _, file := range []string{"foobar-db.yml", "foobar-server-standalone.yml", "foobar-server.yml"} {
+		data, _ := os.ReadFile(filepath.Join("examples.d", file))
+		os.WriteFile(filepath.Join(includeDir, file), data, 0644)
+	}
+	originalConfigFile := configFile
+	configFile = filepath.Join(dir, "config.yml")
+	defer func() {
+		configFile = originalConfigFile
+		if _, err := reloadConfig(); err != nil {
+			t.Error("Could not restore the original config: " + err.Error())
+		}
+	}()
+
+	os.WriteFile(filepath.Join(includeDir, "foobar-proxy.yml"), []byte("---\nfoobar-proxy:\n  enabled: true\n  name_pattern: \"^foobar-proxy[[:digit:]]{2}.domain.tld$\"\n  cluster_type: active/active\n  allowed_parallel_restarts: 1\n  reboot_completion_check: ./tests/always-true.sh\n  reboot_completion_check_interval: 10s\n  reboot_completion_check_consecutive_successes: 1\n"), 0644)
+	code, body := doAdminRequest(http.MethodPost, "v1/reload", currentConfig().AdminAPITokens[0], nil, t)
+	var result reloadResult
+	if err := json.Unmarshal(body, &result); code != http.StatusOK || err != nil {
+		t.Fatalf("Could not reload config. HTTP %d: %s", code, string(body))
+	}
+	if strings.Join(result.AddedClusters, ",") != "foobar-proxy" || len(result.RemovedClusters) != 0 {
+		t.Errorf("Unexpected reload result %+v", result)
+	}
+	resp := doRequest(request{Fqdn: "foobar-proxy01.domain.tld", Uptime: "2h31m"}, "v1/request/restart/os", t)
+	if resp.FoundCluster != "foobar-proxy" {
+		t.Errorf("Added cluster foobar-proxy was not matched after reload: %+v", resp)
+	}
+
+	os.WriteFile(filepath.Join(includeDir, "foobar-proxy.yml"), []byte("---\nfoobar-proxy:\n  name_pattern: \"^foobar-proxy[[:digit:]]{2}.domain.tld$\"\n  cluster_type: active/standby\n"), 0644)
+	code, body = doAdminRequest(http.MethodPost, "v1/reload", currentConfig().AdminAPITokens[0], nil, t)
+	if code != http.StatusUnprocessableEntity || !strings.Contains(string(body), "unknown cluster_type active/standby") {
+		t.Errorf("Invalid cluster settings were not rejected. HTTP %d: %s", code, string(body))
+	}
+	mutex.Lock()
+	proxy, found := clusterSettings["foobar-proxy"]
+	mutex.Unlock()
+	if !found || proxy.ClusterType != clusterTypeActiveActive {
+		t.Errorf("Invalid reload replaced the cluster settings of foobar-proxy: %+v", proxy)
+	}
+
+	// an invalid save_state_dir keeps the running config instead of terminating goahead
+	os.WriteFile(filepath.Join(dir, "config.yml"), bytes.Replace(mainConfig, []byte("save_state_dir: /tmp/goahead/"), []byte("save_state_dir: "+filepath.Join(dir, "config.yml")), 1), 0644)
+	code, body = doAdminRequest(http.MethodPost, "v1/reload", currentConfig().AdminAPITokens[0], nil, t)
+	if code != http.StatusUnprocessableEntity || !strings.Contains(string(body), "exists, but is not a directory") {
+		t.Errorf("Invalid save_state_dir was not rejected. HTTP %d: %s", code, string(body))
+	}
+	os.WriteFile(filepath.Join(dir, "config.yml"), append(append([]byte{}, mainConfig...), []byte("\nreboot_completion_sweep_interval: -1m\n")...), 0644)
+	code, body = doAdminRequest(http.MethodPost, "v1/reload", currentConfig().AdminAPITokens[0], nil, t)
+	if code != http.StatusUnprocessableEntity || !strings.Contains(string(body), "Invalid reboot_completion_sweep_interval -1m0s") {
+		t.Errorf("Negative reboot_completion_sweep_interval was not rejected. HTTP %d: %s", code, string(body))
+	}
+	mutex.Lock()
+	interval := currentConfig().RebootCompletionSweepInterval
+	mutex.Unlock()
+	if interval <= 0 {
+		t.Errorf("Rejected reload changed the reboot_completion_sweep_interval to %s", interval)
+	}
+	os.WriteFile(filepath.Join(dir, "config.yml"), mainConfig, 0644)
+
+	os.Remove(filepath.Join(includeDir, "foobar-proxy.yml"))
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	for i := 0; i < 50; i++ {
+		mutex.Lock()
+		_, found = clusterSettings["foobar-proxy"]
+		mutex.Unlock()
+		if !found {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if found {
+		t.Error("Removed cluster foobar-proxy is still configured after SIGHUP")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	includeDir := checkDirAndCreate(filepath.Join(dir, "conf.d"), "test include_dir")
+	mainConfig, _ := os.ReadFile(testConfigFile)
+	mainConfig = bytes.Replace(mainConfig, []byte("include_dir: ./examples.d/"), []byte("include_dir: "+includeDir), 1)
+	os.WriteFile(filepath.Join(dir, "config.yml"), append(mainConfig, []byte("listen_prot: 8443\n")...), 0644)
+	os.WriteFile(filepath.Join(includeDir, "broken.yml"), []byte(`---
+foobar-broken:
+  name_pattern: "^(foobar-broken.*$"
+  blacklist_name_pattern:
+    - "*-black-*"
+  allowed_parallel_restart: 2
+  reboot_completion_check: ./tests/does-not-exist.sh {:%fqdn%:}
+  reboot_completion_check_interval: -5s
+  reboot_completion_panic_threshold: 3h
+  reboot_completion_panic_actions:
+    scripts:
+      - /tmp/{:%fqdn%:}_panic
+  depends_on:
+    - foobar-unknown
+`), 0644)
+	os.WriteFile(filepath.Join(includeDir, "valid.yaml"), []byte(`---
+foobar-valid:
+  name_pattern: "^foobar-valid[[:digit:]]{2}.domain.tld$"
+  cluster_type: active/active
+  allowed_parallel_restarts: 1
+  reboot_completion_check: ./tests/always-true.sh
+  reboot_completion_check_interval: 10s
+  reboot_completion_check_consecutive_successes: 1
+  reboot_completion_panic_threshold: 3h
+`), 0644)
+
+	problems := validateConfig(filepath.Join(dir, "config.yml"))
+	expected := []string{
+		filepath.Join(dir, "config.yml") + ": yaml: unmarshal errors:\n  line 15: field listen_prot not found in type main.configSettings",
+		"broken.yml: yaml: unmarshal errors:\n  line 6: field allowed_parallel_restart not found in type main.clusterSetting",
+		"broken.yml: cluster foobar-broken: invalid name_pattern ^(foobar-broken.*$: error parsing regexp: missing closing ): `^(foobar-broken.*$`",
+		"broken.yml: cluster foobar-broken: invalid blacklist_name_pattern *-black-*: error parsing regexp: missing argument to repetition operator: `*`",
+		"broken.yml: cluster foobar-broken: reboot_completion_check_interval must not be negative: -5s",
+		"broken.yml: cluster foobar-broken: reboot_completion_check_consecutive_successes must be at least 1: 0",
+		"broken.yml: cluster foobar-broken: reboot_completion_check command ./tests/does-not-exist.sh {:%fqdn%:} is not executable",
+		"cluster foobar-broken references unknown cluster foobar-unknown in depends_on",
+	}
+	if len(problems) != len(expected) {
+		t.Errorf("Expected %d problems, but got %d:\n%s", len(expected), len(problems), strings.Join(problems, "\n"))
+	}
+	for _, e := range expected {
+		found := false
+		for _, problem := range problems {
+			if strings.Contains(problem, e) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Missing problem %q in:\n%s", e, strings.Join(problems, "\n"))
+		}
+	}
+
+	if _, err := readClusterSetting(filepath.Join(includeDir, "broken.yml")); err == nil || !strings.Contains(err.Error(), "invalid name_pattern") {
+		t.Errorf("readClusterSetting() did not reject the broken name_pattern: %v", err)
+	}
+	os.Remove(filepath.Join(includeDir, "broken.yml"))
+	os.WriteFile(filepath.Join(dir, "config.yml"), mainConfig, 0644)
+	if problems := validateConfig(filepath.Join(dir, "config.yml")); len(problems) > 0 {
+		t.Errorf("Valid config returned problems:\n%s", strings.Join(problems, "\n"))
+	}
+
+	// -validate does not create the save_state_dir
+	stateDir := filepath.Join(dir, "state")
+	os.WriteFile(filepath.Join(dir, "config.yml"), bytes.Replace(mainConfig, []byte("save_state_dir: /tmp/goahead/"), []byte("save_state_dir: "+stateDir), 1), 0644)
+	if problems := validateConfig(filepath.Join(dir, "config.yml")); len(problems) > 0 || fileExists(stateDir) {
+		t.Errorf("Validating a config with a missing save_state_dir returned problems or created it:\n%s", strings.Join(problems, "\n"))
+	}
+}
+
+func TestClusterMatch(t *testing.T) {
+	settings := map[string]clusterSetting{
+		"foobar-wide":    {Enabled: true, NamePattern: "^foobar-.*$"},
+		"foobar-proxy":   {Enabled: true, Priority: 10, NamePattern: "^foobar-proxy.*$"},
+		"foobar-blocked": {Enabled: true, Priority: 20, NamePattern: "^foobar-proxy.*$", BlacklistNamePattern: []string{"^foobar-proxy01"}},
+		"foobar-off":     {Enabled: false, Priority: 30, NamePattern: "^foobar-.*$"},
+	}
+	for name, csetting := range settings {
+		if problems := csetting.compilePatterns(); len(problems) > 0 {
+			t.Fatalf("Could not compile the patterns of %s: %v", name, problems)
+		}
+		settings[name] = csetting
+	}
+	if order := strings.Join(clusterNamesByPriority(settings), ","); order != "foobar-off,foobar-blocked,foobar-proxy,foobar-wide" {
+		t.Errorf("Unexpected cluster order %s", order)
+	}
+	m := matchCluster("foobar-proxy01.domain.tld", settings)
+	if m.Cluster != "foobar-proxy" || strings.Join(m.NameMatches, ",") != "foobar-blocked,foobar-proxy,foobar-wide" || m.Blacklisted["foobar-blocked"] != "^foobar-proxy01" {
+		t.Errorf("Unexpected match %+v", m)
+	}
+
+	warnings, err := findClusterOverlaps(settings, []string{"foobar-proxy01.domain.tld", "foobar-db01.domain.tld"})
+	if err != nil || len(warnings) != 1 || !strings.Contains(warnings[0], "foobar-proxy01.domain.tld matches clusters foobar-proxy (priority 10), foobar-wide (priority 0) Using cluster foobar-proxy") {
+		t.Errorf("Unexpected overlap warnings %q error %v", warnings, err)
+	}
+	wide := clusterSetting{Enabled: true, Priority: 10, NamePattern: "^foobar-.*$"}
+	wide.compilePatterns()
+	settings["foobar-wide"] = wide
+	if _, err := findClusterOverlaps(settings, []string{"foobar-proxy01.domain.tld"}); err == nil || !strings.Contains(err.Error(), "with the same priority") {
+		t.Errorf("Overlap with the same priority was not rejected: %v", err)
+	}
+
+	// foobar-server-standalone has a higher priority than foobar-server
+	resp := doRequest(request{Fqdn: "foobar-server-standalone01.domain.tld", Uptime: "1m"}, "v1/request/restart/os", t)
+	if resp.FoundCluster != "foobar-server-standalone" {
+		t.Errorf("Expected cluster foobar-server-standalone, but got %+v", resp)
+	}
+
+	payload, _ := json.Marshal(matchRequest{Fqdns: []string{"foobar-server-standalone01.domain.tld", "foobar-server-black-01.domain.tld", "foobar-unknown.domain.tld"}, Uptime: "1m"})
+	code, body := doAdminRequest(http.MethodPost, "v1/match", currentConfig().AdminAPITokens[0], payload, t)
+	var explanations []matchExplanation
+	if err := json.Unmarshal(body, &explanations); code != http.StatusOK || err != nil || len(explanations) != 3 {
+		t.Fatalf("Could not match FQDNs. HTTP %d: %s", code, string(body))
+	}
+	if e := explanations[0]; e.Cluster != "foobar-server-standalone" || strings.Join(e.MatchingClusters, ",") != "foobar-server-standalone,foobar-server" || e.Decision != "denied_min_uptime" {
+		t.Errorf("Unexpected explanation %+v", e)
+	}
+	if e := explanations[1]; e.Cluster != "" || e.Decision != "blacklisted" || e.BlacklistPatterns["foobar-server"] != ".*-black-.*" {
+		t.Errorf("Unexpected explanation %+v", e)
+	}
+	if e := explanations[2]; e.Decision != "unknown_host" {
+		t.Errorf("Unexpected explanation %+v", e)
+	}
+
+	mutex.Lock()
+	before, _, _ := stateStore.GetClusterState("foobar-server")
+	mutex.Unlock()
+	payload, _ = json.Marshal(matchRequest{Fqdns: []string{"foobar-server-42.domain.tld"}, Uptime: "48h"})
+	code, body = doAdminRequest(http.MethodPost, "v1/match", currentConfig().AdminAPITokens[0], payload, t)
+	explanations = nil
+	if err := json.Unmarshal(body, &explanations); code != http.StatusOK || err != nil || len(explanations) != 1 || !explanations[0].ClusterStateTested {
+		t.Fatalf("Could not match FQDN. HTTP %d: %s", code, string(body))
+	}
+	mutex.Lock()
+	after, _, _ := stateStore.GetClusterState("foobar-server")
+	mutex.Unlock()
+	if _, restarting := after.CurrentRestartingServers["foobar-server-42.domain.tld"]; restarting || after.CurrentOngoingRestarts != before.CurrentOngoingRestarts {
+		t.Errorf("Dry run modified the cluster state of foobar-server: %+v", after)
+	}
+
+	broken := clusterSetting{Enabled: true, NamePattern: "^(foobar-broken.*$", BlacklistNamePattern: []string{"*-black-*"}}
+	if problems := broken.compilePatterns(); len(problems) != 2 {
+		t.Errorf("Expected 2 problems for the invalid patterns, but got %v", problems)
+	}
+	if broken.matchesName("foobar-broken01.domain.tld") || len(broken.blacklistedBy("foobar-broken-black-01.domain.tld")) > 0 {
+		t.Error("Invalid patterns must never match")
+	}
+}
+
+func TestStateFileRecovery(t *testing.T) {
+	useTestStateDir(t, nil)
+	token := currentConfig().AdminAPITokens[0]
+	clusterFile := filepath.Join(currentConfig().SaveStateDir, "foobar-server.json")
+	first := clusterState{CurrentOngoingRestarts: 1, CurrentRestartingServers: map[string]struct{}{"foobar-server-aa71.domain.tld": {}}}
+	second := clusterState{CurrentOngoingRestarts: 2, CurrentRestartingServers: map[string]struct{}{"foobar-server-aa71.domain.tld": {}, "foobar-server-aa72.domain.tld": {}}}
+	for _, cs := range []clusterState{first, second} {
+		if err := stateStore.PutClusterState("foobar-server", cs); err != nil {
+			t.Fatal("Could not save cluster state of foobar-server: " + err.Error())
+		}
+	}
+	if backup, err := readClusterStateFile(clusterFile+".bak", "foobar-server", mainLogger); err != nil || backup.CurrentOngoingRestarts != 1 {
+		t.Errorf("Backup generation does not contain the previous cluster state: %+v %v", backup, err)
+	}
+	if leftovers, _ := filepath.Glob(clusterFile + ".tmp*"); len(leftovers) > 0 {
+		t.Errorf("Atomic writes left temporary files behind: %v", leftovers)
+	}
+
+	// a truncated cluster state file must deny restarts instead of freeing all restart slots
+	os.WriteFile(clusterFile, []byte(`{"last_restart_panic_timestamp":"0001-01-01T00:00:00Z","CurrentOngo`), 0644)
+	req := request{Fqdn: "foobar-server-aa73.domain.tld", Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead || !strings.Contains(resp.Message, "corrupt cluster state file "+clusterFile) {
+		t.Errorf("Restart request was not denied with a corrupt cluster state file: %+v", resp)
+	}
+
+	code, body := doAdminRequest(http.MethodPost, "v1/clusters/foobar-server/state/restore", token, nil, t)
+	var restored clusterState
+	if err := json.Unmarshal(body, &restored); code != http.StatusOK || err != nil || restored.CurrentOngoingRestarts != 1 {
+		t.Fatalf("Could not restore the cluster state from its backup. HTTP %d: %s", code, string(body))
+	}
+	if corrupt, _ := filepath.Glob(clusterFile + ".corrupt-*"); len(corrupt) != 1 {
+		t.Errorf("Corrupt cluster state file was not kept: %v", corrupt)
+	}
+	if cs, _, err := stateStore.GetClusterState("foobar-server"); err != nil || cs.CurrentOngoingRestarts != 1 {
+		t.Errorf("Unexpected cluster state after the restore: %+v %v", cs, err)
+	}
+
+	os.WriteFile(clusterFile, []byte("garbage"), 0644)
+	code, body = doAdminRequest(http.MethodPost, "v1/clusters/foobar-server/state/restore?reset=true", token, nil, t)
+	if code != http.StatusOK {
+		t.Errorf("Could not reset the cluster state. HTTP %d: %s", code, string(body))
+	}
+	if cs, found, err := stateStore.GetClusterState("foobar-server"); err != nil || !found || cs.CurrentOngoingRestarts != 0 {
+		t.Errorf("Unexpected cluster state after the reset: %+v %v", cs, err)
+	}
+	cancelClusterCheck("foobar-server-aa71.domain.tld")
+}
+
+func TestRestartExpiry(t *testing.T) {
+	useTestStateDir(t, nil)
+	original := clusterSettings["foobar-server"]
+	defer func() {
+		mutex.Lock()
+		setClusterSetting("foobar-server", original)
+		mutex.Unlock()
+	}()
+	setPolicy := func(policy string) {
+		mutex.Lock()
+		modified := original
+		modified.RebootCompletionMaxDuration = time.Hour
+		modified.RebootCompletionExpiryPolicy = policy
+		modified.RebootCompletionPanicActions = rebootCompletionPanicActionsStruct{Scripts: []hookAction{{Command: "touch " + currentConfig().SaveStateDir + "{:%fqdn%:}_{:%panic_reason%:}"}}}
+		setClusterSetting("foobar-server", modified)
+		mutex.Unlock()
+	}
+	if err := validateExpiryPolicy(clusterSetting{RebootCompletionExpiryPolicy: "forget"}); err == nil {
+		t.Error("Unknown reboot_completion_expiry_policy was not rejected")
+	}
+
+	setPolicy(expiryPolicyReleaseAndBlacklist)
+	now := time.Now()
+	stale := "foobar-server-aa81.domain.tld"
+	recent := "foobar-server-aa82.domain.tld"
+	err := stateStore.PutClusterState("foobar-server", clusterState{
+		LastRestartRequestTimestamp: now.Add(-10 * time.Minute),
+		CurrentOngoingRestarts:      2,
+		CurrentRestartingServers:    map[string]struct{}{stale: {}, recent: {}},
+		RestartGrantedTimestamps:    map[string]time.Time{stale: now.Add(-2 * time.Hour), recent: now.Add(-10 * time.Minute)},
+	})
+	if err != nil {
+		t.Fatal("Could not save cluster state of foobar-server: " + err.Error())
+	}
+	attemptsFile := startFailingClusterCheck(t, stale)
+	expireStaleRestarts(now)
+	checkClusterCheckStopped(t, stale, attemptsFile)
+	waitForJobs(t)
+	cs, _, _ := stateStore.GetClusterState("foobar-server")
+	if _, restarting := cs.CurrentRestartingServers[stale]; restarting || cs.CurrentOngoingRestarts != 1 || cs.ExpiredRestarts[stale].Policy != expiryPolicyReleaseAndBlacklist {
+		t.Errorf("Stale restart of %s was not released: %+v", stale, cs)
+	}
+	if _, restarting := cs.CurrentRestartingServers[recent]; !restarting {
+		t.Errorf("Recent restart of %s got released: %+v", recent, cs)
+	}
+	if !fileExists(currentConfig().SaveStateDir + stale + "_" + panicKindMaxDuration) {
+		t.Error("Panic actions were not triggered with the max_duration panic reason for " + stale)
+	}
+
+	req := request{Fqdn: stale, Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead || !strings.Contains(resp.Message, "is quarantined in cluster foobar-server") {
+		t.Errorf("Restart request of the quarantined %s was not denied: %+v", stale, resp)
+	}
+	if q, found, _ := stateStore.GetQuarantine("foobar-server", stale); !found || q.Source != quarantineSourceExpiry {
+		t.Errorf("Expired restart of %s was not quarantined: %+v", stale, q)
+	}
+	code, body := doAdminRequest(http.MethodDelete, "v1/clusters/foobar-server/quarantine/"+stale, currentConfig().AdminAPITokens[0], nil, t)
+	if code != http.StatusOK {
+		t.Errorf("Could not remove %s from the quarantine. HTTP %d: %s", stale, code, string(body))
+	}
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if !resp.Goahead {
+		t.Errorf("Restart request of %s was denied after removing it from the quarantine: %+v", stale, resp)
+	}
+	cancelClusterCheck(stale)
+
+	// keep only triggers the panic actions once and keeps the restart slot
+	setPolicy(expiryPolicyKeep)
+	later := now.Add(2 * time.Hour)
+	expireStaleRestarts(later)
+	waitForJobs(t)
+	cs, _, _ = stateStore.GetClusterState("foobar-server")
+	if _, restarting := cs.CurrentRestartingServers[recent]; !restarting || cs.ExpiredRestarts[recent].Policy != expiryPolicyKeep {
+		t.Errorf("Expired restart of %s was not kept: %+v", recent, cs)
+	}
+	panicFile := currentConfig().SaveStateDir + recent + "_" + panicKindMaxDuration
+	if !fileExists(panicFile) {
+		t.Error("Panic actions were not triggered for " + recent)
+	}
+	os.Remove(panicFile)
+	expireStaleRestarts(later.Add(time.Minute))
+	waitForJobs(t)
+	if fileExists(panicFile) {
+		t.Error("Panic actions were triggered twice for the same expired restart of " + recent)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	useTestStateDir(t, nil)
+	token := currentConfig().AdminAPITokens[0]
+	fqdn := "foobar-server-aa91.domain.tld"
+	original := clusterSettings["foobar-server"]
+	defer func() {
+		mutex.Lock()
+		setClusterSetting("foobar-server", original)
+		mutex.Unlock()
+	}()
+
+	code, body := doAdminRequest(http.MethodPut, "v1/clusters/foobar-server/quarantine/"+fqdn, token, []byte(`{}`), t)
+	if code != http.StatusBadRequest {
+		t.Errorf("Quarantine without reason was not rejected. HTTP %d: %s", code, string(body))
+	}
+	code, body = doAdminRequest(http.MethodPut, "v1/clusters/foobar-server/quarantine/"+fqdn, token, []byte(`{"reason":"broken RAID controller"}`), t)
+	if code != http.StatusOK {
+		t.Fatalf("Could not quarantine %s. HTTP %d: %s", fqdn, code, string(body))
+	}
+	req := request{Fqdn: fqdn, Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead || !strings.Contains(resp.Message, "is quarantined in cluster foobar-server") || !strings.Contains(resp.Message, "by 127.0.0.1: broken RAID controller") {
+		t.Errorf("Restart request of the quarantined %s was not denied: %+v", fqdn, resp)
+	}
+
+	code, body = doAdminRequest(http.MethodGet, "v1/quarantine", token, nil, t)
+	var entries []quarantineEntry
+	if err := json.Unmarshal(body, &entries); code != http.StatusOK || err != nil || len(entries) != 1 || entries[0].Fqdn != fqdn || entries[0].Source != quarantineSourceAdmin {
+		t.Errorf("Unexpected quarantine list. HTTP %d: %s", code, string(body))
+	}
+	code, _ = doAdminRequest(http.MethodDelete, "v1/clusters/foobar-server/quarantine/"+fqdn, token, nil, t)
+	if code != http.StatusOK {
+		t.Errorf("Could not remove %s from the quarantine. HTTP %d", fqdn, code)
+	}
+	code, _ = doAdminRequest(http.MethodDelete, "v1/clusters/foobar-server/quarantine/"+fqdn, token, nil, t)
+	if code != http.StatusNotFound {
+		t.Errorf("Removing %s from the quarantine twice returned HTTP %d", fqdn, code)
+	}
+
+	// the panic threshold quarantines the hosts that did not come back
+	mutex.Lock()
+	modified := original
+	modified.QuarantineOnPanic = true
+	modified.RebootCompletionPanicActions = rebootCompletionPanicActionsStruct{}
+	setClusterSetting("foobar-server", modified)
+	mutex.Unlock()
+	stuck := "foobar-server-aa92.domain.tld"
+	err := stateStore.PutClusterState("foobar-server", clusterState{
+		LastRestartRequestTimestamp: time.Now().Add(-4 * time.Hour),
+		CurrentOngoingRestarts:      1,
+		CurrentRestartingServers:    map[string]struct{}{stuck: {}},
+	})
+	if err != nil {
+		t.Fatal("Could not save cluster state of foobar-server: " + err.Error())
+	}
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if resp.Goahead || !strings.Contains(resp.Message, "Reboot completion panic threshold met") {
+		t.Errorf("Expected a reboot completion panic: %+v", resp)
+	}
+	if q, found, _ := stateStore.GetQuarantine("foobar-server", stuck); !found || q.Source != quarantineSourcePanic {
+		t.Errorf("Panic did not quarantine %s: %+v", stuck, q)
+	}
+
+	// an unreadable quarantine denies restarts
+	os.WriteFile(filepath.Join(currentConfig().SaveStateDir, "foobar-server.quarantine.json"), []byte("{"), 0644)
+	if _, quarantined, err := checkQuarantine("foobar-server", fqdn); !quarantined || err == nil {
+		t.Error("Unreadable quarantine file did not fail closed")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	useTestStateDir(t, nil)
+	fqdn := "foobar-server-aa97.domain.tld"
+	started := time.Now()
+	readRecords := func(file string) []auditRecord {
+		records := []auditRecord{}
+		data, _ := os.ReadFile(file)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record auditRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("Invalid audit log line %q: %v", line, err)
+			}
+			if record.Fqdn == fqdn && !record.Timestamp.Before(started) {
+				records = append(records, record)
+			}
+		}
+		return records
+	}
+
+	req := request{Fqdn: fqdn, Uptime: "2h31m"}
+	resp := doRequest(req, "v1/request/restart/os", t)
+	req.RequestID = resp.RequestID
+	resp = doRequest(req, "v1/request/restart/os", t)
+	if !resp.Goahead {
+		t.Fatalf("Expected go_ahead for %s: %+v", fqdn, resp)
+	}
+	code, body := doAdminRequest(http.MethodDelete, "v1/clusters/foobar-server/restarting/"+fqdn, currentConfig().AdminAPITokens[0], nil, t)
+	if code != http.StatusOK {
+		t.Fatalf("Could not release %s. HTTP %d: %s", fqdn, code, string(body))
+	}
+
+	records := readRecords(auditLog.file)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 audit records for %s, but got %+v", fqdn, records)
+	}
+	if r := records[0]; r.Event != auditEventDenied || r.Decision != "request_id_handshake" || r.Cluster != "foobar-server" || r.ClientIP != "127.0.0.1" || len(r.RequestID) < 1 {
+		t.Errorf("Unexpected audit record for the request_id handshake %+v", r)
+	}
+	if r := records[1]; r.Event != auditEventGranted || r.Decision != "go_ahead" || r.State == nil || r.RequestID != resp.RequestID {
+		t.Errorf("Unexpected audit record for the go_ahead %+v", r)
+	} else if _, restarting := r.State.CurrentRestartingServers[fqdn]; !restarting {
+		t.Errorf("State snapshot of the go_ahead does not contain %s: %+v", fqdn, r.State)
+	}
+	if r := records[2]; r.Event != auditEventReleased || r.State == nil {
+		t.Errorf("Unexpected audit record for the release %+v", r)
+	} else if _, restarting := r.State.CurrentRestartingServers[fqdn]; restarting {
+		t.Errorf("State snapshot of the release still contains %s: %+v", fqdn, r.State)
+	}
+	cancelClusterCheck(fqdn)
+
+	restoreConfig(t)
+	updateConfig(func(cfg *configSettings) { cfg.AuditLogMaxBackups = 2 })
+	file := filepath.Join(currentConfig().SaveStateDir, "audit.jsonl")
+	a := &auditLogger{file: file}
+	if err := a.open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		// pretend that the audit log is full
+		a.size = int64(currentConfig().AuditLogMaxSizeMB) * 1024 * 1024
+		if err := a.write(auditRecord{Timestamp: time.Now(), Event: auditEventDenied, Fqdn: fqdn, Reason: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if records := readRecords(file); len(records) != 1 || records[0].Reason != "3" {
+		t.Errorf("Unexpected records in rotated audit log %+v", records)
+	}
+	if records := readRecords(file + ".2"); len(records) != 1 || records[0].Reason != "1" {
+		t.Errorf("Unexpected records in the oldest rotated audit log %+v", records)
+	}
+	if fileExists(file + ".3") {
+		t.Error("Rotation kept more than audit_log_max_backups rotated audit logs")
+	}
+}
+
+func TestRestartHistory(t *testing.T) {
+	completed := "foobar-server-aa20.domain.tld"
+	released := "foobar-server-aa21.domain.tld"
+	grantedAt := time.Now().Add(-10 * time.Minute)
+	cs := clusterState{LastRestartRequestTimestamp: grantedAt, CurrentOngoingRestarts: 2,
+		CurrentRestartingServers: map[string]struct{}{completed: {}, released: {}},
+		RestartGrantedTimestamps: map[string]time.Time{completed: grantedAt, released: grantedAt}}
+	useTestStateDir(t, map[string]clusterState{"foobar-server": cs})
+
+	csetting := clusterSettings["foobar-server"]
+	csetting.RebootCompletionCheckOffset = 0
+	checkCluster <- clusterCheck{csetting, completed, funcName(), "foobar-server"}
+	code, body := doAdminRequest(http.MethodDelete, "v1/clusters/foobar-server/restarting/"+released, currentConfig().AdminAPITokens[0], nil, t)
+	if code != http.StatusOK {
+		t.Fatalf("Could not release %s. HTTP %d: %s", released, code, string(body))
+	}
+	time.Sleep(2 * time.Second)
+
+	var history historyResponse
+	code, body = doAdminRequest(http.MethodGet, "v1/history?cluster=foobar-server", currentConfig().AdminAPITokens[0], nil, t)
+	if code != http.StatusOK {
+		t.Fatalf("Could not query restart history. HTTP %d: %s", code, string(body))
+	}
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Cycles) != 2 || len(history.Hosts) != 2 {
+		t.Fatalf("Expected 2 reboot cycles of 2 hosts, but got %+v", history)
+	}
+	for _, cycle := range history.Cycles {
+		if !cycle.GrantedAt.Equal(grantedAt) || len(cycle.Duration) < 1 {
+			t.Errorf("Unexpected go_ahead timestamp or duration in reboot cycle %+v", cycle)
+		}
+		switch cycle.Fqdn {
+		case completed:
+			if cycle.Outcome != rebootOutcomeCompleted || cycle.CheckAttempts < csetting.RebootCompletionCheckConsecutiveSuccesses || cycle.FirstSeenBackAt.IsZero() {
+				t.Errorf("Unexpected completed reboot cycle %+v", cycle)
+			}
+		case released:
+			if cycle.Outcome != rebootOutcomeReleased {
+				t.Errorf("Unexpected released reboot cycle %+v", cycle)
+			}
+		}
+	}
+	if h := history.Hosts[0]; h.Fqdn != completed || h.Reboots != 1 || h.LastCompletedAt.IsZero() {
+		t.Errorf("Unexpected history summary of %s %+v", completed, h)
+	}
+
+	code, body = doAdminRequest(http.MethodGet, "v1/history?fqdn="+released+"&since=1h", currentConfig().AdminAPITokens[0], nil, t)
+	history = historyResponse{}
+	if err := json.Unmarshal(body, &history); err != nil || code != http.StatusOK || len(history.Cycles) != 1 || history.Cycles[0].Fqdn != released {
+		t.Errorf("Unexpected restart history of %s. HTTP %d: %s", released, code, string(body))
+	}
+	code, body = doAdminRequest(http.MethodGet, "v1/history?cluster=foobar-server&since="+time.Now().Add(time.Hour).Format(time.RFC3339), currentConfig().AdminAPITokens[0], nil, t)
+	history = historyResponse{}
+	if err := json.Unmarshal(body, &history); err != nil || code != http.StatusOK || len(history.Cycles) != 0 {
+		t.Errorf("Expected no reboot cycles in the future. HTTP %d: %s", code, string(body))
+	}
+	if code, _ = doAdminRequest(http.MethodGet, "v1/history?cluster=nonexisting", currentConfig().AdminAPITokens[0], nil, t); code != http.StatusNotFound {
+		t.Errorf("Expected HTTP 404 for the history of an unknown cluster, but got %d", code)
+	}
+
+	restoreConfig(t)
+	updateConfig(func(cfg *configSettings) { cfg.HistoryMaxCyclesPerHost = 2 })
+	now := time.Now()
+	cycles := []rebootCycle{
+		{Fqdn: completed, CompletedAt: now.Add(-currentConfig().HistoryRetention - time.Hour)},
+		{Fqdn: completed, CompletedAt: now.Add(-3 * time.Hour)},
+		{Fqdn: completed, CompletedAt: now.Add(-2 * time.Hour)},
+		{Fqdn: released, CompletedAt: now.Add(-90 * time.Minute)},
+		{Fqdn: completed, CompletedAt: now.Add(-time.Hour)},
+	}
+	pruned := pruneHistory(cycles, now)
+	if len(pruned) != 3 || !pruned[0].CompletedAt.Equal(now.Add(-2*time.Hour)) || pruned[1].Fqdn != released || !pruned[2].CompletedAt.Equal(now.Add(-time.Hour)) {
+		t.Errorf("Unexpected pruned restart history %+v", pruned)
+	}
+}
+
+func TestCompletionChecks(t *testing.T) {
+	dir := t.TempDir()
+	fqdn := "foobar-server-aa22.domain.tld"
+	var settings map[string]clusterSetting
+	data := `
+foobar-native:
+  reboot_completion_check:
+    type: http
+    url: http://127.0.0.1/health/{:%fqdn%:}
+    expected_status: [200, 204]
+    body_regex: "^OK"
+  reboot_completion_check_interval: 1s
+foobar-exec:
+  reboot_completion_check: ./tests/always-true.sh {:%fqdn%:}
+`
+	if err := yaml.UnmarshalStrict([]byte(data), &settings); err != nil {
+		t.Fatal(err)
+	}
+	if c := settings["foobar-exec"].RebootCompletionCheck; c.checkType() != completionCheckExec || c.Command != "./tests/always-true.sh {:%fqdn%:}" {
+		t.Errorf("Shell command reboot_completion_check was not parsed as exec check %+v", c)
+	}
+	if c := settings["foobar-native"].RebootCompletionCheck; c.Type != completionCheckHTTP || len(c.ExpectedStatus) != 2 || c.parse() != nil {
+		t.Errorf("Unexpected structured reboot_completion_check %+v", c)
+	}
+	for _, invalid := range []completionCheck{{Type: "icmp", Address: "{:%fqdn%:}"}, {Type: completionCheckTCP}, {Type: completionCheckHTTP, URL: "http://{:%fqdn%:}/", BodyRegex: "("}} {
+		if err := invalid.parse(); err == nil {
+			t.Errorf("Expected invalid reboot_completion_check %+v to be rejected", invalid)
+		}
+	}
+
+	run := func(c completionCheck) (bool, string) {
+		if err := c.parse(); err != nil {
+			t.Fatal(err)
+		}
+		return c.run(newHookData(fqdn, "foobar-server", clusterSetting{}), 0, false, checkerLogger)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	if ok, result := run(completionCheck{Type: completionCheckTCP, Address: address}); !ok {
+		t.Errorf("Expected tcp check of listening %s to succeed: %s", address, result)
+	}
+	listener.Close()
+	if ok, _ := run(completionCheck{Type: completionCheckTCP, Address: address, Timeout: time.Second}); ok {
+		t.Errorf("Expected tcp check of closed %s to fail", address)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health/"+fqdn {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		fmt.Fprint(w, "OK")
+	}))
+	defer ts.Close()
+	httpCheck := completionCheck{Type: completionCheckHTTP, URL: ts.URL + "/health/{:%fqdn%:}", ExpectedStatus: []int{http.StatusNoContent}}
+	if ok, result := run(httpCheck); !ok {
+		t.Errorf("Expected http check to succeed: %s", result)
+	}
+	httpCheck.ExpectedStatus = nil
+	if ok, _ := run(httpCheck); ok {
+		t.Error("Expected http check to fail with the default expected_status 200")
+	}
+	httpCheck.URL = ts.URL + "/health/{:%cluster%:}"
+	httpCheck.ExpectedStatus = []int{http.StatusNotFound}
+	httpCheck.BodyRegex = "^OK"
+	if ok, _ := run(httpCheck); ok {
+		t.Error("Expected http check to fail if the body does not match the body_regex")
+	}
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer tlsServer.Close()
+	caFile := filepath.Join(dir, "httptest-ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tlsAddress := strings.TrimPrefix(tlsServer.URL, "https://")
+	if ok, _ := run(completionCheck{Type: completionCheckTLS, Address: tlsAddress}); ok {
+		t.Error("Expected tls check of an untrusted certificate to fail")
+	}
+	if ok, result := run(completionCheck{Type: completionCheckTLS, Address: tlsAddress, CaFile: caFile}); !ok {
+		t.Errorf("Expected tls check with ca_file to succeed: %s", result)
+	}
+	if ok, result := run(completionCheck{Type: completionCheckTLS, Address: tlsAddress, InsecureSkipVerify: true}); !ok {
+		t.Errorf("Expected tls check with insecure_skip_verify to succeed: %s", result)
+	}
+	if ok, _ := run(completionCheck{Type: completionCheckTLS, Address: tlsAddress, CaFile: caFile, MinValidity: 100 * 365 * 24 * time.Hour}); ok {
+		t.Error("Expected tls check to fail if the certificate expires within min_validity")
+	}
+	if ok, result := run(completionCheck{Type: completionCheckHTTP, URL: tlsServer.URL, CaFile: caFile, BodyRegex: "^OK$"}); !ok {
+		t.Errorf("Expected https check with ca_file to succeed: %s", result)
+	}
+}
+
+func TestExecuteCommandTimeout(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	before := time.Now()
+	er := executeCommand("goahead_action", "sh -c 'sleep 30 & echo $! > "+pidFile+"; echo started; wait'", 300*time.Millisecond, true, mainLogger.WithField("test", funcName()))
+	if took := time.Since(before); took > 5*time.Second {
+		t.Errorf("executeCommand did not return after its timeout, took %s", took)
+	}
+	if !er.timedOut || er.returnCode != execTimeoutReturnCode || !strings.Contains(er.output, "started") {
+		t.Errorf("Expected timed out result with the output so far, but got %+v", er)
+	}
+	if !strings.Contains(er.String(), "timed out after 300ms") {
+		t.Errorf("Unexpected description of timed out result %s", er.String())
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	time.Sleep(100 * time.Millisecond)
+	if stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil && !strings.Contains(string(stat), ") Z ") {
+		t.Errorf("Child process %d of the timed out command is still running: %s", pid, string(stat))
+	}
+
+	er = executeCommand("goahead_action", "head -c 100000 /dev/zero", time.Second, false, mainLogger.WithField("test", funcName()))
+	if er.timedOut || er.returnCode != 0 || len(er.output) > maxExecOutput+100 || !strings.Contains(er.output, "34464 bytes of output truncated") {
+		t.Errorf("Expected the output to be truncated to %d bytes, but got %d bytes rc %d", maxExecOutput, len(er.output), er.returnCode)
+	}
+
+	csetting := clusterSetting{NamePattern: "^foobar-timeout$", HookTimeouts: map[string]time.Duration{"goahead_action": time.Minute}}
+	if csetting.hookTimeout("goahead_action") != time.Minute || csetting.hookTimeout("completion_action") != currentConfig().HookTimeout {
+		t.Errorf("Unexpected hook timeouts %s %s", csetting.hookTimeout("goahead_action"), csetting.hookTimeout("completion_action"))
+	}
+	csetting.HookTimeouts["goahead_actions"] = time.Minute
+	csetting.RebootCompletionCheck = completionCheck{Command: "./tests/always-true.sh"}
+	csetting.RebootCompletionCheckInterval = time.Second
+	csetting.RebootCompletionCheckConsecutiveSuccesses = 1
+	if problems := validateClusterSetting(&csetting); len(problems) != 1 || !strings.Contains(problems[0], "unknown hook goahead_actions") {
+		t.Errorf("Expected unknown hook in hook_timeouts to be rejected, but got %v", problems)
+	}
+	delete(csetting.HookTimeouts, "goahead_actions")
+	csetting.RebootCompletionCheckInterval = 0
+	csetting.RebootCompletionCheckConsecutiveSuccesses = 0
+	if problems := validateClusterSetting(&csetting); strings.Join(problems, "\n") != "reboot_completion_check_interval must be set\nreboot_completion_check_consecutive_successes must be at least 1: 0" {
+		t.Errorf("Expected a missing reboot_completion_check_interval and consecutive successes to be rejected, but got %v", problems)
+	}
+}
+
+func TestHookTemplates(t *testing.T) {
+	dir := t.TempDir()
+	csetting := clusterSetting{Labels: map[string]string{"env": "prod", "rack-row": "b"}}
+	d := newHookData("foobar-server-aa23.domain.tld", "foobar-server", csetting)
+	d.Uptime = "2h31m"
+	d.RequestID = "abcdefgh"
+	d.ClientIP = "10.0.0.23"
+	d = d.withRestartingHosts(clusterState{CurrentRestartingServers: map[string]struct{}{"foobar-server-aa24.domain.tld": {}, "foobar-server-aa23.domain.tld": {}}})
+
+	templateTests := []struct {
+		template string
+		expected string
+	}{
+		{"notify {:%fqdn%:} {:%hostname%:} {:%domain%:} {:%cluster%:} {:%uptime%:}", "notify foobar-server-aa23.domain.tld foobar-server-aa23 domain.tld foobar-server 2h31m"},
+		{"notify {:%request_id%:} {:%client_ip%:} {:%label.env%:} {:%restarting_hosts%:}", "notify abcdefgh 10.0.0.23 prod foobar-server-aa23.domain.tld,foobar-server-aa24.domain.tld"},
+		{"notify {:%label.rack-row%:} {:%unknown%:} {:%label.missing%:}", "notify b {:%unknown%:} "},
+		{"docker inspect -f '{{.State.Running}}' {:%hostname%:} {{.Fqdn", "docker inspect -f '{{.State.Running}}' foobar-server-aa23 {{.Fqdn"},
+	}
+	for _, test := range templateTests {
+		if rendered, err := renderHookTemplate(test.template, d); err != nil || rendered != test.expected {
+			t.Errorf("renderHookTemplate(%s) returned %q %v, expected %q", test.template, rendered, err, test.expected)
+		}
+	}
+	if rendered, err := renderWebhookTemplate(`{"host": {{json .Hostname}}, "rack": {{json (index .Labels "rack-row")}}, "restarting": {{len .RestartingHosts}}, "cluster": "{:%cluster%:}"}`, d); err != nil ||
+		rendered != `{"host": "foobar-server-aa23", "rack": "b", "restarting": 2, "cluster": "foobar-server"}` {
+		t.Errorf("renderWebhookTemplate returned %q %v", rendered, err)
+	}
+	if _, err := renderWebhookTemplate("notify {{.Fqdn", d); err == nil {
+		t.Error("Expected invalid template to fail")
+	}
+
+	stdinFile := filepath.Join(dir, "stdin.json")
+	envFile := filepath.Join(dir, "env")
+	command, er := executeHook("goahead_action", "sh -c 'cat > "+stdinFile+"; env > "+envFile+"'", d, time.Second, false, mainLogger.WithField("test", funcName()))
+	if er.returnCode != 0 {
+		t.Fatalf("Hook %s failed: %+v", command, er)
+	}
+	var stdin hookData
+	data, _ := os.ReadFile(stdinFile)
+	if err := json.Unmarshal(data, &stdin); err != nil || stdin.Hook != "goahead_action" || stdin.Fqdn != d.Fqdn || stdin.Labels["env"] != "prod" || len(stdin.RestartingHosts) != 2 {
+		t.Errorf("Unexpected hook data on stdin %s %v", string(data), err)
+	}
+	data, _ = os.ReadFile(envFile)
+	for _, variable := range []string{"GOAHEAD_FQDN=foobar-server-aa23.domain.tld", "GOAHEAD_HOSTNAME=foobar-server-aa23", "GOAHEAD_CLUSTER=foobar-server", "GOAHEAD_CLIENT_IP=10.0.0.23", "GOAHEAD_LABEL_RACK_ROW=b", "GOAHEAD_HOOK=goahead_action"} {
+		if !strings.Contains(string(data), variable+"\n") {
+			t.Errorf("Missing environment variable %s in the environment of the hook", variable)
+		}
+	}
+
+	// the reboot completion check used to replace {:%hostname%:} and {:%cluster%:} with the FQDN
+	outFile := filepath.Join(dir, "completion_check")
+	check := completionCheck{Command: "sh -c 'echo {:%hostname%:} {:%cluster%:} > " + outFile + "'"}
+	if ok, result := check.run(d, time.Second, false, checkerLogger); !ok {
+		t.Fatalf("Expected reboot completion check to succeed: %s", result)
+	}
+	if data, _ := os.ReadFile(outFile); string(data) != "foobar-server-aa23 foobar-server\n" {
+		t.Errorf("Unexpected placeholders in reboot completion check %q", string(data))
+	}
+}
+
+func TestWebhookActions(t *testing.T) {
+	var settings map[string]clusterSetting
+	data := `
+foobar-webhook:
+  reboot_goahead_actions:
+    - ./tests/goahead_action.sh {:%fqdn%:} {:%cluster%:}
+    - type: webhook
+      url: https://chat.domain.tld/hooks/{:%cluster%:}
+      headers:
+        Authorization: Bearer secret
+      payload: '{"text": {{json .Fqdn}}}'
+      hmac_secret: s3cr3t
+      retries: 3
+`
+	if err := yaml.UnmarshalStrict([]byte(data), &settings); err != nil {
+		t.Fatal(err)
+	}
+	actions := settings["foobar-webhook"].RebootGoaheadActions
+	if len(actions) != 2 || actions[0].actionType() != hookActionExec || actions[1].actionType() != hookActionWebhook || actions[1].Retries != 3 || actions[1].validate() != nil {
+		t.Fatalf("Unexpected reboot_goahead_actions %+v", actions)
+	}
+	if marshaled, _ := json.Marshal(actions); strings.Contains(string(marshaled), "s3cr3t") || !strings.Contains(string(marshaled), `"./tests/goahead_action.sh {:%fqdn%:} {:%cluster%:}"`) {
+		t.Errorf("Unexpected JSON of reboot_goahead_actions %s", string(marshaled))
+	}
+	if err := (hookAction{Type: hookActionWebhook}).validate(); err == nil {
+		t.Error("Expected webhook without url to be rejected")
+	}
+
+	type received struct {
+		path      string
+		auth      string
+		signature string
+		body      []byte
+	}
+	requests := make(chan received, 10)
+	failures := 2
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{r.URL.Path, r.Header.Get("Authorization"), r.Header.Get(defaultWebhookSignatureHeader), body}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+		if r.URL.Path == "/denied" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	d := newHookData("foobar-server-aa25.domain.tld", "foobar-server", clusterSetting{})
+	webhook := actions[1]
+	webhook.URL = ts.URL + "/hooks/{:%cluster%:}"
+	webhook.RetryBackoff = 10 * time.Millisecond
+	csetting := clusterSetting{RebootGoaheadActions: []hookAction{webhook}}
+	started := time.Now()
+	triggerRebootGoaheadActions(d, csetting, mainLogger.WithField("test", funcName()))
+	// the job queue retries the webhook, the 3 retries give it 4 attempts instead of job_max_attempts
+	if j := waitForJobStatus(t, jobs, started, d.Fqdn, jobStatusSucceeded); len(j.Attempts) != 3 || j.MaxAttempts != 4 || j.RetryBackoff != webhook.RetryBackoff || len(requests) != 3 {
+		t.Fatalf("Expected 2 retries of the webhook job, but got %d requests and %+v", len(requests), j)
+	}
+	var r received
+	for len(requests) > 0 {
+		r = <-requests
+	}
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(r.body)
+	if r.path != "/hooks/foobar-server" || r.auth != "Bearer secret" || string(r.body) != `{"text": "foobar-server-aa25.domain.tld"}` || r.signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("Unexpected webhook request %+v", r)
+	}
+
+	// client errors are not retried and the default payload is the hook data
+	_, er := executeAction("completion_action", hookAction{Type: hookActionWebhook, URL: ts.URL + "/denied", Retries: 3}, d, time.Second, true, mainLogger.WithField("test", funcName()))
+	if er.returnCode == 0 || !er.permanent || len(requests) != 1 {
+		t.Errorf("Expected a single permanently failed webhook request, but got %+v and %d requests", er, len(requests))
+	}
+	var payload hookData
+	if r = <-requests; json.Unmarshal(r.body, &payload) != nil || payload.Hook != "completion_action" || payload.Fqdn != d.Fqdn {
+		t.Errorf("Unexpected default webhook payload %s", string(r.body))
+	}
+	d.Fqdn = "foobar-server-aa30.domain.tld"
+	triggerRebootCompletionActions(d, clusterSetting{RebootCompletionActions: []hookAction{{Type: hookActionWebhook, URL: ts.URL + "/denied", Retries: 3}}}, mainLogger.WithField("test", funcName()))
+	if j := waitForJobStatus(t, jobs, started, d.Fqdn, jobStatusDead); len(j.Attempts) != 1 {
+		t.Errorf("Expected the webhook job to be dead after a single client error, but got %+v", j)
+	}
+	<-requests
+
+	_, er = executeAction("panic_action", hookAction{Type: hookActionWebhook, URL: ts.URL + "/slow", Timeout: 100 * time.Millisecond}, d, time.Minute, true, mainLogger.WithField("test", funcName()))
+	if !er.timedOut || er.permanent {
+		t.Errorf("Expected webhook to time out after 100ms and to be retried, but got %+v", er)
+	}
+	<-requests
+
+	_, er = executeAction("goahead_action", hookAction{Type: hookActionWebhook, URL: ts.URL, Payload: `{"text": {:%fqdn%:}}`}, d, time.Second, true, mainLogger.WithField("test", funcName()))
+	if er.returnCode == 0 || len(requests) != 0 {
+		t.Errorf("Expected webhook with invalid JSON payload not to be sent, but got %+v", er)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	useTestStateDir(t, nil)
+	restoreConfig(t)
+	updateConfig(func(cfg *configSettings) { cfg.JobRetryBackoff, cfg.JobMaxAttempts = 50*time.Millisecond, 2 })
+	started := time.Now()
+
+	// a failed action is retried after the job_retry_backoff
+	flagFile := currentConfig().SaveStateDir + "/flaky"
+	os.Remove(flagFile)
+	d := newHookData("foobar-server-aa26.domain.tld", "foobar-server", clusterSetting{})
+	csetting := clusterSetting{RebootGoaheadActions: []hookAction{{Command: "sh -c 'test -f " + flagFile + " || { touch " + flagFile + "; exit 1; }'"}}}
+	triggerRebootGoaheadActions(d, csetting, mainLogger.WithField("test", funcName()))
+	j := waitForJobStatus(t, jobs, started, d.Fqdn, jobStatusSucceeded)
+	if len(j.Attempts) != 2 || j.Attempts[0].ReturnCode != 1 || j.Attempts[1].ReturnCode != 0 {
+		t.Errorf("Expected a failed and a succeeded attempt of job %s: %+v", j.ID, j.Attempts)
+	}
+
+	// an action that keeps failing ends up dead after job_max_attempts and can be retried via the admin API
+	d = newHookData("foobar-server-aa27.domain.tld", "foobar-server", clusterSetting{})
+	csetting = clusterSetting{RaiseErrors: true, RebootCompletionActions: []hookAction{{Command: "sh -c 'echo failing {:%fqdn%:}; exit 3'"}}}
+	triggerRebootCompletionActions(d, csetting, mainLogger.WithField("test", funcName()))
+	j = waitForJobStatus(t, jobs, started, d.Fqdn, jobStatusDead)
+	if len(j.Attempts) != 2 || j.Attempts[1].ReturnCode != 3 || !strings.Contains(j.Attempts[1].Output, "failing "+d.Fqdn) {
+		t.Errorf("Unexpected attempts of dead job %s: %+v", j.ID, j.Attempts)
+	}
+	code, body := doAdminRequest(http.MethodGet, "v1/jobs?status=dead&fqdn="+d.Fqdn, currentConfig().AdminAPITokens[0], nil, t)
+	var list []job
+	if err := json.Unmarshal(body, &list); code != http.StatusOK || err != nil || len(list) < 1 || list[len(list)-1].ID != j.ID {
+		t.Errorf("Unexpected list of dead jobs. HTTP %d: %s", code, string(body))
+	}
+	code, body = doAdminRequest(http.MethodGet, "v1/jobs/"+j.ID, currentConfig().AdminAPITokens[0], nil, t)
+	if code != http.StatusOK || !strings.Contains(string(body), "failing "+d.Fqdn) {
+		t.Errorf("Unexpected job %s. HTTP %d: %s", j.ID, code, string(body))
+	}
+	if code, _ = doAdminRequest(http.MethodGet, "v1/jobs/unknown", currentConfig().AdminAPITokens[0], nil, t); code != http.StatusNotFound {
+		t.Errorf("Expected HTTP 404 for an unknown job, but got %d", code)
+	}
+	if code, _ = doAdminRequest(http.MethodGet, "v1/jobs", "", nil, t); code != http.StatusUnauthorized {
+		t.Errorf("Expected HTTP 401 for the job list without a token, but got %d", code)
+	}
+	code, body = doAdminRequest(http.MethodPost, "v1/jobs/"+j.ID+"/retry", currentConfig().AdminAPITokens[0], nil, t)
+	if code != http.StatusOK {
+		t.Errorf("Could not retry dead job %s. HTTP %d: %s", j.ID, code, string(body))
+	}
+	for i := 0; i < 500; i++ {
+		if j, _ = jobs.get(j.ID); j.Status == jobStatusDead && len(j.Attempts) == 4 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if j.Status != jobStatusDead || len(j.Attempts) != 4 {
+		t.Errorf("Expected retried job %s to be dead again after 4 attempts: %+v", j.ID, j)
+	}
+	succeeded := waitForJobStatus(t, jobs, started, "foobar-server-aa26.domain.tld", jobStatusSucceeded)
+	if code, body = doAdminRequest(http.MethodPost, "v1/jobs/"+succeeded.ID+"/retry", currentConfig().AdminAPITokens[0], nil, t); code != http.StatusConflict {
+		t.Errorf("Expected HTTP 409 for the retry of succeeded job %s, but got %d: %s", succeeded.ID, code, string(body))
+	}
+	running := jobs
+	jobs = nil
+	code, body = doAdminRequest(http.MethodGet, "v1/jobs/"+succeeded.ID, currentConfig().AdminAPITokens[0], nil, t)
+	jobs = running
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected HTTP 503 without a running job queue, but got %d: %s", code, string(body))
+	}
+
+	// queued jobs survive a restart of goahead
+	dir := currentConfig().SaveStateDir + "/jobs"
+	os.RemoveAll(dir)
+	q, err := openJobQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doneFile := currentConfig().SaveStateDir + "/persisted"
+	os.Remove(doneFile)
+	q.enqueue(&job{ID: newJobID(), Hook: "goahead_action", Cluster: "foobar-server", Fqdn: "foobar-server-aa28.domain.tld", CreatedAt: time.Now(),
+		Action: hookAction{Type: hookActionWebhook, URL: "http://127.0.0.1:1/", HMACSecret: "s3cr3t"}, Timeout: time.Second, MaxAttempts: 1})
+	q.enqueue(&job{ID: newJobID(), Hook: "goahead_action", Cluster: "foobar-server", Fqdn: "foobar-server-aa29.domain.tld", CreatedAt: time.Now(),
+		Action: hookAction{Command: "touch " + doneFile}, Timeout: time.Second, MaxAttempts: 1})
+	if data, _ := os.ReadFile(q.file(q.list()[0].ID)); strings.Contains(string(data), "s3cr3t") {
+		t.Errorf("hmac_secret of webhook job was persisted: %s", string(data))
+	}
+	if list := q.list(); len(list) != 2 || list[0].Action.HMACSecret != "" {
+		t.Errorf("Unexpected jobs of the job queue: %+v", list)
+	}
+	mutex.Lock()
+	previous := clusterSettings
+	modified := clusterSettings["foobar-server"]
+	modified.RebootGoaheadActions = []hookAction{{Type: hookActionWebhook, URL: "http://127.0.0.1:1/", HMACSecret: "r0t4t3d"}}
+	setClusterSetting("foobar-server", modified)
+	mutex.Unlock()
+	t.Cleanup(func() {
+		mutex.Lock()
+		clusterSettings = previous
+		mutex.Unlock()
+	})
+	reopened, err := openJobQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, ok := actionSecret("foobar-server", reopened.list()[0].Hook, reopened.list()[0].Action); !ok || secret != "r0t4t3d" {
+		t.Errorf("Expected the hmac_secret of the reopened webhook job to be looked up in the cluster settings, but got %q", secret)
+	}
+	reopened.start(1)
+	waitForJobStatus(t, reopened, started, "foobar-server-aa29.domain.tld", jobStatusSucceeded)
+	waitForJobStatus(t, reopened, started, "foobar-server-aa28.domain.tld", jobStatusDead)
+	if !fileExists(doneFile) {
+		t.Error("Queued job was not executed after reopening the job queue")
+	}
+}
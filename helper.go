@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -24,6 +27,52 @@ import (
 type ExecResult struct {
 	returnCode int
 	output     string
+	timedOut   bool
+	timeout    time.Duration
+	// permanent failures like a webhook rejected with HTTP 4xx do not get retried
+	permanent bool
+}
+
+// execTimeoutReturnCode is the return code of commands that got killed after their timeout, like the one of timeout(1)
+const execTimeoutReturnCode = 124
+
+// maxExecOutput is the number of bytes of the output of a command that executeCommand keeps
+const maxExecOutput = 64 * 1024
+
+// String describes the result for log messages
+func (er ExecResult) String() string {
+	if er.timedOut {
+		return "timed out after " + er.timeout.String()
+	}
+	return strconv.Itoa(er.returnCode)
+}
+
+// boundedBuffer keeps the first max bytes written to it and discards the rest
+type boundedBuffer struct {
+	buf       []byte
+	max       int
+	truncated int
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if free := b.max - len(b.buf); free > 0 {
+		if len(p) > free {
+			b.buf = append(b.buf, p[:free]...)
+			b.truncated += len(p) - free
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	} else {
+		b.truncated += len(p)
+	}
+	return len(p), nil
+}
+
+func (b *boundedBuffer) String() string {
+	if b.truncated > 0 {
+		return string(b.buf) + "\n[" + strconv.Itoa(b.truncated) + " bytes of output truncated]"
+	}
+	return string(b.buf)
 }
 
 // Debugf is a helper function for debug logging if global variable debug is set to true
@@ -148,7 +197,14 @@ func purgeDir(dir string, callingFunction string) {
 	}
 }
 
-func executeCommand(command string, timeout int, allowFail bool, logger *log.Entry) ExecResult {
+// executeCommand runs the command in its own process group and kills the whole process group if it is still running after the timeout.
+// Only the first maxExecOutput bytes of its combined output are kept.
+func executeCommand(hook string, command string, timeout time.Duration, allowFail bool, logger *log.Entry) ExecResult {
+	return executeCommandWithInput(hook, command, nil, nil, timeout, allowFail, logger)
+}
+
+// executeCommandWithInput is executeCommand with the environment of the command and the data written to its stdin, a nil env inherits the environment of goahead
+func executeCommandWithInput(hook string, command string, env []string, stdin []byte, timeout time.Duration, allowFail bool, logger *log.Entry) ExecResult {
 	logger.Info("Executing " + command)
 	parts := strings.SplitN(command, " ", 2)
 	cmd := parts[0]
@@ -161,18 +217,47 @@ func executeCommand(command string, timeout int, allowFail bool, logger *log.Ent
 			cmdArgs = args
 		}
 	}
+	if timeout <= 0 {
+		timeout = currentConfig().HookTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, cmd, cmdArgs...)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		// kill the children of the command as well, they would keep its output open
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	// stop waiting for the output of children that left the process group
+	c.WaitDelay = time.Second
+	out := &boundedBuffer{max: maxExecOutput}
+	c.Stdout = out
+	c.Stderr = out
+	c.Env = env
+	if stdin != nil {
+		c.Stdin = bytes.NewReader(stdin)
+	}
 
 	before := time.Now()
-	out, err := exec.Command(cmd, cmdArgs...).CombinedOutput()
+	err := c.Run()
+	hookDurations.observe(time.Since(before), hook)
 	duration := time.Since(before).Seconds()
-	er := ExecResult{0, string(out)}
+	er := ExecResult{returnCode: 0, output: out.String(), timeout: timeout}
+	if ctx.Err() == context.DeadlineExceeded {
+		hookTimeouts.inc(hook)
+		er.returnCode = execTimeoutReturnCode
+		er.timedOut = true
+		logger.Warn("executeCommand(): command timed out after " + timeout.String() + " and got killed: " + command + "\nOutput: " + er.output)
+		return er
+	}
 	if msg, ok := err.(*exec.ExitError); ok { // there is error code
 		er.returnCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
 	}
 	logger.Debug("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 	if err != nil {
 		if !allowFail {
-			logger.Warn("executeCommand(): command failed: " + command + " " + err.Error() + "\nOutput: " + string(out))
+			logger.Warn("executeCommand(): command failed: " + command + " " + err.Error() + "\nOutput: " + er.output)
 		} else {
 			er.returnCode = 1
 			er.output = fmt.Sprint(err)
@@ -223,34 +308,69 @@ func randSeq() string {
 }
 
 func writeStructJSONFile(file string, v interface{}) error {
-	f, err := os.Create(file)
+	json, err := json.Marshal(v)
 	if err != nil {
+		Warnf("Could not encode JSON file " + file + " " + err.Error())
+		return err
+	}
+	if err := writeFileAtomic(file, json); err != nil {
 		Warnf("Could not write JSON file " + file + " " + err.Error())
 		return err
 	}
-	defer f.Close()
-	json, err := json.Marshal(v)
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory, fsyncs it and renames it to file,
+// so that a crash leaves either the previous or the new content behind, but never a truncated file
+func writeFileAtomic(file string, data []byte) error {
+	dir := filepath.Dir(file)
+	f, err := os.CreateTemp(dir, filepath.Base(file)+".tmp*")
 	if err != nil {
-		Warnf("Could not encode JSON file " + file + " " + err.Error())
 		return err
 	}
-	f.Write(json)
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
 	return nil
 }
 
-func readClusterStateFile(file string, cluster string, clusterLogger *log.Entry) clusterState {
+// readClusterStateFile reads the cluster state file and returns an error if it is unreadable or corrupt
+func readClusterStateFile(file string, cluster string, clusterLogger *log.Entry) (clusterState, error) {
 	clusterLogger.Debug("Trying to read json file: " + file)
+	var cs clusterState
 	data, err := os.ReadFile(file)
 	if err != nil {
-		clusterLogger.Warn("readStructJSONFile(): There was an error parsing the json file " + file + ": " + err.Error())
+		return cs, errors.New("could not read cluster state file " + file + ": " + err.Error())
 	}
-
-	var cs clusterState
-	err = json.Unmarshal([]byte(data), &cs)
-	if err != nil {
-		clusterLogger.Warn("In json file " + file + ": JSON unmarshal error: " + err.Error())
+	if err := json.Unmarshal(data, &cs); err != nil {
+		return clusterState{}, errors.New("corrupt cluster state file " + file + ": JSON unmarshal error: " + err.Error())
 	}
-	return cs
+	return cs, nil
 }
 
 func readAckFile(file string, res response, cluster string, clusterLogger *log.Entry) response {
@@ -276,7 +396,7 @@ func keysString(m map[string]struct{}) []string {
 }
 
 func initLogger(fileName string) *log.Entry {
-	logPath := filepath.Join(config.LogBaseDir, fileName+".log")
+	logPath := filepath.Join(currentConfig().LogBaseDir, fileName+".log")
 	log.Debug("setting up log file:" + logPath)
 	var logrusLog = log.New()
 	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	rebootOutcomeCompleted = "completed"
+	rebootOutcomeReleased  = "released"
+	rebootOutcomeExpired   = "expired"
+)
+
+// rebootCycle is a finished restart of a host from its go_ahead until its reboot completion or its release
+type rebootCycle struct {
+	Fqdn            string    `json:"fqdn"`
+	Cluster         string    `json:"cluster"`
+	GrantedAt       time.Time `json:"granted_at"`
+	FirstSeenBackAt time.Time `json:"first_seen_back_at,omitempty"`
+	CompletedAt     time.Time `json:"completed_at"`
+	Duration        string    `json:"duration"`
+	CheckAttempts   int       `json:"check_attempts"`
+	Outcome         string    `json:"outcome"`
+}
+
+// hostHistory summarizes the reboot cycles of a single host
+type hostHistory struct {
+	Fqdn              string    `json:"fqdn"`
+	Cluster           string    `json:"cluster"`
+	Reboots           int       `json:"reboots"`
+	LastCompletedAt   time.Time `json:"last_completed_at,omitempty"`
+	LastOutcome       string    `json:"last_outcome"`
+	LastRebootedSince string    `json:"last_rebooted_since,omitempty"`
+}
+
+// historyResponse is returned by the history endpoint
+type historyResponse struct {
+	Cycles []rebootCycle  `json:"cycles"`
+	Hosts  []*hostHistory `json:"hosts"`
+}
+
+// historyMutex serializes the read-modify-write of the history, so that it does not block restart requests holding the mutex
+var historyMutex sync.Mutex
+
+// recordRebootCycle appends the finished reboot cycle to the history of its cluster and applies the history_retention and history_max_cycles_per_host
+func recordRebootCycle(cycle rebootCycle) {
+	if cycle.CompletedAt.IsZero() {
+		cycle.CompletedAt = time.Now()
+	}
+	if !cycle.GrantedAt.IsZero() {
+		cycle.Duration = cycle.CompletedAt.Sub(cycle.GrantedAt).Round(time.Second).String()
+	}
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	cycles, err := stateStore.GetHistory(cycle.Cluster)
+	if err != nil {
+		stateLogger(cycle.Cluster).Error("Could not read restart history of cluster " + cycle.Cluster + " " + err.Error())
+		return
+	}
+	cycles = pruneHistory(append(cycles, cycle), cycle.CompletedAt)
+	if err := stateStore.PutHistory(cycle.Cluster, cycles); err != nil {
+		stateLogger(cycle.Cluster).Error("Could not save restart history of cluster " + cycle.Cluster + " " + err.Error())
+	}
+}
+
+// pruneHistory drops the cycles that completed before the history_retention and the oldest cycles of every host beyond history_max_cycles_per_host
+func pruneHistory(cycles []rebootCycle, now time.Time) []rebootCycle {
+	cfg := currentConfig()
+	sort.SliceStable(cycles, func(i, j int) bool { return cycles[i].CompletedAt.Before(cycles[j].CompletedAt) })
+	perHost := make(map[string]int)
+	kept := []rebootCycle{}
+	// walk from the newest to the oldest cycle to keep the newest cycles of every host
+	for i := len(cycles) - 1; i >= 0; i-- {
+		cycle := cycles[i]
+		if cfg.HistoryRetention > 0 && now.Sub(cycle.CompletedAt) > cfg.HistoryRetention {
+			continue
+		}
+		if perHost[cycle.Fqdn] >= cfg.HistoryMaxCyclesPerHost {
+			continue
+		}
+		perHost[cycle.Fqdn]++
+		kept = append(kept, cycle)
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	return kept
+}
+
+// historyHandler returns the reboot cycles that completed since the optional since parameter, filtered by the optional cluster and fqdn parameters,
+// and the last reboot of every host in these cycles
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	clusterFilter := r.URL.Query().Get("cluster")
+	fqdnFilter := r.URL.Query().Get("fqdn")
+	settings, _ := currentClusterSettings()
+	clusters := sortedClusterNames(settings)
+	if len(clusterFilter) > 0 {
+		if _, ok := settings[clusterFilter]; !ok {
+			respondWithError(w, http.StatusNotFound, "", "Unknown cluster "+clusterFilter)
+			return
+		}
+		clusters = []string{clusterFilter}
+	}
+
+	now := time.Now()
+	res := historyResponse{Cycles: []rebootCycle{}, Hosts: []*hostHistory{}}
+	hosts := make(map[string]*hostHistory)
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	for _, cluster := range clusters {
+		cycles, err := stateStore.GetHistory(cluster)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "", "Could not read restart history of cluster "+cluster+" "+err.Error())
+			return
+		}
+		for _, cycle := range cycles {
+			if (len(fqdnFilter) > 0 && cycle.Fqdn != fqdnFilter) || cycle.CompletedAt.Before(since) {
+				continue
+			}
+			res.Cycles = append(res.Cycles, cycle)
+			h, ok := hosts[cluster+"/"+cycle.Fqdn]
+			if !ok {
+				h = &hostHistory{Fqdn: cycle.Fqdn, Cluster: cluster}
+				hosts[cluster+"/"+cycle.Fqdn] = h
+				res.Hosts = append(res.Hosts, h)
+			}
+			h.Reboots++
+			h.LastOutcome = cycle.Outcome
+			if cycle.Outcome == rebootOutcomeCompleted && cycle.CompletedAt.After(h.LastCompletedAt) {
+				h.LastCompletedAt = cycle.CompletedAt
+				h.LastRebootedSince = now.Sub(cycle.CompletedAt).Round(time.Second).String()
+			}
+		}
+	}
+	sort.SliceStable(res.Cycles, func(i, j int) bool { return res.Cycles[i].CompletedAt.Before(res.Cycles[j].CompletedAt) })
+	sort.Slice(res.Hosts, func(i, j int) bool {
+		if res.Hosts[i].Cluster != res.Hosts[j].Cluster {
+			return res.Hosts[i].Cluster < res.Hosts[j].Cluster
+		}
+		return res.Hosts[i].Fqdn < res.Hosts[j].Fqdn
+	})
+	respondWithJSON(w, http.StatusOK, "", res)
+}
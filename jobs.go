@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	jobStatusQueued    = "queued"
+	jobStatusRunning   = "running"
+	jobStatusRetrying  = "retrying"
+	jobStatusSucceeded = "succeeded"
+	jobStatusDead      = "dead"
+)
+
+// job is a single action of reboot_goahead_actions, reboot_completion_actions or reboot_completion_panic_actions that the worker pool executes
+type job struct {
+	ID            string        `json:"id"`
+	Hook          string        `json:"hook"`
+	Cluster       string        `json:"cluster"`
+	Fqdn          string        `json:"fqdn"`
+	Action        hookAction    `json:"action"`
+	Data          hookData      `json:"data"`
+	Timeout       time.Duration `json:"timeout"`
+	AllowFail     bool          `json:"allow_fail"`
+	Status        string        `json:"status"`
+	MaxAttempts   int           `json:"max_attempts"`
+	RetryBackoff  time.Duration `json:"retry_backoff"`
+	Attempts      []jobAttempt  `json:"attempts"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+	NextAttemptAt time.Time     `json:"next_attempt_at,omitempty"`
+}
+
+// jobAttempt is the result of a single execution of a job
+type jobAttempt struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Command    string    `json:"command"`
+	ReturnCode int       `json:"return_code"`
+	TimedOut   bool      `json:"timed_out"`
+	Output     string    `json:"output"`
+}
+
+// jobQueue persists every job as <save_state_dir>/jobs/<id>.json, so that queued jobs survive a restart of goahead
+type jobQueue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	dir     string
+	jobs    map[string]*job
+	pending []string
+	running int
+}
+
+var jobs *jobQueue
+
+// openJobQueue loads the jobs of the directory and queues the unfinished ones again.
+// Jobs that were running when goahead stopped get executed again.
+func openJobQueue(dir string) (*jobQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New("could not create job queue directory " + dir + ": " + err.Error())
+	}
+	q := &jobQueue{dir: dir, jobs: make(map[string]*job)}
+	q.cond = sync.NewCond(&q.Mutex)
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.New("could not read job file " + file + ": " + err.Error())
+		}
+		var j job
+		if err := json.Unmarshal(data, &j); err != nil {
+			mainLogger.Error("Ignoring corrupt job file " + file + ": JSON unmarshal error: " + err.Error())
+			continue
+		}
+		q.jobs[j.ID] = &j
+		switch j.Status {
+		case jobStatusQueued, jobStatusRunning:
+			j.Status = jobStatusQueued
+			q.pending = append(q.pending, j.ID)
+		case jobStatusRetrying:
+			q.retryAt(j.ID, j.NextAttemptAt)
+		}
+	}
+	q.prune(time.Now())
+	return q, nil
+}
+
+// start runs the worker pool
+func (q *jobQueue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+}
+
+func (q *jobQueue) file(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// save persists the job, the caller has to hold the lock of the queue
+func (q *jobQueue) save(j *job) {
+	j.UpdatedAt = time.Now()
+	if err := writeStructJSONFile(q.file(j.ID), j); err != nil {
+		stateLogger(j.Cluster).Error("Could not save job " + j.ID + " " + err.Error())
+	}
+}
+
+// enqueue persists the job and hands it to the worker pool
+func (q *jobQueue) enqueue(j *job) {
+	q.Lock()
+	defer q.Unlock()
+	q.push(j)
+}
+
+// push persists the job as queued and hands it to the worker pool, the caller has to hold the lock of the queue
+func (q *jobQueue) push(j *job) {
+	j.Status = jobStatusQueued
+	q.jobs[j.ID] = j
+	q.save(j)
+	q.pending = append(q.pending, j.ID)
+	q.cond.Signal()
+}
+
+// retryAt queues the job again at the given time
+func (q *jobQueue) retryAt(id string, at time.Time) {
+	time.AfterFunc(time.Until(at), func() {
+		q.Lock()
+		defer q.Unlock()
+		if j, ok := q.jobs[id]; ok && j.Status == jobStatusRetrying {
+			q.push(j)
+		}
+	})
+}
+
+func (q *jobQueue) worker() {
+	for {
+		q.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		j := q.jobs[q.pending[0]]
+		q.pending = q.pending[1:]
+		j.Status = jobStatusRunning
+		q.running++
+		q.save(j)
+		run := *j
+		q.Unlock()
+		if secret, ok := actionSecret(run.Cluster, run.Hook, run.Action); ok {
+			run.Action.HMACSecret = secret
+		}
+
+		logger := stateLogger(run.Cluster).WithFields(logrus.Fields{"job": run.ID, "fqdn": run.Fqdn})
+		attempt := jobAttempt{StartedAt: time.Now()}
+		command, er := executeAction(run.Hook, run.Action, run.Data, run.Timeout, run.AllowFail, logger)
+		attempt.FinishedAt = time.Now()
+		attempt.Command = command
+		attempt.ReturnCode = er.returnCode
+		attempt.TimedOut = er.timedOut
+		attempt.Output = er.output
+
+		q.Lock()
+		q.running--
+		j.Attempts = append(j.Attempts, attempt)
+		switch {
+		case er.returnCode == 0 && !er.timedOut:
+			j.Status = jobStatusSucceeded
+			logger.Info(strings.Replace(run.Hook, "_", " ", -1) + " job " + j.ID + " of " + command + " succeeded")
+		case er.permanent:
+			j.Status = jobStatusDead
+			logger.Error(strings.Replace(run.Hook, "_", " ", -1) + " job " + j.ID + " of " + command + " failed with " + er.String() + " which is not retried, giving up")
+		case len(j.Attempts) < j.MaxAttempts:
+			// wait the retry backoff after the first failed attempt and twice as long after every further one
+			backoff := j.RetryBackoff
+			if backoff <= 0 {
+				backoff = currentConfig().JobRetryBackoff
+			}
+			backoff <<= len(j.Attempts) - 1
+			j.Status = jobStatusRetrying
+			j.NextAttemptAt = time.Now().Add(backoff)
+			logger.Warn(strings.Replace(run.Hook, "_", " ", -1) + " job " + j.ID + " of " + command + " failed with " + er.String() + " Retrying in " + backoff.String())
+			q.retryAt(j.ID, j.NextAttemptAt)
+		default:
+			j.Status = jobStatusDead
+			logger.Error(strings.Replace(run.Hook, "_", " ", -1) + " job " + j.ID + " of " + command + " failed with " + er.String() + " after " + strconv.Itoa(len(j.Attempts)) + " attempts, giving up")
+		}
+		q.save(j)
+		q.prune(time.Now())
+		q.cond.Broadcast()
+		q.Unlock()
+	}
+}
+
+// prune removes the succeeded and dead jobs that finished before the job_retention, the caller has to hold the lock of the queue
+func (q *jobQueue) prune(now time.Time) {
+	for id, j := range q.jobs {
+		if (j.Status == jobStatusSucceeded || j.Status == jobStatusDead) && now.Sub(j.UpdatedAt) > currentConfig().JobRetention {
+			if err := os.Remove(q.file(id)); err != nil && !os.IsNotExist(err) {
+				mainLogger.Error("Could not remove job file " + q.file(id) + " " + err.Error())
+				continue
+			}
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// idle returns if no job is queued or running
+func (q *jobQueue) idle() bool {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.pending) == 0 && q.running == 0
+}
+
+// get returns a copy of the job without the hmac_secret of its action
+func (q *jobQueue) get(id string) (job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return j.copy(), true
+}
+
+// copy returns a copy of the job without the hmac_secret of its action, the caller has to hold the lock of the queue
+func (j *job) copy() job {
+	c := *j
+	c.Action.HMACSecret = ""
+	c.Attempts = append([]jobAttempt{}, j.Attempts...)
+	return c
+}
+
+// list returns copies of all jobs ordered by their creation
+func (q *jobQueue) list() []job {
+	q.Lock()
+	ids := make([]string, 0, len(q.jobs))
+	for id := range q.jobs {
+		ids = append(ids, id)
+	}
+	q.Unlock()
+	sort.Strings(ids)
+	list := []job{}
+	for _, id := range ids {
+		if j, ok := q.get(id); ok {
+			list = append(list, j)
+		}
+	}
+	return list
+}
+
+// retry queues a dead job again with a fresh number of attempts
+func (q *jobQueue) retry(id string) (job, error) {
+	q.Lock()
+	j, ok := q.jobs[id]
+	if !ok {
+		q.Unlock()
+		return job{}, errors.New("Unknown job " + id)
+	}
+	if j.Status != jobStatusDead {
+		q.Unlock()
+		return job{}, errors.New("Job " + id + " is " + j.Status + ", only dead jobs can be retried")
+	}
+	attempts, _ := retryPolicy(j.Action)
+	j.MaxAttempts = len(j.Attempts) + attempts
+	q.push(j)
+	c := j.copy()
+	q.Unlock()
+	return c, nil
+}
+
+// actionSecret returns the hmac_secret of the webhook action from the current cluster settings.
+// The hmac_secret is not persisted with the job, so that it does not end up in plain text in the job files.
+func actionSecret(cluster string, hook string, a hookAction) (string, bool) {
+	if a.actionType() != hookActionWebhook {
+		return "", false
+	}
+	settings, _ := currentClusterSettings()
+	for _, configured := range settings[cluster].hookActions(hook) {
+		if configured.actionType() == hookActionWebhook && configured.URL == a.URL && configured.Method == a.Method && configured.Payload == a.Payload {
+			return configured.HMACSecret, true
+		}
+	}
+	return "", false
+}
+
+// retryPolicy returns the number of attempts and the retry backoff of the jobs of the action.
+// The retries and retry_backoff of a webhook take precedence over job_max_attempts and job_retry_backoff.
+func retryPolicy(a hookAction) (int, time.Duration) {
+	cfg := currentConfig()
+	attempts, backoff := cfg.JobMaxAttempts, cfg.JobRetryBackoff
+	if a.actionType() == hookActionWebhook && a.Retries > 0 {
+		attempts, backoff = a.Retries+1, time.Second
+	}
+	if a.actionType() == hookActionWebhook && a.RetryBackoff > 0 {
+		backoff = a.RetryBackoff
+	}
+	return attempts, backoff
+}
+
+// newJobID returns IDs that sort by their creation time
+func newJobID() string {
+	return time.Now().UTC().Format("20060102T150405.000000000") + "-" + randSeq()
+}
+
+// enqueueActions queues every action as its own job, so that a failing action neither blocks nor prevents the other actions.
+// Without a job queue the actions get executed right away.
+func enqueueActions(hook string, actions []hookAction, d hookData, csetting clusterSetting, clusterLogger *logrus.Entry) {
+	for _, action := range actions {
+		timeout := csetting.hookTimeout(hook)
+		if action.Timeout > 0 {
+			timeout = action.Timeout
+		}
+		if jobs == nil {
+			command, er := executeAction(hook, action, d, timeout, !csetting.RaiseErrors, clusterLogger)
+			clusterLogger.Info(strings.Replace(hook, "_", " ", -1) + " result of " + command + " is " + er.String())
+			continue
+		}
+		attempts, backoff := retryPolicy(action)
+		j := &job{ID: newJobID(), Hook: hook, Cluster: d.Cluster, Fqdn: d.Fqdn, Action: action, Data: d, Timeout: timeout,
+			AllowFail: !csetting.RaiseErrors, MaxAttempts: attempts, RetryBackoff: backoff, Attempts: []jobAttempt{}, CreatedAt: time.Now()}
+		jobs.enqueue(j)
+		clusterLogger.Info("Queued " + strings.Replace(hook, "_", " ", -1) + " job " + j.ID + " of " + action.String())
+	}
+}
+
+// listJobsHandler lists the jobs, optionally filtered by the status, cluster and fqdn parameters
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	cluster := r.URL.Query().Get("cluster")
+	fqdn := r.URL.Query().Get("fqdn")
+	if jobs == nil {
+		respondWithError(w, http.StatusServiceUnavailable, "", "The job queue is not running")
+		return
+	}
+	list := []job{}
+	for _, j := range jobs.list() {
+		if (len(status) > 0 && j.Status != status) || (len(cluster) > 0 && j.Cluster != cluster) || (len(fqdn) > 0 && j.Fqdn != fqdn) {
+			continue
+		}
+		list = append(list, j)
+	}
+	respondWithJSON(w, http.StatusOK, "", list)
+}
+
+// getJobHandler returns a single job with the output of all its attempts
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if jobs == nil {
+		respondWithError(w, http.StatusServiceUnavailable, "", "The job queue is not running")
+		return
+	}
+	j, ok := jobs.get(id)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "", "Unknown job "+id)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, "", j)
+}
+
+// retryJobHandler queues a dead job again
+func retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if jobs == nil {
+		respondWithError(w, http.StatusServiceUnavailable, "", "The job queue is not running")
+		return
+	}
+	if _, ok := jobs.get(id); !ok {
+		respondWithError(w, http.StatusNotFound, "", "Unknown job "+id)
+		return
+	}
+	j, err := jobs.retry(id)
+	if err != nil {
+		respondWithError(w, http.StatusConflict, "", err.Error())
+		return
+	}
+	mainLogger.Info("Retrying dead job " + id + " via admin API by " + adminIdentity(r))
+	respondWithJSON(w, http.StatusOK, "", j)
+}
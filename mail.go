@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPanicMailTemplate is used for reboot_completion_panic_actions mails if no panic_mail_template is configured
+const defaultPanicMailTemplate = `{{if eq .Kind "max_duration"}}{{.Reason}}{{else}}The reboot completion panic threshold of {{.Threshold}} was met for goahead cluster {{.Cluster}}.{{end}}
+
+The following hosts received the go_ahead to restart, but were not flagged as successfully rebooted yet:
+{{range .StuckHosts}}  - {{.}}
+{{end}}
+Last restart request: {{.LastRestartRequest.Format "2006-01-02 15:04:05 MST"}} ({{.SinceLastRestartRequest}} ago)
+{{if eq .Kind "max_duration"}}Expired host: {{.Fqdn}}{{else}}Triggered by restart request from: {{.Fqdn}}{{end}}
+`
+
+// panicMailData contains the fields that can be used inside the panic mail template
+type panicMailData struct {
+	Cluster                 string
+	Fqdn                    string
+	Kind                    string
+	Reason                  string
+	StuckHosts              []string
+	Threshold               time.Duration
+	LastRestartRequest      time.Time
+	SinceLastRestartRequest time.Duration
+}
+
+// sendPanicMail notifies the reboot_completion_panic_actions mail recipients of the given cluster about the hosts that are still restarting
+func sendPanicMail(fqdn string, cluster string, kind string, reason string, cs clusterState, csetting clusterSetting, clusterLogger *logrus.Entry) error {
+	recipients := csetting.RebootCompletionPanicActions.Mail
+	if len(recipients) == 0 {
+		return nil
+	}
+	stuckHosts := keysString(cs.CurrentRestartingServers)
+	sort.Strings(stuckHosts)
+	data := panicMailData{
+		Cluster:                 cluster,
+		Fqdn:                    fqdn,
+		Kind:                    kind,
+		Reason:                  reason,
+		StuckHosts:              stuckHosts,
+		Threshold:               csetting.RebootCompletionPanicThreshold,
+		LastRestartRequest:      cs.LastRestartRequestTimestamp,
+		SinceLastRestartRequest: time.Since(cs.LastRestartRequestTimestamp).Round(time.Second),
+	}
+
+	body, err := renderPanicMail(data)
+	if err != nil {
+		clusterLogger.Error("Could not render panic mail for cluster " + cluster + " " + err.Error())
+		return err
+	}
+	subject := "goahead: reboot completion panic in cluster " + cluster + " for " + strings.Join(stuckHosts, ",")
+	if kind == panicKindMaxDuration {
+		subject = "goahead: reboot_completion_max_duration expired in cluster " + cluster + " for " + fqdn
+	}
+	clusterLogger.Info("Sending reboot completion panic mail for cluster " + cluster + " to " + strings.Join(recipients, ","))
+	if err := sendMail(recipients, subject, body); err != nil {
+		clusterLogger.Error("Could not send reboot completion panic mail for cluster " + cluster + " via " + currentConfig().SMTPServer + ":" + strconv.Itoa(currentConfig().SMTPPort) + " " + err.Error())
+		return err
+	}
+	return nil
+}
+
+// renderPanicMail renders the configured panic_mail_template or the default template with the given data
+func renderPanicMail(data panicMailData) (string, error) {
+	cfg := currentConfig()
+	text := defaultPanicMailTemplate
+	if len(cfg.PanicMailTemplate) > 0 {
+		content, err := os.ReadFile(cfg.PanicMailTemplate)
+		if err != nil {
+			return "", err
+		}
+		text = string(content)
+	}
+	tmpl, err := template.New("panic_mail").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// sendMail delivers a plain text mail to the given recipients using the configured smtp_* settings
+func sendMail(recipients []string, subject string, body string) error {
+	cfg := currentConfig()
+	addr := net.JoinHostPort(cfg.SMTPServer, strconv.Itoa(cfg.SMTPPort))
+	tlsConfig := &tls.Config{ServerName: cfg.SMTPServer, InsecureSkipVerify: cfg.SMTPInsecureSkipVerify}
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+
+	var conn net.Conn
+	var err error
+	if cfg.SMTPTLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(4 * cfg.Timeout))
+
+	c, err := smtp.NewClient(conn, cfg.SMTPServer)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if cfg.SMTPTLS == "" || cfg.SMTPTLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if cfg.SMTPTLS == "starttls" {
+			return errors.New("smtp_tls is set to starttls, but SMTP server " + addr + " does not support STARTTLS")
+		}
+	}
+
+	if len(cfg.SMTPUsername) > 0 {
+		if err := c.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPServer)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(cfg.SMTPFrom); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	msg := "From: " + cfg.SMTPFrom + "\r\n" +
+		"To: " + strings.Join(recipients, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + strings.Replace(body, "\n", "\r\n", -1)
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is a weekly recurring time range in which the hosts of a cluster may restart
+type maintenanceWindow struct {
+	Weekdays []string `yaml:"weekdays" json:"weekdays"`
+	Start    string   `yaml:"start" json:"start"`
+	End      string   `yaml:"end" json:"end"`
+	Timezone string   `yaml:"timezone" json:"timezone"`
+	weekdays map[time.Weekday]bool
+	start    int
+	end      int
+	location *time.Location
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// parse validates the maintenance window settings and fills the parsed weekdays, start and end minutes and location
+func (mw *maintenanceWindow) parse() error {
+	mw.weekdays = make(map[time.Weekday]bool)
+	if len(mw.Weekdays) == 0 {
+		for _, wd := range weekdayNames {
+			mw.weekdays[wd] = true
+		}
+	}
+	for _, day := range mw.Weekdays {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if from, to, isRange := strings.Cut(day, "-"); isRange {
+			fromDay, ok1 := weekdayNames[from]
+			toDay, ok2 := weekdayNames[to]
+			if !ok1 || !ok2 {
+				return errors.New("invalid weekday range " + day + " in maintenance window, use e.g. mon-fri")
+			}
+			for wd := fromDay; ; wd = (wd + 1) % 7 {
+				mw.weekdays[wd] = true
+				if wd == toDay {
+					break
+				}
+			}
+			continue
+		}
+		wd, ok := weekdayNames[day]
+		if !ok {
+			return errors.New("invalid weekday " + day + " in maintenance window, use e.g. mon or monday")
+		}
+		mw.weekdays[wd] = true
+	}
+
+	var err error
+	if mw.start, err = parseTimeOfDay(mw.Start); err != nil {
+		return err
+	}
+	if mw.end, err = parseTimeOfDay(mw.End); err != nil {
+		return err
+	}
+	if mw.location, err = time.LoadLocation(mw.Timezone); err != nil {
+		return errors.New("invalid timezone " + mw.Timezone + " in maintenance window: " + err.Error())
+	}
+	return nil
+}
+
+// parseTimeOfDay converts a HH:MM time of day into minutes since midnight
+func parseTimeOfDay(s string) (int, error) {
+	hours, minutes, found := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !found || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, errors.New("invalid time of day '" + s + "' in maintenance window, use HH:MM between 00:00 and 24:00")
+	}
+	return h*60 + m, nil
+}
+
+// occurrence returns the start and end of the maintenance window on the given number of days relative to the day of t
+func (mw maintenanceWindow) occurrence(t time.Time, days int) (time.Time, time.Time) {
+	local := t.In(mw.location)
+	start := time.Date(local.Year(), local.Month(), local.Day()+days, 0, mw.start, 0, 0, mw.location)
+	endDays := days
+	if mw.end <= mw.start {
+		// the window ends on the next day, e.g. 22:00 - 04:00
+		endDays++
+	}
+	end := time.Date(local.Year(), local.Month(), local.Day()+endDays, 0, mw.end, 0, 0, mw.location)
+	return start, end
+}
+
+// checkMaintenanceWindows returns if one of the given maintenance windows is open at t.
+// If none is open, it also returns the time when the next maintenance window opens.
+func checkMaintenanceWindows(windows []maintenanceWindow, t time.Time) (bool, time.Time) {
+	if len(windows) == 0 {
+		return true, t
+	}
+	var next time.Time
+	for _, mw := range windows {
+		// start one day earlier to find windows that started yesterday and are still open
+		for days := -1; days <= 7; days++ {
+			start, end := mw.occurrence(t, days)
+			if !mw.weekdays[start.Weekday()] {
+				continue
+			}
+			if !t.Before(start) && t.Before(end) {
+				return true, t
+			}
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+	return false, next
+}
+
+// askAgainIn formats the duration until the given time as ask_again_in value for the client
+func askAgainIn(until time.Time) string {
+	return strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))) + "s"
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clusterMatch is the result of matching a FQDN against the name patterns of all enabled clusters
+type clusterMatch struct {
+	// Cluster is the cluster with the highest priority whose name_pattern matches and whose blacklist_name_pattern does not
+	Cluster string
+	// NameMatches are all clusters whose name_pattern matches in the order of their priority
+	NameMatches []string
+	// Blacklisted are the clusters whose name_pattern and blacklist_name_pattern match with the matching blacklist_name_pattern
+	Blacklisted map[string]string
+}
+
+// matchExplanation explains which cluster a FQDN belongs to and which decision goahead would make for a restart request
+type matchExplanation struct {
+	Fqdn               string            `json:"fqdn"`
+	Cluster            string            `json:"cluster"`
+	MatchingClusters   []string          `json:"matching_clusters"`
+	BlacklistPatterns  map[string]string `json:"blacklist_patterns,omitempty"`
+	Decision           string            `json:"decision"`
+	Reason             string            `json:"reason"`
+	ClusterStateTested bool              `json:"cluster_state_tested"`
+}
+
+// matchRequest is the payload of a dry-run match request
+type matchRequest struct {
+	Fqdns  []string `json:"fqdns"`
+	Uptime string   `json:"uptime"`
+}
+
+// compilePatterns compiles the name_pattern and the blacklist_name_pattern once, so that restart requests do not have to
+func (csetting *clusterSetting) compilePatterns() []string {
+	problems := []string{}
+	csetting.nameRegex = nil
+	csetting.blacklistRegexes = nil
+	if len(csetting.NamePattern) < 1 {
+		problems = append(problems, "missing name_pattern")
+	} else if re, err := regexp.Compile(csetting.NamePattern); err != nil {
+		problems = append(problems, "invalid name_pattern "+csetting.NamePattern+": "+err.Error())
+	} else {
+		csetting.nameRegex = re
+	}
+	for _, pattern := range csetting.BlacklistNamePattern {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			problems = append(problems, "invalid blacklist_name_pattern "+pattern+": "+err.Error())
+			continue
+		}
+		csetting.blacklistRegexes = append(csetting.blacklistRegexes, re)
+	}
+	return problems
+}
+
+// matchesName returns if the FQDN matches the compiled name_pattern of the cluster.
+// Cluster settings that were not compiled by compilePatterns never match.
+func (csetting clusterSetting) matchesName(fqdn string) bool {
+	return csetting.nameRegex != nil && csetting.nameRegex.MatchString(fqdn)
+}
+
+// blacklistedBy returns the first compiled blacklist_name_pattern of the cluster that matches the FQDN
+func (csetting clusterSetting) blacklistedBy(fqdn string) string {
+	for _, blacklistRegex := range csetting.blacklistRegexes {
+		if blacklistRegex.MatchString(fqdn) {
+			return blacklistRegex.String()
+		}
+	}
+	return ""
+}
+
+// clusterNamesByPriority returns the cluster names ordered by descending priority and by name for equal priorities
+func clusterNamesByPriority(settings map[string]clusterSetting) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if settings[names[i]].Priority != settings[names[j]].Priority {
+			return settings[names[i]].Priority > settings[names[j]].Priority
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// matchCluster matches the FQDN against all enabled clusters in the order of their priority
+func matchCluster(fqdn string, settings map[string]clusterSetting) clusterMatch {
+	m := clusterMatch{NameMatches: []string{}, Blacklisted: make(map[string]string)}
+	for _, c := range clusterNamesByPriority(settings) {
+		csetting := settings[c]
+		if !csetting.Enabled || !csetting.matchesName(fqdn) {
+			continue
+		}
+		m.NameMatches = append(m.NameMatches, c)
+		if blacklistRegex := csetting.blacklistedBy(fqdn); len(blacklistRegex) > 0 {
+			m.Blacklisted[c] = blacklistRegex
+		} else if len(m.Cluster) < 1 {
+			m.Cluster = c
+		}
+	}
+	return m
+}
+
+// findClusterOverlaps matches every sample host against all clusters.
+// It returns a warning for every host that matches multiple clusters with different priorities
+// and an error for hosts that match multiple clusters with the same highest priority.
+func findClusterOverlaps(settings map[string]clusterSetting, hosts []string) ([]string, error) {
+	warnings := []string{}
+	problems := []string{}
+	for _, fqdn := range hosts {
+		m := matchCluster(fqdn, settings)
+		candidates := []string{}
+		for _, c := range m.NameMatches {
+			if _, blacklisted := m.Blacklisted[c]; !blacklisted {
+				candidates = append(candidates, c)
+			}
+		}
+		if len(candidates) < 2 {
+			continue
+		}
+		described := make([]string, 0, len(candidates))
+		for _, c := range candidates {
+			described = append(described, c+" (priority "+strconv.Itoa(settings[c].Priority)+")")
+		}
+		overlap := "sample host " + fqdn + " matches clusters " + strings.Join(described, ", ")
+		if settings[candidates[0]].Priority == settings[candidates[1]].Priority {
+			problems = append(problems, overlap+" with the same priority")
+		} else {
+			warnings = append(warnings, overlap+" Using cluster "+m.Cluster)
+		}
+	}
+	if len(problems) > 0 {
+		return warnings, errors.New(strings.Join(problems, ", "))
+	}
+	return warnings, nil
+}
+
+// readSampleHostsFile reads the FQDNs of the sample_hosts_file with one FQDN per line
+func readSampleHostsFile(file string) ([]string, error) {
+	if len(file) < 1 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("could not read sample_hosts_file " + file + ": " + err.Error())
+	}
+	hosts := make(map[string]struct{})
+	addMemberLines(hosts, string(data))
+	fqdns := keysString(hosts)
+	sort.Strings(fqdns)
+	return fqdns, nil
+}
+
+// checkClusterOverlaps logs the priority resolved overlaps of the sample_hosts_file and returns an error for ambiguous overlaps
+func checkClusterOverlaps(cfg configSettings, settings map[string]clusterSetting) error {
+	hosts, err := readSampleHostsFile(cfg.SampleHostsFile)
+	if err != nil {
+		return err
+	}
+	warnings, err := findClusterOverlaps(settings, hosts)
+	for _, warning := range warnings {
+		mainLogger.Warn("Overlapping name patterns: " + warning)
+	}
+	if err != nil {
+		return errors.New("Ambiguous name patterns, set a different priority for these clusters: " + err.Error())
+	}
+	return nil
+}
+
+// explainMatch explains which cluster the FQDN matches and which decision a restart request with the given uptime would get without modifying any state.
+// The request_id handshake and the primary_check are not evaluated. The cluster state is only evaluated if withState is set.
+func explainMatch(fqdn string, uptime string, settings map[string]clusterSetting, withState bool) matchExplanation {
+	m := matchCluster(fqdn, settings)
+	e := matchExplanation{Fqdn: fqdn, Cluster: m.Cluster, MatchingClusters: m.NameMatches}
+	if len(m.Blacklisted) > 0 {
+		e.BlacklistPatterns = m.Blacklisted
+	}
+	if len(m.Cluster) < 1 {
+		if len(m.Blacklisted) > 0 {
+			e.Decision = "blacklisted"
+			e.Reason = "FQDN " + fqdn + " is blacklisted in every matching cluster"
+		} else {
+			e.Decision = "unknown_host"
+			e.Reason = "FQDN " + fqdn + " did not match any known cluster"
+		}
+		return e
+	}
+	c := m.Cluster
+	csetting := settings[c]
+	now := time.Now()
+	if len(uptime) > 0 {
+		d, err := time.ParseDuration(uptime)
+		if err != nil {
+			e.Decision = "error"
+			e.Reason = "Can not convert value " + uptime + " of your uptime to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m."
+			return e
+		}
+		if d < csetting.MinimumUptime {
+			e.Decision = "denied_min_uptime"
+			e.Reason = "Configured minimum uptime for cluster: " + csetting.MinimumUptime.String() + " was not reached by uptime: " + uptime
+			return e
+		}
+	}
+	if reason, _, frozen := checkFreeze(c, now); frozen {
+		e.Decision = "denied_freeze"
+		e.Reason = "Denied restart request during change freeze of cluster " + c + " because of " + reason
+		return e
+	}
+	if open, next := checkMaintenanceWindows(csetting.MaintenanceWindows, now); !open {
+		e.Decision = "denied_maintenance_window"
+		e.Reason = "Denied restart request outside of the maintenance windows of cluster " + c + " Next maintenance window opens at " + next.Format(time.RFC3339)
+		return e
+	}
+	if !withState {
+		e.Decision = "go_ahead"
+		e.Reason = "Restart allowed by the cluster settings, the cluster state was not evaluated"
+		return e
+	}
+
+	e.ClusterStateTested = true
+	var members []string
+	if csetting.Members.configured() {
+		var err error
+		if members, err = resolveClusterMembers(c, csetting, stateLogger(c)); err != nil {
+			e.Decision = "error"
+			e.Reason = "Could not resolve the members of cluster " + c + " " + err.Error()
+			return e
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	saved, _, err := stateStore.GetClusterState(c)
+	if err != nil {
+		e.Decision = "error"
+		e.Reason = "Could not read cluster state of cluster " + c + " " + err.Error()
+		return e
+	}
+	// decide on a copy, so that the saved cluster state stays untouched
+	var cs clusterState
+	data, _ := json.Marshal(saved)
+	json.Unmarshal(data, &cs)
+	if cs.CurrentRestartingServers == nil {
+		cs.CurrentRestartingServers = make(map[string]struct{})
+	}
+	var result rebootCheckResult
+	if err := decideClusterState(c, fqdn, csetting, settings, members, &cs, &result, stateLogger(c)); err != nil && err != errKeepClusterState {
+		e.Decision = "error"
+		e.Reason = err.Error()
+		return e
+	}
+	e.Reason = result.Reason
+	switch {
+	case result.RebootPanicThresholdEnabled:
+		e.Decision = "panic"
+	case result.ClusterGoAhead:
+		e.Decision = "go_ahead"
+	case len(result.Decision) > 0:
+		e.Decision = result.Decision
+	default:
+		e.Decision = "denied"
+	}
+	if csetting.ClusterType == clusterTypeActivePassive && e.Decision == "go_ahead" {
+		e.Reason = strings.TrimSpace(e.Reason + " The primary_check of the active/passive cluster was not evaluated")
+	}
+	return e
+}
+
+// matchHandler explains the cluster match and the restart decision for the given FQDNs without modifying any state
+func matchHandler(w http.ResponseWriter, r *http.Request) {
+	var mr matchRequest
+	if err := json.NewDecoder(r.Body).Decode(&mr); err != nil || len(mr.Fqdns) == 0 {
+		respondWithError(w, http.StatusBadRequest, "", "Invalid request payload. Need at least the fqdns field!")
+		return
+	}
+	defer r.Body.Close()
+	settings, _ := currentClusterSettings()
+	explanations := []matchExplanation{}
+	for _, fqdn := range mr.Fqdns {
+		explanations = append(explanations, explainMatch(fqdn, mr.Uptime, settings, true))
+	}
+	respondWithJSON(w, http.StatusOK, "", explanations)
+}
+
+// runMatch explains the cluster match and the restart decision for the given comma separated FQDNs on the command line.
+// It does not open the state store, so the cluster state is not evaluated.
+func runMatch(fqdns string, uptime string) error {
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	logger.SetLevel(logrus.WarnLevel)
+	mainLogger = logger.WithField("component", "match")
+	cfg, err := loadConfigfile(configFile)
+	if err != nil {
+		return err
+	}
+	setConfig(cfg)
+	loadAdhocFreeze()
+	settings, err := loadClusterSettings(cfg.IncludeDir)
+	if err != nil {
+		return err
+	}
+	if err := checkClusterOverlaps(cfg, settings); err != nil {
+		mainLogger.Error(err.Error())
+	}
+	explanations := []matchExplanation{}
+	for _, fqdn := range strings.Split(fqdns, ",") {
+		if fqdn = strings.TrimSpace(fqdn); len(fqdn) > 0 {
+			explanations = append(explanations, explainMatch(fqdn, uptime, settings, false))
+		}
+	}
+	output, _ := json.MarshalIndent(explanations, "", "  ")
+	fmt.Println(string(output))
+	return nil
+}
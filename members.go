@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// parallelRestarts is the allowed_parallel_restarts setting, either an absolute number or a percentage of the known cluster members like 20%
+type parallelRestarts struct {
+	Count   int
+	Percent int
+}
+
+// UnmarshalYAML accepts allowed_parallel_restarts: 2 as well as allowed_parallel_restarts: 20%
+func (pr *parallelRestarts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	p, err := parseParallelRestarts(s)
+	if err != nil {
+		return err
+	}
+	*pr = p
+	return nil
+}
+
+func parseParallelRestarts(s string) (parallelRestarts, error) {
+	s = strings.TrimSpace(s)
+	if percent, isPercent := strings.CutSuffix(s, "%"); isPercent {
+		p, err := strconv.Atoi(strings.TrimSpace(percent))
+		if err != nil || p < 1 || p > 100 {
+			return parallelRestarts{}, errors.New("invalid allowed_parallel_restarts " + s + " Percentages have to be between 1% and 100%")
+		}
+		return parallelRestarts{Percent: p}, nil
+	}
+	c, err := strconv.Atoi(s)
+	if err != nil || c < 0 {
+		return parallelRestarts{}, errors.New("invalid allowed_parallel_restarts " + s + " Use a number like 2 or a percentage of the cluster members like 20%")
+	}
+	return parallelRestarts{Count: c}, nil
+}
+
+// MarshalJSON returns the number or the percentage string like in the cluster config
+func (pr parallelRestarts) MarshalJSON() ([]byte, error) {
+	if pr.Percent > 0 {
+		return json.Marshal(pr.String())
+	}
+	return json.Marshal(pr.Count)
+}
+
+// UnmarshalJSON accepts the number or the percentage string returned by MarshalJSON
+func (pr *parallelRestarts) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	p, err := parseParallelRestarts(s)
+	if err != nil {
+		return err
+	}
+	*pr = p
+	return nil
+}
+
+func (pr parallelRestarts) String() string {
+	if pr.Percent > 0 {
+		return strconv.Itoa(pr.Percent) + "%"
+	}
+	return strconv.Itoa(pr.Count)
+}
+
+// allowed returns the absolute number of parallel restarts for the given number of known cluster members.
+// A percentage is rounded down, but allows at least one restart as long as there are members.
+func (pr parallelRestarts) allowed(members int) int {
+	if pr.Percent < 1 {
+		return pr.Count
+	}
+	allowed := members * pr.Percent / 100
+	if allowed < 1 && members > 0 {
+		allowed = 1
+	}
+	return allowed
+}
+
+// clusterMembers is the optional inventory of the hosts that belong to a cluster
+type clusterMembers struct {
+	Static  []string `yaml:"static" json:"static,omitempty"`
+	File    string   `yaml:"file" json:"file,omitempty"`
+	Command string   `yaml:"command" json:"command,omitempty"`
+}
+
+func (m clusterMembers) configured() bool {
+	return len(m.Static) > 0 || len(m.File) > 0 || len(m.Command) > 0
+}
+
+// validateMembers checks that the cluster has a member inventory if one of its settings depends on it
+func validateMembers(csetting clusterSetting) error {
+	if csetting.AllowedParallelRestarts.Percent > 0 && !csetting.Members.configured() {
+		return errors.New("allowed_parallel_restarts " + csetting.AllowedParallelRestarts.String() + " requires a members inventory")
+	}
+	return nil
+}
+
+// resolveClusterMembers returns the sorted and deduplicated FQDNs of the static members, the members file with one FQDN per line and the output of the members command
+func resolveClusterMembers(cluster string, csetting clusterSetting, clusterLogger *logrus.Entry) ([]string, error) {
+	members := make(map[string]struct{})
+	for _, fqdn := range csetting.Members.Static {
+		members[fqdn] = struct{}{}
+	}
+	if len(csetting.Members.File) > 0 {
+		data, err := os.ReadFile(csetting.Members.File)
+		if err != nil {
+			return nil, errors.New("could not read members file of cluster " + cluster + ": " + err.Error())
+		}
+		addMemberLines(members, string(data))
+	}
+	if len(csetting.Members.Command) > 0 {
+		command, er := executeHook("members_command", csetting.Members.Command, newHookData("", cluster, csetting), csetting.hookTimeout("members_command"), false, clusterLogger)
+		if er.timedOut {
+			return nil, errors.New("members command " + command + " of cluster " + cluster + " timed out after " + er.timeout.String())
+		}
+		if er.returnCode != 0 {
+			return nil, errors.New("members command " + command + " of cluster " + cluster + " returned exit code " + strconv.Itoa(er.returnCode))
+		}
+		addMemberLines(members, er.output)
+	}
+	fqdns := keysString(members)
+	sort.Strings(fqdns)
+	return fqdns, nil
+}
+
+// addMemberLines adds every non-empty line that is not a # comment as member FQDN
+func addMemberLines(members map[string]struct{}, lines string) {
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			members[line] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hookDurationBuckets are the upper bounds in seconds of the executeCommand duration histogram
+var hookDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+var (
+	restartDecisions = newCounterVec("goahead_restart_decisions_total", "Number of restart and inquire decisions made by goahead", "cluster", "decision")
+	hookDurations    = newHistogramVec("goahead_hook_duration_seconds", "Duration of the executed hook commands", hookDurationBuckets, "hook")
+	hookTimeouts     = newCounterVec("goahead_hook_timeouts_total", "Number of hook commands killed after their timeout", "hook")
+)
+
+// counterVec is a minimal Prometheus counter with labels
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+// histogramVec is a minimal Prometheus histogram with labels
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+// labelValueEscaper escapes the label values like the Prometheus text format defines it, only backslash, double quote and line feed get escaped
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString renders the label names and values in the Prometheus text format, e.g. cluster="foo",decision="go_ahead"
+func labelString(names []string, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + labelValueEscaper.Replace(value) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// inc increments the counter with the given label values
+func (c *counterVec) inc(labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[labelString(c.labels, labelValues)]++
+}
+
+// get returns the current value of the counter with the given label values
+func (c *counterVec) get(labelValues ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.values[labelString(c.labels, labelValues)]
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, labels := range sortedMetricKeys(c.values) {
+		fmt.Fprintf(b, "%s{%s} %s\n", c.name, labels, formatMetricValue(c.values[labels]))
+	}
+}
+
+// observe adds the given duration to the histogram with the given label values
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	labels := labelString(h.labels, labelValues)
+	v, ok := h.values[labels]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[labels] = v
+	}
+	seconds := d.Seconds()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += seconds
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, labels := range sortedMetricKeys(h.values) {
+		v := h.values[labels]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=%q} %d\n", h.name, labels, formatMetricValue(bound), v.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, labels, v.count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", h.name, labels, formatMetricValue(v.sum))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", h.name, labels, v.count)
+	}
+}
+
+func writeGauge(b *strings.Builder, name string, help string, values map[string]float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, labels := range sortedMetricKeys(values) {
+		if len(labels) > 0 {
+			fmt.Fprintf(b, "%s{%s} %s\n", name, labels, formatMetricValue(values[labels]))
+		} else {
+			fmt.Fprintf(b, "%s %s\n", name, formatMetricValue(values[labels]))
+		}
+	}
+}
+
+func sortedMetricKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsHandler exposes the goahead metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	restartDecisions.write(&b)
+	hookDurations.write(&b)
+	hookTimeouts.write(&b)
+
+	ongoingRestarts := make(map[string]float64)
+	settings, _ := currentClusterSettings()
+	for _, cluster := range sortedClusterNames(settings) {
+		cs, _ := readClusterState(cluster)
+		ongoingRestarts[labelString([]string{"cluster"}, []string{cluster})] = float64(cs.CurrentOngoingRestarts)
+	}
+	writeGauge(&b, "goahead_cluster_current_ongoing_restarts", "Number of hosts per cluster that received the go_ahead and did not successfully reboot yet", ongoingRestarts)
+
+	mutex.Lock()
+	sleepingChecks := float64(len(sleepingClusterChecks))
+	runningChecks := float64(len(runningClusterChecks))
+	mutex.Unlock()
+	writeGauge(&b, "goahead_sleeping_cluster_checks", "Number of reboot completion checks waiting for their reboot_completion_check_offset", map[string]float64{"": sleepingChecks})
+	writeGauge(&b, "goahead_running_cluster_checks", "Number of currently running reboot completion checks", map[string]float64{"": runningChecks})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
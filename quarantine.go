@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	quarantineSourceAdmin  = "admin"
+	quarantineSourcePanic  = "panic"
+	quarantineSourceExpiry = "expiry"
+)
+
+// quarantineEntry denies all restart requests of a host until an operator removes it
+type quarantineEntry struct {
+	Fqdn    string    `json:"fqdn"`
+	Cluster string    `json:"cluster"`
+	Reason  string    `json:"reason"`
+	By      string    `json:"by"`
+	Source  string    `json:"source"`
+	Since   time.Time `json:"since"`
+}
+
+// quarantineRequest is the payload to quarantine a host via the admin API
+type quarantineRequest struct {
+	Reason string `json:"reason"`
+}
+
+// checkQuarantine returns the reason why the FQDN must not restart, because it is quarantined.
+// An unreadable quarantine denies the restart as well.
+func checkQuarantine(cluster string, fqdn string) (string, bool, error) {
+	q, found, err := stateStore.GetQuarantine(cluster, fqdn)
+	if err != nil {
+		return "", true, errors.New("Could not read quarantine of cluster " + cluster + " " + err.Error())
+	}
+	if !found {
+		return "", false, nil
+	}
+	return "Denied restart request, because FQDN " + fqdn + " is quarantined in cluster " + cluster + " since " + q.Since.Format(time.RFC3339) + " by " + q.By + ": " + q.Reason, true, nil
+}
+
+// quarantineHost quarantines the FQDN unless it already is quarantined, so that the original reason is kept
+func quarantineHost(q quarantineEntry, clusterLogger *logrus.Entry) error {
+	if _, found, err := stateStore.GetQuarantine(q.Cluster, q.Fqdn); err != nil || found {
+		return err
+	}
+	if q.Since.IsZero() {
+		q.Since = time.Now()
+	}
+	if err := stateStore.PutQuarantine(q); err != nil {
+		clusterLogger.Error("Could not quarantine FQDN: " + q.Fqdn + " in cluster " + q.Cluster + " " + err.Error())
+		return err
+	}
+	clusterLogger.Warn("Quarantined FQDN: " + q.Fqdn + " in cluster " + q.Cluster + " by " + q.By + ": " + q.Reason)
+	return nil
+}
+
+// listQuarantineHandler lists the quarantined hosts of all clusters
+func listQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	entries := []quarantineEntry{}
+	for _, cluster := range sortedClusterNames(clusterSettings) {
+		list, err := stateStore.ListQuarantine(cluster)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		entries = append(entries, list...)
+	}
+	respondWithJSON(w, http.StatusOK, "", entries)
+}
+
+// quarantineHostHandler quarantines a host via the admin API
+func quarantineHostHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fqdn := mux.Vars(r)["fqdn"]
+	settings, loggers := currentClusterSettings()
+	if _, ok := settings[name]; !ok {
+		respondWithError(w, http.StatusNotFound, "", "Unknown cluster "+name)
+		return
+	}
+	var qr quarantineRequest
+	if err := json.NewDecoder(r.Body).Decode(&qr); err != nil || len(qr.Reason) < 1 {
+		respondWithError(w, http.StatusBadRequest, "", "Invalid request payload. Need at least the reason field!")
+		return
+	}
+	defer r.Body.Close()
+	q := quarantineEntry{Fqdn: fqdn, Cluster: name, Reason: qr.Reason, By: adminIdentity(r), Source: quarantineSourceAdmin, Since: time.Now()}
+	mutex.Lock()
+	err := stateStore.PutQuarantine(q)
+	mutex.Unlock()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	loggers[name].Warn("Quarantined FQDN: " + fqdn + " in cluster " + name + " by " + q.By + " via admin API: " + q.Reason)
+	respondWithJSON(w, http.StatusOK, "", q)
+}
+
+// clearQuarantineHandler allows restarts of a quarantined host again
+func clearQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fqdn := mux.Vars(r)["fqdn"]
+	settings, loggers := currentClusterSettings()
+	if _, ok := settings[name]; !ok {
+		respondWithError(w, http.StatusNotFound, "", "Unknown cluster "+name)
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	q, found, err := stateStore.GetQuarantine(name, fqdn)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "", "FQDN "+fqdn+" is not quarantined in cluster "+name)
+		return
+	}
+	if err := stateStore.DeleteQuarantine(name, fqdn); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	loggers[name].Info("Removed FQDN: " + fqdn + " from the quarantine of cluster " + name + " by " + adminIdentity(r) + " It was quarantined by " + q.By + ": " + q.Reason)
+	respondWithJSON(w, http.StatusOK, "", q)
+}
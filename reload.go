@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// reloadResult lists the cluster changes of a successful config reload
+type reloadResult struct {
+	Clusters        []string `json:"clusters"`
+	AddedClusters   []string `json:"added_clusters"`
+	RemovedClusters []string `json:"removed_clusters"`
+	IgnoredSettings []string `json:"ignored_settings"`
+}
+
+// reloadConfig re-reads the config file and the cluster settings of the include_dir and only swaps them, if everything is valid.
+// Already scheduled and running reboot completion checks keep the cluster settings they were started with.
+func reloadConfig() (reloadResult, error) {
+	result := reloadResult{AddedClusters: []string{}, RemovedClusters: []string{}, IgnoredSettings: []string{}}
+	mainLogger.Info("Reloading config file " + configFile)
+	newConfig, err := loadConfigfile(configFile)
+	if err != nil {
+		return result, err
+	}
+	newSettings, err := loadClusterSettings(newConfig.IncludeDir)
+	if err != nil {
+		return result, err
+	}
+	if err := checkClusterOverlaps(newConfig, newSettings); err != nil {
+		return result, err
+	}
+	tlsConfig, err := buildTLSConfig(newConfig)
+	if err != nil {
+		return result, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	config := currentConfig()
+	// these settings are only used on startup, keep the running values
+	for _, setting := range []struct {
+		name      string
+		changed   bool
+		keepValue func()
+	}{
+		{"listen_address", newConfig.ListenAddress != config.ListenAddress, func() { newConfig.ListenAddress = config.ListenAddress }},
+		{"listen_port", newConfig.ListenPort != config.ListenPort, func() { newConfig.ListenPort = config.ListenPort }},
+		{"log_base_dir", newConfig.LogBaseDir != config.LogBaseDir, func() { newConfig.LogBaseDir = config.LogBaseDir }},
+		{"audit_log_file", newConfig.AuditLogFile != config.AuditLogFile, func() { newConfig.AuditLogFile = config.AuditLogFile }},
+		{"save_state_dir", newConfig.SaveStateDir != config.SaveStateDir, func() { newConfig.SaveStateDir = config.SaveStateDir }},
+		{"state_backend", newConfig.StateBackend != config.StateBackend, func() { newConfig.StateBackend = config.StateBackend }},
+		{"state_bolt_file", newConfig.StateBoltFile != config.StateBoltFile, func() { newConfig.StateBoltFile = config.StateBoltFile }},
+	} {
+		if setting.changed {
+			mainLogger.Warn("Ignoring changed setting " + setting.name + " during reload, it only takes effect after a restart of goahead")
+			setting.keepValue()
+			result.IgnoredSettings = append(result.IgnoredSettings, setting.name)
+		}
+	}
+
+	for cluster := range newSettings {
+		if _, ok := clusterSettings[cluster]; !ok {
+			result.AddedClusters = append(result.AddedClusters, cluster)
+		}
+		result.Clusters = append(result.Clusters, cluster)
+	}
+	for cluster := range clusterSettings {
+		if _, ok := newSettings[cluster]; !ok {
+			result.RemovedClusters = append(result.RemovedClusters, cluster)
+		}
+	}
+	sort.Strings(result.Clusters)
+	sort.Strings(result.AddedClusters)
+	sort.Strings(result.RemovedClusters)
+
+	clusterLoggers := currentClusterLoggers()
+	newLoggers := clusterLoggersFor(newSettings, clusterLoggers)
+	// keep the loggers of removed clusters for their still running reboot completion checks
+	for _, cluster := range result.RemovedClusters {
+		newLoggers[cluster] = clusterLoggers[cluster]
+	}
+	setConfig(newConfig)
+	clusterSettings = newSettings
+	setClusterLoggers(newLoggers)
+	currentTLSConfig.Store(tlsConfig)
+	mainLogger.Info("Reloaded config file " + configFile + " with clusters: " + strings.Join(result.Clusters, ", ") + " Added clusters: " + strings.Join(result.AddedClusters, ", ") + " Removed clusters: " + strings.Join(result.RemovedClusters, ", "))
+	return result, nil
+}
+
+// reloadOnSIGHUP reloads the config whenever goahead receives a SIGHUP
+func reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		mainLogger.Info("Received SIGHUP")
+		if _, err := reloadConfig(); err != nil {
+			mainLogger.Error("Keeping the current config, because reloading failed: " + err.Error())
+		}
+	}
+}
+
+// reloadHandler reloads the config via the admin API
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := reloadConfig()
+	if err != nil {
+		mainLogger.Error("Keeping the current config, because reloading failed: " + err.Error())
+		respondWithError(w, http.StatusUnprocessableEntity, "", "Keeping the current config, because reloading failed: "+err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, "", result)
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,40 +19,88 @@ func serve() {
 	router := mux.NewRouter()
 	addV1Routes(router.PathPrefix("/v1").Subrouter())
 	addRoutes(router)
+	router.HandleFunc("/metrics", metricsHandler)
 
-	// TLS stuff
+	cfg := currentConfig()
+	tlsConfig, err := buildTLSConfig(*cfg)
+	if err != nil {
+		mainLogger.Fatal(err.Error())
+	}
+	currentTLSConfig.Store(tlsConfig)
+
+	server := &http.Server{
+		Handler:      router,
+		Addr:         cfg.ListenAddress + ":" + strconv.Itoa(cfg.ListenPort),
+		TLSConfig:    reloadableTLSConfig(),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		IdleTimeout:  15 * time.Second,
+	}
+
+	mainLogger.Info("Listening on https://" + cfg.ListenAddress + ":" + strconv.Itoa(cfg.ListenPort) + "/")
+	// the certificate gets served by the reloadable TLS config
+	err = server.ListenAndServeTLS("", "")
+	if err != nil {
+		mainLogger.Fatal("Error while trying to serve HTTPS with ssl_certificate_file " + cfg.CertificateFile + " and ssl_private_key " + cfg.PrivateKey + " " + err.Error())
+	}
+}
+
+// currentTLSConfig is the TLS config of the last successfully loaded config file, it gets replaced on reload
+var currentTLSConfig atomic.Pointer[tls.Config]
+
+// reloadableTLSConfig returns a TLS config that always uses the certificates and the client CA of the currentTLSConfig
+func reloadableTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &currentTLSConfig.Load().Certificates[0], nil
+		},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return currentTLSConfig.Load(), nil
+		},
+	}
+}
+
+// buildTLSConfig loads the configured SSL key and certificate and the client certificate CA
+func buildTLSConfig(cfg configSettings) (*tls.Config, error) {
 	tlsConfig := &tls.Config{}
 	//Use only TLS v1.2
 	tlsConfig.MinVersion = tls.VersionTLS12
 
-	if config.RequireAndVerifyClientCert {
+	cert, err := tls.LoadX509KeyPair(cfg.CertificateFile, cfg.PrivateKey)
+	if err != nil {
+		return nil, errors.New("Error while trying to load ssl_certificate_file " + cfg.CertificateFile + " and ssl_private_key " + cfg.PrivateKey + " " + err.Error())
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	if cfg.RequireAndVerifyClientCert {
 
 		//Expect and verify client certificate against a CA cert
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 
 		// Load CA cert
-		caCert, err := os.ReadFile(config.ClientCertCaFile)
+		caCert, err := os.ReadFile(cfg.ClientCertCaFile)
 		if err != nil {
-			mainLogger.Fatal("Error while trying to read ssl_client_cert_ca_file " + config.ClientCertCaFile + " " + err.Error())
+			return nil, errors.New("Error while trying to read ssl_client_cert_ca_file " + cfg.ClientCertCaFile + " " + err.Error())
 		}
 		caCertPool := x509.NewCertPool()
 		caCertPool.AppendCertsFromPEM(caCert)
 		tlsConfig.ClientCAs = caCertPool
-		mainLogger.Info("Expecting and verifing client certificate against " + config.ClientCertCaFile)
+		mainLogger.Info("Expecting and verifing client certificate against " + cfg.ClientCertCaFile)
 
-	}
-	server := &http.Server{
-		Handler:      router,
-		Addr:         config.ListenAddress + ":" + strconv.Itoa(config.ListenPort),
-		TLSConfig:    tlsConfig,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
-		IdleTimeout:  15 * time.Second,
-	}
+	} else if len(cfg.AdminClientCertCNs) > 0 {
 
-	mainLogger.Info("Listening on https://" + config.ListenAddress + ":" + strconv.Itoa(config.ListenPort) + "/")
-	err := server.ListenAndServeTLS(config.CertificateFile, config.PrivateKey)
-	if err != nil {
-		mainLogger.Fatal("Error while trying to serve HTTPS with ssl_certificate_file " + config.CertificateFile + " and ssl_private_key " + config.PrivateKey + " " + err.Error())
+		// Verify optional client certificates, so that admins can authenticate with them
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+		caCert, err := os.ReadFile(cfg.ClientCertCaFile)
+		if err != nil {
+			return nil, errors.New("Error while trying to read ssl_client_cert_ca_file " + cfg.ClientCertCaFile + " " + err.Error())
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConfig.ClientCAs = caCertPool
+		mainLogger.Info("Verifing optional client certificates for admin_client_cert_cns against " + cfg.ClientCertCaFile)
 	}
+	return tlsConfig, nil
 }
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"path/filepath"
+	"errors"
 	"strconv"
 	"strings"
 	"time"
@@ -9,11 +9,19 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// errHostNotRestarting is returned if a FQDN should be released that does not hold a restart slot
+var errHostNotRestarting = errors.New("FQDN is not restarting")
+
+// errKeepClusterState aborts an updateClusterState without saving the cluster state
+var errKeepClusterState = errors.New("keep cluster state")
+
 type rebootCheckResult struct {
 	RebootPanicThresholdEnabled bool
 	FqdnGoAhead                 bool
 	ClusterGoAhead              bool
 	Reason                      string
+	Decision                    string
+	ClusterState                clusterState
 }
 
 type inquireCheckResult struct {
@@ -22,31 +30,25 @@ type inquireCheckResult struct {
 }
 
 func saveAckFile(res response, clusterLogger *logrus.Entry) {
-	folder := filepath.Join(config.SaveStateDir, res.FoundCluster)
-	checkDirAndCreate(folder, "SaveAckFile cluster directory")
-	file := filepath.Join(folder, res.RequestingFqdn+".json")
-	clusterLogger.Infof("Trying to save fqdn ACK file %s", file)
-	writeStructJSONFile(file, res)
+	clusterLogger.Infof("Trying to save fqdn ACK for %s in cluster %s", res.RequestingFqdn, res.FoundCluster)
+	if err := stateStore.PutHostAck(res); err != nil {
+		clusterLogger.Error("Could not save fqdn ACK for " + res.RequestingFqdn + " in cluster " + res.FoundCluster + " " + err.Error())
+	}
 }
 
-func checkAckFileInquire(req request, res response, clusterLogger *logrus.Entry, cs clusterSetting) inquireCheckResult {
-	folder := filepath.Join(config.SaveStateDir, res.FoundCluster)
-	file := filepath.Join(folder, req.Fqdn+".json")
-	clusterLogger.Debug(res.RequestID + " Checking for ACK file " + file)
-	if fileExists(file) {
-		clusterLogger.Debug(res.RequestID + " Found ACK file " + file + " Trying to read it")
-		var ackFile response
-		ackFile = readAckFile(file, ackFile, res.FoundCluster, clusterLogger)
+func checkAckFileInquire(req request, res response, clusterLogger *logrus.Entry) inquireCheckResult {
+	clusterLogger.Debug(res.RequestID + " Checking for ACK of " + req.Fqdn)
+	ackFile, found, err := stateStore.GetHostAck(res.FoundCluster, req.Fqdn)
+	if err != nil {
+		clusterLogger.Error("Could not read fqdn ACK for " + req.Fqdn + " in cluster " + res.FoundCluster + " " + err.Error())
+	}
+	if found {
+		clusterLogger.Debug(res.RequestID + " Found ACK of " + req.Fqdn)
 		// TODO: add check if this fqdn recieved goahead in cluster state json
 		if compareDurationString(req.Uptime, ackFile.ReportedUptime) == "shorter" || ackFile.Goahead {
-			mutex.Lock()
-			if cc, ok := sleepingClusterChecks[res.RequestingFqdn]; ok {
-				// Interrupt a reboot completion check if there is one still sleeping
-				clusterLogger.Info("Interrupting sleeping reboot completion check for " + req.Fqdn + " inside cluster " + res.FoundCluster)
-				delete(sleepingClusterChecks, cc.Fqdn)
-				go startCheckForRebootedSystem(cc, req, cs)
-			}
-			mutex.Unlock()
+			// Interrupt a reboot completion check if there is one still sleeping
+			clusterLogger.Debug("Trying to interrupt sleeping reboot completion check for " + req.Fqdn + " inside cluster " + res.FoundCluster)
+			wakeClusterCheck(req, nil, "Received inquire request from FQDN "+req.Fqdn+" Interrupting reboot_completion_check_offset sleep!")
 		} else {
 			clusterLogger.Info("Reported uptime for FQDN: " + req.Fqdn + " was not shorter! Reported uptime:" + req.Uptime + " last reported uptime in ACK file: " + ackFile.ReportedUptime)
 			updatedRes := ackFile
@@ -57,21 +59,22 @@ func checkAckFileInquire(req request, res response, clusterLogger *logrus.Entry,
 			clusterLogger.Info("YesInquireToRestart found for FQDN: " + req.Fqdn + " Reason: " + ackFile.Message)
 			return inquireCheckResult{InquireToRestart: true, Reason: ackFile.Message}
 		}
-	} else {
+	} else if err == nil {
 		saveAckFile(res, clusterLogger)
 	}
 	return inquireCheckResult{InquireToRestart: false}
 }
 
-func checkChecksInquire(req request, res response, clusterLogger *logrus.Entry) inquireCheckResult {
-	for _, check := range clusterSettings[res.FoundCluster].RebootGoaheadChecks {
+func checkChecksInquire(req request, res response, d hookData, csetting clusterSetting, clusterLogger *logrus.Entry) inquireCheckResult {
+	for _, check := range csetting.RebootGoaheadChecks {
 		clusterLogger.Info("found goahead check:" + check)
-		command := strings.Replace(check, "{:%fqdn%:}", req.Fqdn, -1)
-		command = strings.Replace(command, "{:%cluster%:}", res.FoundCluster, -1)
-		command = strings.Replace(command, "{:%hostname%:}", strings.SplitN(req.Fqdn, ".", 2)[0], -1)
-		er := executeCommand(command, 5, clusterSettings[res.FoundCluster].RaiseErrors, clusterLogger)
-		clusterLogger.Info("goahead check result of "+command+" is ", er.returnCode)
-		if er.returnCode == clusterSettings[res.FoundCluster].RebootGoaheadChecksExitCodeForReboot {
+		command, er := executeHook("goahead_check", check, d, csetting.hookTimeout("goahead_check"), csetting.RaiseErrors, clusterLogger)
+		clusterLogger.Info("goahead check result of " + command + " is " + er.String())
+		if er.timedOut {
+			// a hanging check must never ask the host to restart
+			continue
+		}
+		if er.returnCode == csetting.RebootGoaheadChecksExitCodeForReboot {
 			clusterLogger.Info("YesInquireToRestart: goahead check result of " + command + " is " + strconv.Itoa(er.returnCode))
 			return inquireCheckResult{InquireToRestart: true, Reason: "YesInquireToRestart: goahead check result of " + command + " is " + strconv.Itoa(er.returnCode)}
 		}
@@ -80,16 +83,17 @@ func checkChecksInquire(req request, res response, clusterLogger *logrus.Entry)
 }
 
 func checkAckFile(req request, res response, clusterLogger *logrus.Entry) rebootCheckResult {
-	folder := filepath.Join(config.SaveStateDir, res.FoundCluster)
-	file := filepath.Join(folder, req.Fqdn+".json")
-	clusterLogger.Debug("Checking for ACK file " + file)
-	if fileExists(file) {
-		clusterLogger.Debug(res.RequestID + " Found ACK file " + file + " Trying to read it")
-		var ackFile response
-		ackFile = readAckFile(file, ackFile, res.FoundCluster, clusterLogger)
+	clusterLogger.Debug("Checking for ACK of " + req.Fqdn)
+	ackFile, found, err := stateStore.GetHostAck(res.FoundCluster, req.Fqdn)
+	if err != nil {
+		clusterLogger.Error("Could not read fqdn ACK for " + req.Fqdn + " in cluster " + res.FoundCluster + " " + err.Error())
+		return rebootCheckResult{FqdnGoAhead: false, ClusterGoAhead: false, Reason: "Could not read previous request of fqdn: " + req.Fqdn + " " + err.Error(), Decision: "error"}
+	}
+	if found {
+		clusterLogger.Debug(res.RequestID + " Found ACK of " + req.Fqdn)
 		if len(req.RequestID) > 1 {
 			if req.RequestID == ackFile.RequestID {
-				clusterLogger.Debug(req.RequestID + " Found matching request_id in ACK file " + file + " and in request")
+				clusterLogger.Debug(req.RequestID + " Found matching request_id in ACK and in request")
 				return rebootCheckResult{FqdnGoAhead: true, ClusterGoAhead: false, Reason: ""}
 			}
 			return rebootCheckResult{FqdnGoAhead: false, ClusterGoAhead: false, Reason: "Found mismatching request_id in request: " + req.RequestID + " and found on middle-ware: " + ackFile.RequestID}
@@ -102,121 +106,194 @@ func checkAckFile(req request, res response, clusterLogger *logrus.Entry) reboot
 }
 
 func deleteAckFile(fqdn string, cluster string) {
-	purgeDir(filepath.Join(config.SaveStateDir, cluster, fqdn+".json"), "successful reboot check for fqdn "+fqdn)
+	if err := stateStore.DeleteHostAck(cluster, fqdn); err != nil {
+		stateLogger(cluster).Error("Could not delete fqdn ACK for " + fqdn + " in cluster " + cluster + " " + err.Error())
+	}
 }
 
-func checkClusterState(res response, result rebootCheckResult, clusterLogger *logrus.Entry) rebootCheckResult {
-	folder := filepath.Join(config.SaveStateDir, res.FoundCluster)
-	checkDirAndCreate(folder, "SaveAckFile cluster directory")
-	clusterFile := filepath.Join(config.SaveStateDir, res.FoundCluster+".json")
-	mutex.Lock()
-	defer mutex.Unlock()
-	var cs clusterState
-	if fileExists(clusterFile) {
-		// read clusterFile and check if global clusterStates exists
-		cs = readClusterStateFile(clusterFile, res.FoundCluster, clusterLogger)
-		if _, ok := cs.CurrentRestartingServers[res.RequestingFqdn]; ok {
-			result.Reason = "You should already be restarting!"
-			result.ClusterGoAhead = true
-			return result
-		} else if len(cs.CurrentRestartingServers) > 0 &&
-			// we do not want to run script on every request, we will wait for next threshold (act like interval)
-			time.Since(cs.LastRestartPanicTimestamp).Seconds() > clusterSettings[res.FoundCluster].RebootCompletionPanicThreshold.Seconds() &&
-			// we have meet threshold
-			time.Since(cs.LastRestartRequestTimestamp).Seconds() > clusterSettings[res.FoundCluster].RebootCompletionPanicThreshold.Seconds() {
-			result.Reason = "Reboot completion panic threshold met for cluster " + res.FoundCluster + " because previous host " + strings.Join(keysString(cs.CurrentRestartingServers), ",") + " still offline!"
-			result.ClusterGoAhead = false
-			result.RebootPanicThresholdEnabled = true
-			cs.LastRestartPanicTimestamp = time.Now()
-			clusterLogger.Debug("Trying to save cluster ACK file on restart panic " + clusterFile)
-			if err := writeStructJSONFile(clusterFile, cs); err != nil {
-				result.Reason = "Could not save cluster state file: " + clusterFile + " " + err.Error()
-				clusterLogger.Error("Could not save cluster state file: " + clusterFile + " " + err.Error())
-			} else {
-				clusterLogger.Debug("Saved cluster state file: " + clusterFile)
-			}
-			return result
-		} else if cs.CurrentOngoingRestarts >= clusterSettings[res.FoundCluster].AllowedParallelRestarts {
-			result.Reason = "Denied restart request as the current_ongoing_restarts of cluster " + res.FoundCluster + " is larger than the allowed_parallel_restarts: " + strconv.Itoa(cs.CurrentOngoingRestarts) + " >= " + strconv.Itoa(clusterSettings[res.FoundCluster].AllowedParallelRestarts) + " Currently restarting hosts: " + strings.Join(keysString(cs.CurrentRestartingServers), ",")
+// checkClusterState decides with the cluster settings of the request if the FQDN may restart and saves the cluster state
+func checkClusterState(res response, result rebootCheckResult, csetting clusterSetting, settings map[string]clusterSetting, clusterLogger *logrus.Entry) rebootCheckResult {
+	var members []string
+	if csetting.Members.configured() {
+		var err error
+		// resolve the members before locking, the members command might take a while
+		if members, err = resolveClusterMembers(res.FoundCluster, csetting, clusterLogger); err != nil {
+			result.Reason = "Could not resolve the members of cluster " + res.FoundCluster + " " + err.Error()
 			result.ClusterGoAhead = false
+			result.Decision = "error"
+			clusterLogger.Error(result.Reason)
 			return result
 		}
-		cs.CurrentOngoingRestarts++
-		cs.CurrentRestartingServers[res.RequestingFqdn] = struct{}{}
-		cs.LastRestartPanicTimestamp = time.Time{}
-		cs.LastRestartRequestTimestamp = time.Now()
-	} else {
-		clusterLogger.Debug("Creating cluster state for cluster " + res.FoundCluster)
-		crs := make(map[string]struct{})
-		cs = clusterState{LastRestartRequestTimestamp: time.Now(), CurrentOngoingRestarts: 1, CurrentRestartingServers: crs}
-		cs.CurrentRestartingServers[res.RequestingFqdn] = struct{}{}
-	}
-	clusterLogger.Debug("Trying to save cluster ACK file " + clusterFile)
-	err := writeStructJSONFile(clusterFile, cs)
-	if err != nil {
-		result.Reason = "Could not save cluster state file: " + clusterFile + " " + err.Error()
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	cs, err := updateClusterState(res.FoundCluster, func(cs *clusterState, exists bool) error {
+		if !exists {
+			clusterLogger.Debug("Creating cluster state for cluster " + res.FoundCluster)
+		}
+		return decideClusterState(res.FoundCluster, res.RequestingFqdn, csetting, settings, members, cs, &result, clusterLogger)
+	})
+	result.ClusterState = cs
+	if err == errKeepClusterState {
+		return result
+	} else if err != nil {
+		result.Reason = "Could not update cluster state of cluster " + res.FoundCluster + " " + err.Error()
 		result.ClusterGoAhead = false
-		clusterLogger.Error("Could not save cluster state file: " + clusterFile + " " + err.Error())
-	} else {
-		result.ClusterGoAhead = true
-		clusterLogger.Debug("Saved cluster state file: " + clusterFile)
+		result.RebootPanicThresholdEnabled = false
+		result.Decision = "error"
+		clusterLogger.Error(result.Reason)
+		return result
+	}
+	clusterLogger.Debug("Saved cluster state for cluster " + res.FoundCluster)
+	if result.RebootPanicThresholdEnabled {
+		if csetting.QuarantineOnPanic {
+			for _, fqdn := range sortedKeys(cs.CurrentRestartingServers) {
+				quarantineHost(quarantineEntry{Fqdn: fqdn, Cluster: res.FoundCluster, Reason: result.Reason, By: "goahead", Source: quarantineSourcePanic}, clusterLogger)
+			}
+		}
 	}
 	return result
 
 }
 
-func modifyClusterState(cluster string, fqdn string, operation string, clusterLogger *logrus.Entry) {
+// decideClusterState decides if the FQDN may restart based on the cluster state and the restarts of the other clusters.
+// It adds the FQDN to the restarting servers of cs if it may restart and has to be called with the mutex held.
+// settings are the cluster settings of all clusters the decision is based on.
+func decideClusterState(cluster string, fqdn string, csetting clusterSetting, settings map[string]clusterSetting, members []string, cs *clusterState, result *rebootCheckResult, clusterLogger *logrus.Entry) error {
+	allowed, limit := allowedParallelRestarts(csetting, members)
+	if reason, quarantined, err := checkQuarantine(cluster, fqdn); err != nil {
+		return err
+	} else if quarantined {
+		result.Reason = reason
+		result.ClusterGoAhead = false
+		result.Decision = "denied_quarantine"
+		return errKeepClusterState
+	}
+	if _, ok := cs.CurrentRestartingServers[fqdn]; ok {
+		result.Reason = "You should already be restarting!"
+		result.ClusterGoAhead = true
+		return errKeepClusterState
+	} else if len(cs.CurrentRestartingServers) > 0 &&
+		// we do not want to run script on every request, we will wait for next threshold (act like interval)
+		time.Since(cs.LastRestartPanicTimestamp).Seconds() > csetting.RebootCompletionPanicThreshold.Seconds() &&
+		// we have meet threshold
+		time.Since(cs.LastRestartRequestTimestamp).Seconds() > csetting.RebootCompletionPanicThreshold.Seconds() {
+		result.Reason = "Reboot completion panic threshold met for cluster " + cluster + " because previous host " + strings.Join(keysString(cs.CurrentRestartingServers), ",") + " still offline!"
+		result.ClusterGoAhead = false
+		result.RebootPanicThresholdEnabled = true
+		cs.LastRestartPanicTimestamp = time.Now()
+		clusterLogger.Debug("Trying to save cluster state on restart panic for cluster " + cluster)
+		return nil
+	} else if cs.CurrentOngoingRestarts >= allowed {
+		result.Reason = "Denied restart request as the current_ongoing_restarts of cluster " + cluster + " is larger than the " + limit + ": " + strconv.Itoa(cs.CurrentOngoingRestarts) + " >= " + strconv.Itoa(allowed) + " Currently restarting hosts: " + strings.Join(keysString(cs.CurrentRestartingServers), ",")
+		result.ClusterGoAhead = false
+		result.Decision = "denied_parallel"
+		return errKeepClusterState
+	}
+	if reason, blocked, err := checkClusterDependencies(cluster, settings); err != nil {
+		return err
+	} else if blocked {
+		result.Reason = reason
+		result.ClusterGoAhead = false
+		result.Decision = "denied_dependency"
+		return errKeepClusterState
+	}
+	if reason, blocked, err := checkRestartBudgets(cluster, *cs, settings); err != nil {
+		return err
+	} else if blocked {
+		result.Reason = reason
+		result.ClusterGoAhead = false
+		result.Decision = "denied_budget"
+		return errKeepClusterState
+	}
+	cs.CurrentOngoingRestarts++
+	cs.CurrentRestartingServers[fqdn] = struct{}{}
+	cs.LastRestartPanicTimestamp = time.Time{}
+	cs.LastRestartRequestTimestamp = time.Now()
+	if cs.RestartGrantedTimestamps == nil {
+		cs.RestartGrantedTimestamps = make(map[string]time.Time)
+	}
+	cs.RestartGrantedTimestamps[fqdn] = cs.LastRestartRequestTimestamp
+	clusterLogger.Debug("Trying to save cluster state for cluster " + cluster)
+	result.ClusterGoAhead = true
+	return nil
+}
+
+// modifyClusterState adds or removes the given FQDN to or from the currently restarting servers of the cluster.
+// The operation "remove" flags the FQDN as successfully rebooted, while "release" only frees its restart slot.
+// It also returns when the FQDN received its go_ahead according to the modified cluster state.
+func modifyClusterState(cluster string, fqdn string, operation string, clusterLogger *logrus.Entry) (clusterState, time.Time, error) {
 	clusterLogger.Info("Modifying cluster state for cluster: ", cluster, " for FQDN: ", fqdn, " with operation: ", operation)
-	clusterFile := filepath.Join(config.SaveStateDir, cluster+".json")
 	mutex.Lock()
 	defer mutex.Unlock()
-	var cs clusterState
-	if fileExists(clusterFile) {
-		cs = readClusterStateFile(clusterFile, cluster, clusterLogger)
+	var grantedAt time.Time
+	cs, err := updateClusterState(cluster, func(cs *clusterState, exists bool) error {
+		if !exists {
+			clusterLogger.Error("Could not find cluster state to modify for cluster: " + cluster)
+			return errors.New("Could not find cluster state to modify for cluster: " + cluster)
+		}
+		_, restarting := cs.CurrentRestartingServers[fqdn]
+		grantedAt = restartGrantedAt(*cs, fqdn)
 		// server finished -> then --
 		// server append -> then ++
-		if operation == "remove" {
-			cs.CurrentOngoingRestarts--
-			if cs.CurrentOngoingRestarts < 0 {
-				cs.CurrentOngoingRestarts = 0
+		switch operation {
+		case "remove", "release":
+			if !restarting {
+				if operation == "release" {
+					return errHostNotRestarting
+				}
+				clusterLogger.Warn("FQDN: " + fqdn + " is not restarting in cluster " + cluster + " Not decrementing current_ongoing_restarts")
+			} else {
+				cs.CurrentOngoingRestarts--
+				if cs.CurrentOngoingRestarts < 0 {
+					cs.CurrentOngoingRestarts = 0
+				}
+				delete(cs.CurrentRestartingServers, fqdn)
 			}
-			delete(cs.CurrentRestartingServers, fqdn)
-			cs.LastSuccessfulRestartTimestamp = time.Now()
-		} else if operation == "add" {
-			cs.CurrentOngoingRestarts++
-			cs.CurrentRestartingServers[fqdn] = struct{}{}
-		} else {
-			clusterLogger.Fatal("Invalid operation verb: " + operation + " for cluster state file: " + clusterFile)
+			delete(cs.RestartGrantedTimestamps, fqdn)
+			if operation == "remove" {
+				cs.LastSuccessfulRestartTimestamp = time.Now()
+				if cs.RebootedServers == nil {
+					cs.RebootedServers = make(map[string]time.Time)
+				}
+				cs.RebootedServers[fqdn] = cs.LastSuccessfulRestartTimestamp
+			}
+		case "add":
+			if !restarting {
+				cs.CurrentOngoingRestarts++
+				cs.CurrentRestartingServers[fqdn] = struct{}{}
+				if cs.RestartGrantedTimestamps == nil {
+					cs.RestartGrantedTimestamps = make(map[string]time.Time)
+				}
+				cs.RestartGrantedTimestamps[fqdn] = time.Now()
+			}
+		default:
+			clusterLogger.Fatal("Invalid operation verb: " + operation + " for cluster: " + cluster)
 		}
-
-		clusterLogger.Debug("Trying to save cluster ACK file " + clusterFile)
-		writeStructJSONFile(clusterFile, cs)
-	} else {
-		clusterLogger.Fatal("Could not find cluster state file to modify: " + clusterFile)
-	}
+		clusterLogger.Debug("Trying to save cluster state for cluster " + cluster)
+		return nil
+	})
+	return cs, grantedAt, err
 }
 
-// checkCurrentClusterStates checks the configured SaveStateDir for already existing cluster state files. Needed for a service restart to know the cluster state before the restart.
+// checkCurrentClusterStates checks the state store for already existing cluster states. Needed for a service restart to know the cluster state before the restart.
 func checkCurrentClusterStates() {
-	for cluster, csetting := range clusterSettings {
-		mutex.Lock()
-		clusterLogger := clusterLoggers[cluster]
-		mutex.Unlock()
+	settings, loggers := currentClusterSettings()
+	for cluster, csetting := range settings {
+		clusterLogger := loggers[cluster]
 		go func(cluster string, csetting clusterSetting) {
-			clusterFile := config.SaveStateDir + cluster + ".json"
-			if fileExists(clusterFile) {
-				clusterLogger.Info("Found previously existing cluster state file: " + clusterFile)
-				var cs clusterState = readClusterStateFile(clusterFile, cluster, clusterLogger)
+			cs, found, err := stateStore.GetClusterState(cluster)
+			if err != nil {
+				clusterLogger.Error("Could not read previously existing cluster state of cluster " + cluster + " " + err.Error())
+			}
+			if found {
+				clusterLogger.Info("Found previously existing cluster state for cluster " + cluster)
 				if cs.CurrentOngoingRestarts > 0 || len(cs.CurrentRestartingServers) > 0 {
-					clusterLogger.Info("Trying to restart cluster node checks for clusterFile: " + clusterFile)
+					clusterLogger.Info("Trying to restart cluster node checks for cluster " + cluster)
 					// restart the successfull reboot checker, otherwise it would block _all_ later restart requests
 					for restartingClusterNode := range cs.CurrentRestartingServers {
-						cc := clusterCheck{clusterSettings[cluster], restartingClusterNode, "checkCurrentClusterStates()", cluster}
-						mutex.Lock()
-						sleepingClusterChecks[restartingClusterNode] = cc
-						mutex.Unlock()
-						checkerLogger.Info("Sleeping for reboot_completion_check_offset: " + cc.Csetting.RebootCompletionCheckOffset.String() + " for FQDN: " + cc.Fqdn)
-						clusterLogger.Info("Restarting cluster checker for " + restartingClusterNode + " inside cluster " + cluster + " check command: " + csetting.RebootCompletionCheck)
+						checkCluster <- clusterCheck{csetting, restartingClusterNode, "checkCurrentClusterStates()", cluster}
+						clusterLogger.Info("Restarting cluster checker for " + restartingClusterNode + " inside cluster " + cluster + " check: " + csetting.RebootCompletionCheck.String())
 					}
 				}
 			}
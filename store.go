@@ -0,0 +1,567 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// StateStore persists the cluster states and the FQDN ACK responses
+type StateStore interface {
+	// GetClusterState returns the saved state of the cluster and if there is one
+	GetClusterState(cluster string) (clusterState, bool, error)
+	// PutClusterState saves the state of the cluster unconditionally
+	PutClusterState(cluster string, cs clusterState) error
+	// CompareAndSwapClusterState saves cs with the next revision only if the saved cluster state still has the revision of old
+	CompareAndSwapClusterState(cluster string, old clusterState, cs clusterState) (bool, error)
+	// GetHostAck returns the saved ACK response of the FQDN and if there is one
+	GetHostAck(cluster string, fqdn string) (response, bool, error)
+	// PutHostAck saves the ACK response for its requesting FQDN and found cluster
+	PutHostAck(res response) error
+	// DeleteHostAck removes the saved ACK response of the FQDN
+	DeleteHostAck(cluster string, fqdn string) error
+	// ListHostAcks returns all saved ACK responses of the cluster ordered by FQDN
+	ListHostAcks(cluster string) ([]response, error)
+	// GetQuarantine returns the quarantine entry of the FQDN and if it is quarantined
+	GetQuarantine(cluster string, fqdn string) (quarantineEntry, bool, error)
+	// PutQuarantine saves the quarantine entry for its FQDN and cluster
+	PutQuarantine(q quarantineEntry) error
+	// DeleteQuarantine removes the quarantine entry of the FQDN
+	DeleteQuarantine(cluster string, fqdn string) error
+	// ListQuarantine returns all quarantine entries of the cluster ordered by FQDN
+	ListQuarantine(cluster string) ([]quarantineEntry, error)
+	// GetHistory returns the finished reboot cycles of the cluster ordered by completion
+	GetHistory(cluster string) ([]rebootCycle, error)
+	// PutHistory replaces the finished reboot cycles of the cluster
+	PutHistory(cluster string, cycles []rebootCycle) error
+	Close() error
+}
+
+var stateStore StateStore
+
+// clusterStateRestorer is implemented by state stores that keep a backup generation of every cluster state
+type clusterStateRestorer interface {
+	// RestoreClusterState replaces the saved state of the cluster with its backup and returns it
+	RestoreClusterState(cluster string) (clusterState, error)
+}
+
+// errClusterStateChanged is returned if a cluster state was modified concurrently too often
+var errClusterStateChanged = errors.New("cluster state was modified concurrently")
+
+// newStateStore opens the state store configured with state_backend
+func newStateStore() (StateStore, error) {
+	cfg := currentConfig()
+	switch cfg.StateBackend {
+	case "", "file":
+		return &fileStateStore{}, nil
+	case "bolt":
+		return newBoltStateStore(cfg.StateBoltFile)
+	}
+	return nil, errors.New("unknown state_backend " + cfg.StateBackend + " Valid values are file or bolt")
+}
+
+// updateClusterState atomically applies fn to the saved state of the cluster and saves the result
+func updateClusterState(cluster string, fn func(cs *clusterState, exists bool) error) (clusterState, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		old, exists, err := stateStore.GetClusterState(cluster)
+		if err != nil {
+			return old, err
+		}
+		// work on a copy, so that old stays untouched for the comparison
+		var cs clusterState
+		data, _ := json.Marshal(old)
+		json.Unmarshal(data, &cs)
+		if cs.CurrentRestartingServers == nil {
+			cs.CurrentRestartingServers = make(map[string]struct{})
+		}
+		if err := fn(&cs, exists); err != nil {
+			return cs, err
+		}
+		swapped, err := stateStore.CompareAndSwapClusterState(cluster, old, cs)
+		if err != nil {
+			return cs, err
+		}
+		if swapped {
+			cs.Revision = old.Revision + 1
+			return cs, nil
+		}
+	}
+	return clusterState{}, errClusterStateChanged
+}
+
+// stateLogger returns the logger of the cluster for log messages of the state store
+func stateLogger(cluster string) *logrus.Entry {
+	if clusterLogger, ok := currentClusterLoggers()[cluster]; ok {
+		return clusterLogger
+	}
+	return unknownLogger
+}
+
+// fileStateStore saves the cluster states as <save_state_dir>/<cluster>.json and the ACK responses as <save_state_dir>/<cluster>/<fqdn>.json
+type fileStateStore struct {
+	sync.Mutex
+}
+
+func (s *fileStateStore) clusterFile(cluster string) string {
+	return filepath.Join(currentConfig().SaveStateDir, cluster+".json")
+}
+
+func (s *fileStateStore) ackFile(cluster string, fqdn string) string {
+	return filepath.Join(currentConfig().SaveStateDir, cluster, fqdn+".json")
+}
+
+// GetClusterState fails closed: a corrupt cluster state file is returned as an error instead of an empty cluster state,
+// because an empty cluster state would free all restart slots of the cluster
+func (s *fileStateStore) GetClusterState(cluster string) (clusterState, bool, error) {
+	file := s.clusterFile(cluster)
+	if !fileExists(file) {
+		return clusterState{}, false, nil
+	}
+	cs, err := readClusterStateFile(file, cluster, stateLogger(cluster))
+	if err != nil {
+		return cs, true, errors.New(err.Error() + " Restore it from the backup " + file + ".bak via the admin API")
+	}
+	return cs, true, nil
+}
+
+// PutClusterState keeps the previous readable cluster state as <cluster>.json.bak before it replaces the cluster state file
+func (s *fileStateStore) PutClusterState(cluster string, cs clusterState) error {
+	file := s.clusterFile(cluster)
+	if data, err := os.ReadFile(file); err == nil && json.Valid(data) {
+		if err := writeFileAtomic(file+".bak", data); err != nil {
+			stateLogger(cluster).Warn("Could not write backup of cluster state file " + file + " " + err.Error())
+		}
+	}
+	return writeStructJSONFile(file, cs)
+}
+
+// RestoreClusterState replaces the cluster state of the cluster with its backup generation
+func (s *fileStateStore) RestoreClusterState(cluster string) (clusterState, error) {
+	s.Lock()
+	defer s.Unlock()
+	file := s.clusterFile(cluster)
+	cs, err := readClusterStateFile(file+".bak", cluster, stateLogger(cluster))
+	if err != nil {
+		return cs, err
+	}
+	current, _, err := s.GetClusterState(cluster)
+	if err != nil {
+		// keep the corrupt cluster state file for a post mortem
+		corrupt := file + ".corrupt-" + time.Now().Format("20060102T150405")
+		if err := os.Rename(file, corrupt); err == nil {
+			stateLogger(cluster).Warn("Moved corrupt cluster state file " + file + " to " + corrupt)
+		}
+	} else if current.Revision >= cs.Revision {
+		// the restored cluster state must not be mistaken for an older revision by concurrent updates
+		cs.Revision = current.Revision + 1
+	}
+	return cs, writeStructJSONFile(file, cs)
+}
+
+func (s *fileStateStore) CompareAndSwapClusterState(cluster string, old clusterState, cs clusterState) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	current, _, err := s.GetClusterState(cluster)
+	if err != nil {
+		return false, err
+	}
+	if current.Revision != old.Revision {
+		return false, nil
+	}
+	cs.Revision = old.Revision + 1
+	return true, s.PutClusterState(cluster, cs)
+}
+
+func (s *fileStateStore) GetHostAck(cluster string, fqdn string) (response, bool, error) {
+	var res response
+	file := s.ackFile(cluster, fqdn)
+	if !fileExists(file) {
+		return res, false, nil
+	}
+	return readAckFile(file, res, cluster, stateLogger(cluster)), true, nil
+}
+
+func (s *fileStateStore) PutHostAck(res response) error {
+	checkDirAndCreate(filepath.Join(currentConfig().SaveStateDir, res.FoundCluster), "SaveAckFile cluster directory")
+	return writeStructJSONFile(s.ackFile(res.FoundCluster, res.RequestingFqdn), res)
+}
+
+func (s *fileStateStore) DeleteHostAck(cluster string, fqdn string) error {
+	if err := os.Remove(s.ackFile(cluster, fqdn)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStateStore) ListHostAcks(cluster string) ([]response, error) {
+	acks := []response{}
+	files, err := filepath.Glob(filepath.Join(currentConfig().SaveStateDir, cluster, "*.json"))
+	if err != nil {
+		return acks, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		var res response
+		acks = append(acks, readAckFile(file, res, cluster, stateLogger(cluster)))
+	}
+	return acks, nil
+}
+
+func (s *fileStateStore) quarantineFile(cluster string) string {
+	return filepath.Join(currentConfig().SaveStateDir, cluster+".quarantine.json")
+}
+
+// readQuarantine fails closed like GetClusterState, an unreadable quarantine file must not release quarantined hosts
+func (s *fileStateStore) readQuarantine(cluster string) (map[string]quarantineEntry, error) {
+	entries := make(map[string]quarantineEntry)
+	file := s.quarantineFile(cluster)
+	if !fileExists(file) {
+		return entries, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return entries, errors.New("could not read quarantine file " + file + ": " + err.Error())
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return entries, errors.New("corrupt quarantine file " + file + ": JSON unmarshal error: " + err.Error())
+	}
+	return entries, nil
+}
+
+func (s *fileStateStore) GetQuarantine(cluster string, fqdn string) (quarantineEntry, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	entries, err := s.readQuarantine(cluster)
+	q, found := entries[fqdn]
+	return q, found, err
+}
+
+func (s *fileStateStore) PutQuarantine(q quarantineEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	entries, err := s.readQuarantine(q.Cluster)
+	if err != nil {
+		return err
+	}
+	entries[q.Fqdn] = q
+	return writeStructJSONFile(s.quarantineFile(q.Cluster), entries)
+}
+
+func (s *fileStateStore) DeleteQuarantine(cluster string, fqdn string) error {
+	s.Lock()
+	defer s.Unlock()
+	entries, err := s.readQuarantine(cluster)
+	if err != nil {
+		return err
+	}
+	if _, found := entries[fqdn]; !found {
+		return nil
+	}
+	delete(entries, fqdn)
+	return writeStructJSONFile(s.quarantineFile(cluster), entries)
+}
+
+func (s *fileStateStore) ListQuarantine(cluster string) ([]quarantineEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+	entries, err := s.readQuarantine(cluster)
+	list := []quarantineEntry{}
+	for _, q := range entries {
+		list = append(list, q)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Fqdn < list[j].Fqdn })
+	return list, err
+}
+
+func (s *fileStateStore) historyFile(cluster string) string {
+	return filepath.Join(currentConfig().SaveStateDir, cluster+".history.json")
+}
+
+func (s *fileStateStore) GetHistory(cluster string) ([]rebootCycle, error) {
+	s.Lock()
+	defer s.Unlock()
+	cycles := []rebootCycle{}
+	file := s.historyFile(cluster)
+	if !fileExists(file) {
+		return cycles, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return cycles, errors.New("could not read history file " + file + ": " + err.Error())
+	}
+	if err := json.Unmarshal(data, &cycles); err != nil {
+		return cycles, errors.New("corrupt history file " + file + ": JSON unmarshal error: " + err.Error())
+	}
+	return cycles, nil
+}
+
+func (s *fileStateStore) PutHistory(cluster string, cycles []rebootCycle) error {
+	s.Lock()
+	defer s.Unlock()
+	return writeStructJSONFile(s.historyFile(cluster), cycles)
+}
+
+func (s *fileStateStore) Close() error {
+	return nil
+}
+
+var (
+	boltClusterStatesBucket = []byte("cluster_states")
+	boltHostAcksBucket      = []byte("host_acks")
+	boltQuarantineBucket    = []byte("quarantine")
+	boltHistoryBucket       = []byte("history")
+)
+
+// boltStateStore saves the cluster states and the ACK responses transactionally in an embedded bbolt database
+type boltStateStore struct {
+	db *bolt.DB
+}
+
+// newBoltStateStore opens or creates the bbolt database file, defaults to <save_state_dir>/goahead.db
+func newBoltStateStore(file string) (*boltStateStore, error) {
+	if len(file) < 1 {
+		file = filepath.Join(currentConfig().SaveStateDir, "goahead.db")
+	}
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.New("could not open state_bolt_file " + file + ": " + err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltClusterStatesBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltHostAcksBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltQuarantineBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltHistoryBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStateStore{db: db}, nil
+}
+
+func getBoltClusterState(tx *bolt.Tx, cluster string) (clusterState, bool, error) {
+	var cs clusterState
+	data := tx.Bucket(boltClusterStatesBucket).Get([]byte(cluster))
+	if data == nil {
+		return cs, false, nil
+	}
+	if err := json.Unmarshal(data, &cs); err != nil {
+		return cs, true, errors.New("JSON unmarshal error of cluster state " + cluster + ": " + err.Error())
+	}
+	return cs, true, nil
+}
+
+func putBoltClusterState(tx *bolt.Tx, cluster string, cs clusterState) error {
+	data, err := json.Marshal(cs)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltClusterStatesBucket).Put([]byte(cluster), data)
+}
+
+func (s *boltStateStore) GetClusterState(cluster string) (cs clusterState, exists bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		cs, exists, err = getBoltClusterState(tx, cluster)
+		return err
+	})
+	return cs, exists, err
+}
+
+func (s *boltStateStore) PutClusterState(cluster string, cs clusterState) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putBoltClusterState(tx, cluster, cs)
+	})
+}
+
+func (s *boltStateStore) CompareAndSwapClusterState(cluster string, old clusterState, cs clusterState) (bool, error) {
+	swapped := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		current, _, err := getBoltClusterState(tx, cluster)
+		if err != nil {
+			return err
+		}
+		if current.Revision != old.Revision {
+			return nil
+		}
+		cs.Revision = old.Revision + 1
+		swapped = true
+		return putBoltClusterState(tx, cluster, cs)
+	})
+	return swapped && err == nil, err
+}
+
+func (s *boltStateStore) GetHostAck(cluster string, fqdn string) (res response, exists bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		acks := tx.Bucket(boltHostAcksBucket).Bucket([]byte(cluster))
+		if acks == nil {
+			return nil
+		}
+		data := acks.Get([]byte(fqdn))
+		if data == nil {
+			return nil
+		}
+		exists = true
+		return json.Unmarshal(data, &res)
+	})
+	return res, exists, err
+}
+
+func (s *boltStateStore) PutHostAck(res response) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		acks, err := tx.Bucket(boltHostAcksBucket).CreateBucketIfNotExists([]byte(res.FoundCluster))
+		if err != nil {
+			return err
+		}
+		return acks.Put([]byte(res.RequestingFqdn), data)
+	})
+}
+
+func (s *boltStateStore) DeleteHostAck(cluster string, fqdn string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		acks := tx.Bucket(boltHostAcksBucket).Bucket([]byte(cluster))
+		if acks == nil {
+			return nil
+		}
+		return acks.Delete([]byte(fqdn))
+	})
+}
+
+func (s *boltStateStore) ListHostAcks(cluster string) ([]response, error) {
+	responses := []response{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		acks := tx.Bucket(boltHostAcksBucket).Bucket([]byte(cluster))
+		if acks == nil {
+			return nil
+		}
+		// bbolt iterates the keys in byte-sorted order
+		return acks.ForEach(func(fqdn []byte, data []byte) error {
+			var res response
+			if err := json.Unmarshal(data, &res); err != nil {
+				return errors.New("JSON unmarshal error of ACK response " + cluster + "/" + string(fqdn) + ": " + err.Error())
+			}
+			responses = append(responses, res)
+			return nil
+		})
+	})
+	return responses, err
+}
+
+func (s *boltStateStore) GetQuarantine(cluster string, fqdn string) (q quarantineEntry, exists bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(boltQuarantineBucket).Bucket([]byte(cluster))
+		if entries == nil {
+			return nil
+		}
+		data := entries.Get([]byte(fqdn))
+		if data == nil {
+			return nil
+		}
+		exists = true
+		return json.Unmarshal(data, &q)
+	})
+	return q, exists, err
+}
+
+func (s *boltStateStore) PutQuarantine(q quarantineEntry) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entries, err := tx.Bucket(boltQuarantineBucket).CreateBucketIfNotExists([]byte(q.Cluster))
+		if err != nil {
+			return err
+		}
+		return entries.Put([]byte(q.Fqdn), data)
+	})
+}
+
+func (s *boltStateStore) DeleteQuarantine(cluster string, fqdn string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(boltQuarantineBucket).Bucket([]byte(cluster))
+		if entries == nil {
+			return nil
+		}
+		return entries.Delete([]byte(fqdn))
+	})
+}
+
+func (s *boltStateStore) ListQuarantine(cluster string) ([]quarantineEntry, error) {
+	list := []quarantineEntry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(boltQuarantineBucket).Bucket([]byte(cluster))
+		if entries == nil {
+			return nil
+		}
+		return entries.ForEach(func(fqdn []byte, data []byte) error {
+			var q quarantineEntry
+			if err := json.Unmarshal(data, &q); err != nil {
+				return errors.New("JSON unmarshal error of quarantine entry " + cluster + "/" + string(fqdn) + ": " + err.Error())
+			}
+			list = append(list, q)
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *boltStateStore) GetHistory(cluster string) ([]rebootCycle, error) {
+	cycles := []rebootCycle{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltHistoryBucket).Get([]byte(cluster))
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &cycles); err != nil {
+			return errors.New("JSON unmarshal error of history of cluster " + cluster + ": " + err.Error())
+		}
+		return nil
+	})
+	return cycles, err
+}
+
+func (s *boltStateStore) PutHistory(cluster string, cycles []rebootCycle) error {
+	data, err := json.Marshal(cycles)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltHistoryBucket).Put([]byte(cluster), data)
+	})
+}
+
+func (s *boltStateStore) Close() error {
+	return s.db.Close()
+}
+
+// describeStateBackend returns a human readable description of the configured state backend for log messages
+func describeStateBackend() string {
+	cfg := currentConfig()
+	if cfg.StateBackend == "bolt" {
+		file := cfg.StateBoltFile
+		if len(file) < 1 {
+			file = filepath.Join(cfg.SaveStateDir, "goahead.db")
+		}
+		return "bolt database " + file
+	}
+	return "JSON files in " + strings.TrimSuffix(cfg.SaveStateDir, "/")
+}
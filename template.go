@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// hookData is available in every hook command as template, as GOAHEAD_* environment variables and as JSON document on stdin
+type hookData struct {
+	Hook            string            `json:"hook"`
+	Fqdn            string            `json:"fqdn"`
+	Hostname        string            `json:"hostname"`
+	Domain          string            `json:"domain"`
+	Cluster         string            `json:"cluster"`
+	Uptime          string            `json:"uptime"`
+	RequestID       string            `json:"request_id"`
+	ClientIP        string            `json:"client_ip"`
+	ClientCN        string            `json:"client_cn"`
+	RestartingHosts []string          `json:"restarting_hosts"`
+	Labels          map[string]string `json:"labels"`
+	PanicReason     string            `json:"panic_reason,omitempty"`
+}
+
+// newHookData returns the hook data of the FQDN in the cluster, the caller adds the details of the request
+func newHookData(fqdn string, cluster string, csetting clusterSetting) hookData {
+	d := hookData{Fqdn: fqdn, Cluster: cluster, RestartingHosts: []string{}, Labels: csetting.Labels}
+	parts := strings.SplitN(fqdn, ".", 2)
+	d.Hostname = parts[0]
+	if len(parts) > 1 {
+		d.Domain = parts[1]
+	}
+	if d.Labels == nil {
+		d.Labels = make(map[string]string)
+	}
+	return d
+}
+
+// withRestartingHosts returns the hook data with the currently restarting hosts of the cluster state
+func (d hookData) withRestartingHosts(cs clusterState) hookData {
+	d.RestartingHosts = keysString(cs.CurrentRestartingServers)
+	sort.Strings(d.RestartingHosts)
+	return d
+}
+
+// legacyPlaceholders maps the {:%placeholder%:} syntax to the template actions
+var legacyPlaceholders = map[string]string{
+	"fqdn":             "{{.Fqdn}}",
+	"hostname":         "{{.Hostname}}",
+	"domain":           "{{.Domain}}",
+	"cluster":          "{{.Cluster}}",
+	"uptime":           "{{.Uptime}}",
+	"request_id":       "{{.RequestID}}",
+	"client_ip":        "{{.ClientIP}}",
+	"client_cn":        "{{.ClientCN}}",
+	"restarting_hosts": `{{join .RestartingHosts ","}}`,
+	"panic_reason":     "{{.PanicReason}}",
+}
+
+var legacyPlaceholderRegex = regexp.MustCompile(`\{:%([A-Za-z0-9_.-]+)%:\}`)
+
+var templateFuncs = template.FuncMap{"join": strings.Join, "json": templateJSON}
+
+// templateJSON encodes a value as JSON, e.g. {"host": {{json .Fqdn}}} in webhook payloads
+func templateJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// literalBraces keeps {{ and }} of hook commands like docker inspect -f '{{.State.Running}}' as they are
+var literalBraces = strings.NewReplacer("{{", `{{"{{"}}`, "}}", `{{"}}"}}`)
+
+// parseHookTemplate parses a hook command with the {:%fqdn%:} placeholders.
+// {{ and }} are no template actions in hook commands, so that existing commands that contain them keep working.
+func parseHookTemplate(s string) (*template.Template, error) {
+	return template.New("hook").Funcs(templateFuncs).Parse(replaceLegacyPlaceholders(literalBraces.Replace(s)))
+}
+
+// parseWebhookTemplate parses the url, a header or the payload of a webhook, which can use Go templates like {{json .Fqdn}} and the {:%fqdn%:} placeholders
+func parseWebhookTemplate(s string) (*template.Template, error) {
+	return template.New("webhook").Funcs(templateFuncs).Parse(replaceLegacyPlaceholders(s))
+}
+
+// replaceLegacyPlaceholders replaces the {:%fqdn%:} placeholders by their template actions.
+// {:%label.<name>%:} is the value of the label <name> of the cluster, unknown placeholders are kept as they are.
+func replaceLegacyPlaceholders(s string) string {
+	return legacyPlaceholderRegex.ReplaceAllStringFunc(s, func(placeholder string) string {
+		name := legacyPlaceholderRegex.FindStringSubmatch(placeholder)[1]
+		if action, ok := legacyPlaceholders[name]; ok {
+			return action
+		}
+		if label, ok := strings.CutPrefix(name, "label."); ok {
+			return "{{index .Labels " + strconv.Quote(label) + "}}"
+		}
+		return "{{" + strconv.Quote(placeholder) + "}}"
+	})
+}
+
+// renderHookTemplate returns the hook command with all placeholders replaced by the hook data
+func renderHookTemplate(s string, d hookData) (string, error) {
+	return renderTemplate(s, d, parseHookTemplate)
+}
+
+// renderWebhookTemplate returns the url, header or payload of a webhook with all templates replaced by the hook data
+func renderWebhookTemplate(s string, d hookData) (string, error) {
+	return renderTemplate(s, d, parseWebhookTemplate)
+}
+
+// renderTemplate parses the template with the given parse function and executes it with the hook data
+func renderTemplate(s string, d hookData, parse func(string) (*template.Template, error)) (string, error) {
+	t, err := parse(s)
+	if err != nil {
+		return "", errors.New("invalid template " + s + ": " + err.Error())
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, d); err != nil {
+		return "", errors.New("could not render template " + s + ": " + err.Error())
+	}
+	return b.String(), nil
+}
+
+var envNameRegex = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// environment returns the hook data as GOAHEAD_* environment variables
+func (d hookData) environment() []string {
+	env := []string{
+		"GOAHEAD_HOOK=" + d.Hook,
+		"GOAHEAD_FQDN=" + d.Fqdn,
+		"GOAHEAD_HOSTNAME=" + d.Hostname,
+		"GOAHEAD_DOMAIN=" + d.Domain,
+		"GOAHEAD_CLUSTER=" + d.Cluster,
+		"GOAHEAD_UPTIME=" + d.Uptime,
+		"GOAHEAD_REQUEST_ID=" + d.RequestID,
+		"GOAHEAD_CLIENT_IP=" + d.ClientIP,
+		"GOAHEAD_CLIENT_CN=" + d.ClientCN,
+		"GOAHEAD_RESTARTING_HOSTS=" + strings.Join(d.RestartingHosts, ","),
+		"GOAHEAD_PANIC_REASON=" + d.PanicReason,
+	}
+	labels := make([]string, 0, len(d.Labels))
+	for name := range d.Labels {
+		labels = append(labels, name)
+	}
+	sort.Strings(labels)
+	for _, name := range labels {
+		env = append(env, "GOAHEAD_LABEL_"+envNameRegex.ReplaceAllString(strings.ToUpper(name), "_")+"="+d.Labels[name])
+	}
+	return env
+}
+
+// executeHook renders the hook command with the hook data and executes it with the GOAHEAD_* environment variables and the hook data as JSON on stdin
+func executeHook(hook string, command string, d hookData, timeout time.Duration, allowFail bool, logger *logrus.Entry) (string, ExecResult) {
+	d.Hook = hook
+	rendered, err := renderHookTemplate(command, d)
+	if err != nil {
+		logger.Error(err.Error())
+		return command, ExecResult{returnCode: 1, output: err.Error()}
+	}
+	stdin, err := json.Marshal(d)
+	if err != nil {
+		logger.Error("Could not marshal hook data for " + rendered + " " + err.Error())
+		return rendered, ExecResult{returnCode: 1, output: err.Error()}
+	}
+	return rendered, executeCommandWithInput(hook, rendered, append(os.Environ(), d.environment()...), stdin, timeout, allowFail, logger)
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"math/rand"
 	"net/http"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -100,72 +99,120 @@ func restartHandlerV1(w http.ResponseWriter, r *http.Request) {
 	// Default response if cluster/fqdn is unknown
 	res.Goahead = false
 	res.UnknownHost = true
-	for c := range clusterSettings {
-		mutex.Lock()
-		clusterLogger := clusterLoggers[c].WithFields(logrus.Fields{"request_id": res.RequestID, "fqdn": request.Fqdn})
-		mutex.Unlock()
-		if !clusterSettings[c].Enabled {
+	// every restart request ends up as one record in the audit log
+	record := auditRequest(r, auditEventDenied)
+	record.RequestID = rid
+	record.Fqdn = request.Fqdn
+	// decide records the decision of the request, a later decision replaces an earlier one
+	decide := func(cluster string, decision string) {
+		record.Cluster = cluster
+		record.Decision = decision
+		switch {
+		case strings.HasPrefix(decision, "inquire_"):
+			record.Event = auditEventInquire
+		case decision == "go_ahead":
+			record.Event = auditEventGranted
+		case decision == "panic":
+			record.Event = auditEventPanic
+		default:
+			record.Event = auditEventDenied
+		}
+	}
+	defer func() {
+		// count every request once with its final decision
+		restartDecisions.inc(record.Cluster, record.Decision)
+		record.Reason = res.Message
+		audit(record)
+	}()
+
+	// use the same cluster settings for the whole request, even if the config gets reloaded meanwhile
+	settings, loggers := currentClusterSettings()
+	// clusters with a higher priority win if the name patterns of multiple clusters match
+	for _, c := range clusterNamesByPriority(settings) {
+		csetting := settings[c]
+		clusterLogger := loggers[c].WithFields(logrus.Fields{"request_id": res.RequestID, "fqdn": request.Fqdn})
+		if !csetting.Enabled {
 			clusterLogger.Debug("Skipping disabled Cluster setting " + c)
 			continue
 		}
 		clusterLogger.Debug("Checking against Cluster setting " + c)
-		if regexp.MustCompile(clusterSettings[c].NamePattern).MatchString(request.Fqdn) {
-			clusterLogger.Debug("Found matching name pattern " + clusterSettings[c].NamePattern + " with fqdn from request " + request.Fqdn)
+		if csetting.matchesName(request.Fqdn) {
+			clusterLogger.Debug("Found matching name pattern " + csetting.NamePattern + " with fqdn from request " + request.Fqdn)
 			res.UnknownHost = false
 			res.FoundCluster = c
 			res.Goahead = false
 
-			fqdnBlacklisted := false
-			for _, blacklistRegex := range clusterSettings[c].BlacklistNamePattern {
-				if regexp.MustCompile(blacklistRegex).MatchString(request.Fqdn) {
-					clusterLogger.Debug("Found matching blacklist name pattern: " + blacklistRegex + " Preventing restart...")
-					// make the client exit
-					res.UnknownHost = true
-					res.Message = "Found matching blacklist name pattern: " + blacklistRegex + " for FQDN: " + request.Fqdn + " Preventing restart!"
-					fqdnBlacklisted = true
-					break
-					//respondWithJSON(w, http.StatusOK, rid, res)
-					//return
-				}
-			}
-
-			if fqdnBlacklisted {
+			if blacklistRegex := csetting.blacklistedBy(request.Fqdn); len(blacklistRegex) > 0 {
+				clusterLogger.Debug("Found matching blacklist name pattern: " + blacklistRegex + " Preventing restart...")
+				// make the client exit
+				res.UnknownHost = true
+				res.Message = "Found matching blacklist name pattern: " + blacklistRegex + " for FQDN: " + request.Fqdn + " Preventing restart!"
+				decide(c, "blacklisted")
 				// check the next cluster setting if another cluster name pattern matches
 				continue
 			}
 
 			clusterLogger.Infof("Received %v request from %v", string(r.RequestURI), request.Fqdn)
+			hook := newHookData(request.Fqdn, c, csetting)
+			hook.Uptime = request.Uptime
+			hook.RequestID = request.RequestID
+			hook.ClientIP = ip
+			hook.ClientCN = record.ClientCN
 			if strings.HasPrefix(r.RequestURI, "/v1/inquire/") {
 				// check if there are sleeping checks for this server and start them,
 				// because the server only inquired if it should restart
 				// which means that the previous necessary restart did happen.
 				res.Message = "No reason to restart"
-				inquireResult := checkAckFileInquire(request, res, clusterLogger, clusterSettings[c])
+				inquireResult := checkAckFileInquire(request, res, clusterLogger)
 
 				clusterLogger.Infof("inquireResult from checkAckFileInquire %+v", inquireResult)
 				if !inquireResult.InquireToRestart {
-					inquireResult = checkChecksInquire(request, res, clusterLogger)
+					inquireResult = checkChecksInquire(request, res, hook, csetting, clusterLogger)
 					clusterLogger.Infof("inquireResult from checkChecksInquire %+v", inquireResult)
 				}
 				if inquireResult.InquireToRestart {
 					res.Message = inquireResult.Reason
-					if uptime.Seconds() < clusterSettings[c].MinimumUptime.Seconds() {
-						res.Message = "MW found a reason to restart, but configured minimum uptime for cluster: " + time.Duration.String(clusterSettings[c].MinimumUptime) + " was not reached by client's uptime: " + request.Uptime
+					if uptime.Seconds() < csetting.MinimumUptime.Seconds() {
+						res.Message = "MW found a reason to restart, but configured minimum uptime for cluster: " + time.Duration.String(csetting.MinimumUptime) + " was not reached by client's uptime: " + request.Uptime
 						clusterLogger.Info(res.Message)
+						decide(c, "inquire_denied_min_uptime")
 						respondWithJSON(w, http.StatusOK, rid, res)
 						return
 					}
 					clusterLogger.Infof("Responding to %s with %+v", r.RequestURI, res)
+					decide(c, "inquire_restart")
 					respondWithJSON(w, http.StatusOK, rid, res)
 					return
 				}
+				decide(c, "inquire_no_restart")
 				clusterLogger.Infof("Responding to %s with %+v", r.RequestURI, res)
 				respondWithJSON(w, http.StatusOK, rid, res)
 				return
 			}
-			if uptime.Seconds() < clusterSettings[c].MinimumUptime.Seconds() {
-				res.Message = "Configured minimum uptime for cluster: " + time.Duration.String(clusterSettings[c].MinimumUptime) + " was not reached by client's uptime: " + request.Uptime
+			if uptime.Seconds() < csetting.MinimumUptime.Seconds() {
+				res.Message = "Configured minimum uptime for cluster: " + time.Duration.String(csetting.MinimumUptime) + " was not reached by client's uptime: " + request.Uptime
+				clusterLogger.Info(res.Message)
+				decide(c, "denied_min_uptime")
+				respondWithJSON(w, http.StatusOK, rid, res)
+				return
+			}
+
+			if reason, until, frozen := checkFreeze(c, timestamp); frozen {
+				if !until.IsZero() {
+					res.AskagainIn = askAgainIn(until)
+				}
+				res.Message = "Denied restart request during change freeze of cluster " + c + " because of " + reason
 				clusterLogger.Info(res.Message)
+				decide(c, "denied_freeze")
+				respondWithJSON(w, http.StatusOK, rid, res)
+				return
+			}
+
+			if open, next := checkMaintenanceWindows(csetting.MaintenanceWindows, timestamp); !open {
+				res.AskagainIn = askAgainIn(next)
+				res.Message = "Denied restart request outside of the maintenance windows of cluster " + c + " Next maintenance window opens at " + next.Format(time.RFC3339)
+				clusterLogger.Info(res.Message)
+				decide(c, "denied_maintenance_window")
 				respondWithJSON(w, http.StatusOK, rid, res)
 				return
 			}
@@ -173,34 +220,53 @@ func restartHandlerV1(w http.ResponseWriter, r *http.Request) {
 			res.AskagainIn = strconv.Itoa(rand.Intn(30)) + "s"
 			result := checkAckFile(request, res, clusterLogger)
 			if result.FqdnGoAhead {
-				result = checkClusterState(res, result, clusterLogger)
+				if primary, reason := checkPrimary(hook, csetting, clusterLogger); primary {
+					result.Reason = reason
+					result.Decision = "denied_primary"
+				} else {
+					result = checkClusterState(res, result, csetting, settings, clusterLogger)
+					if result.Decision != "error" {
+						record.State = &result.ClusterState
+					}
+				}
 			}
 			if result.RebootPanicThresholdEnabled {
 				res.Message = result.Reason
-				triggerRebootCompletionPanicActions(request.Fqdn, res.FoundCluster, request.Uptime, clusterLogger)
+				decide(c, "panic")
+				triggerRebootCompletionPanicActions(hook, panicKindThreshold, result.Reason, result.ClusterState, csetting, clusterLogger)
 				clusterLogger.Info("Reboot panic happened for cluster " + res.FoundCluster)
 			} else if result.FqdnGoAhead && result.ClusterGoAhead {
 				res.Message = result.Reason
 				res.Goahead = true
-				triggerRebootGoaheadActions(request.Fqdn, res.FoundCluster, request.Uptime, clusterLogger)
+				decide(c, "go_ahead")
+				triggerRebootGoaheadActions(hook.withRestartingHosts(result.ClusterState), csetting, clusterLogger)
 				clusterLogger.Info("Activating cluster checker for " + request.Fqdn + " inside cluster " + res.FoundCluster)
-				mutex.Lock()
-				if _, ok := sleepingClusterChecks[res.RequestingFqdn]; !ok {
-					sleepingClusterChecks[request.Fqdn] = clusterCheck{clusterSettings[c], request.Fqdn, rid, res.FoundCluster}
-				}
-				mutex.Unlock()
+				checkCluster <- clusterCheck{csetting, request.Fqdn, rid, res.FoundCluster}
 			} else {
 				res.Message = result.Reason
+				if !result.FqdnGoAhead {
+					decide(c, "request_id_handshake")
+				} else if len(result.Decision) > 0 {
+					decide(c, result.Decision)
+				} else {
+					decide(c, "denied")
+				}
 			}
 			clusterLogger.Infof("Responding with %+v", res)
 			respondWithJSON(w, http.StatusOK, rid, res)
 			return
 		}
-		clusterLogger.Debug("Name pattern " + clusterSettings[c].NamePattern + " does not match with fqdn from request " + request.Fqdn)
-		res.Message = "FQDN " + request.Fqdn + " did not match any known cluster"
+		clusterLogger.Debug("Name pattern " + csetting.NamePattern + " does not match with fqdn from request " + request.Fqdn)
+		if len(res.Message) < 1 {
+			res.Message = "FQDN " + request.Fqdn + " did not match any known cluster"
+		}
 	}
 	unknownLogger.Infof("Responding with %+v", res)
 	res.FoundCluster = "unknown"
+	if len(record.Decision) < 1 {
+		// keep the blacklisted decision of a matching cluster
+		decide(res.FoundCluster, "unknown_host")
+	}
 	saveAckFile(res, unknownLogger)
 	respondWithJSON(w, http.StatusOK, rid, res)
 
@@ -210,6 +276,7 @@ func restartHandlerV1(w http.ResponseWriter, r *http.Request) {
 func addV1Routes(r *mux.Router) {
 	r.HandleFunc("/request/restart/os", restartHandlerV1)
 	r.HandleFunc("/inquire/restart/", restartHandlerV1)
+	addAdminV1Routes(r)
 	addRoutes(r)
 }
 
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// validateClusterSetting returns every problem of the settings of a single cluster that prevents goahead from using them
+func validateClusterSetting(csetting *clusterSetting) []string {
+	problems := []string{}
+	if err := validateClusterType(*csetting); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateMembers(*csetting); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateExpiryPolicy(*csetting); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for i := range csetting.MaintenanceWindows {
+		if err := csetting.MaintenanceWindows[i].parse(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	problems = append(problems, csetting.compilePatterns()...)
+	if err := csetting.RebootCompletionCheck.parse(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, hook := range []struct {
+		name      string
+		templates []string
+	}{
+		{"reboot_goahead_checks", csetting.RebootGoaheadChecks},
+		{"reboot_completion_check", []string{csetting.RebootCompletionCheck.Command, csetting.RebootCompletionCheck.Address, csetting.RebootCompletionCheck.URL}},
+		{"primary_check", []string{csetting.PrimaryCheck}},
+		{"members command", []string{csetting.Members.Command}},
+	} {
+		for _, tmpl := range hook.templates {
+			if _, err := parseHookTemplate(tmpl); err != nil {
+				problems = append(problems, hook.name+" has an invalid template "+tmpl+": "+err.Error())
+			}
+		}
+	}
+	for _, actions := range []struct {
+		name    string
+		actions []hookAction
+	}{
+		{"reboot_goahead_actions", csetting.RebootGoaheadActions},
+		{"reboot_completion_actions", csetting.RebootCompletionActions},
+		{"reboot_completion_panic_actions scripts", csetting.RebootCompletionPanicActions.Scripts},
+	} {
+		for _, action := range actions.actions {
+			if err := action.validate(); err != nil {
+				problems = append(problems, actions.name+" "+err.Error())
+			}
+		}
+	}
+	knownHooks := make(map[string]struct{})
+	for _, hook := range hookNames {
+		knownHooks[hook] = struct{}{}
+	}
+	hooks := make([]string, 0, len(csetting.HookTimeouts))
+	for hook := range csetting.HookTimeouts {
+		hooks = append(hooks, hook)
+	}
+	sort.Strings(hooks)
+	for _, hook := range hooks {
+		timeout := csetting.HookTimeouts[hook]
+		if _, ok := knownHooks[hook]; !ok {
+			problems = append(problems, "unknown hook "+hook+" in hook_timeouts, use one of "+strings.Join(hookNames, ", "))
+		} else if timeout < 0 {
+			problems = append(problems, "hook_timeouts "+hook+" must not be negative: "+timeout.String())
+		}
+	}
+	for _, setting := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"minimum_uptime", csetting.MinimumUptime},
+		{"reboot_completion_check_interval", csetting.RebootCompletionCheckInterval},
+		{"reboot_completion_check_offset", csetting.RebootCompletionCheckOffset},
+		{"reboot_completion_panic_threshold", csetting.RebootCompletionPanicThreshold},
+		{"reboot_completion_max_duration", csetting.RebootCompletionMaxDuration},
+	} {
+		if setting.value < 0 {
+			problems = append(problems, setting.name+" must not be negative: "+setting.value.String())
+		}
+	}
+	// the reboot completion check would run back to back without an interval and one success would already complete the reboot
+	if csetting.RebootCompletionCheckInterval == 0 {
+		problems = append(problems, "reboot_completion_check_interval must be set")
+	}
+	if csetting.RebootCompletionCheckConsecutiveSuccesses < 1 {
+		problems = append(problems, "reboot_completion_check_consecutive_successes must be at least 1: "+strconv.Itoa(csetting.RebootCompletionCheckConsecutiveSuccesses))
+	}
+	return problems
+}
+
+// lintClusterSetting returns the problems of a cluster that goahead could run with, but that most likely are mistakes
+func lintClusterSetting(csetting clusterSetting) []string {
+	problems := []string{}
+	if csetting.RebootCompletionPanicThreshold == 0 {
+		problems = append(problems, "reboot_completion_panic_threshold is not set, every restart request during an ongoing restart would trigger the reboot_completion_panic_actions")
+	}
+	hooks := []struct {
+		name     string
+		commands []string
+	}{
+		{"reboot_goahead_checks", csetting.RebootGoaheadChecks},
+		{"reboot_goahead_actions", actionCommands(csetting.RebootGoaheadActions)},
+		{"reboot_completion_check", []string{csetting.RebootCompletionCheck.Command}},
+		{"reboot_completion_actions", actionCommands(csetting.RebootCompletionActions)},
+		{"reboot_completion_panic_actions scripts", actionCommands(csetting.RebootCompletionPanicActions.Scripts)},
+		{"primary_check", []string{csetting.PrimaryCheck}},
+		{"members command", []string{csetting.Members.Command}},
+	}
+	for _, hook := range hooks {
+		for _, command := range hook.commands {
+			if problem := checkHookCommand(command); len(problem) > 0 {
+				problems = append(problems, hook.name+" "+problem)
+			}
+		}
+	}
+	return problems
+}
+
+// checkHookCommand checks that the executable of the command exists and is executable.
+// Executables that contain placeholders can only be checked at execution time.
+func checkHookCommand(command string) string {
+	executable := strings.SplitN(strings.TrimSpace(command), " ", 2)[0]
+	if len(executable) < 1 || strings.Contains(executable, "{:%") || strings.Contains(executable, "{{") {
+		return ""
+	}
+	if _, err := exec.LookPath(executable); err != nil {
+		return "command " + command + " is not executable: " + err.Error()
+	}
+	return ""
+}
+
+// validateConfig strictly loads the config file and every cluster settings file of its include_dir and returns all problems found
+func validateConfig(configFile string) []string {
+	problems := []string{}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return append(problems, configFile+": "+err.Error())
+	}
+	var strictConfig configSettings
+	if err := yaml.UnmarshalStrict(data, &strictConfig); err != nil {
+		problems = append(problems, configFile+": "+err.Error())
+		if _, unknownFields := err.(*yaml.TypeError); !unknownFields {
+			return problems
+		}
+	}
+	cfg, err := loadConfigfile(configFile)
+	if err != nil {
+		problems = append(problems, configFile+": "+err.Error())
+	}
+	if len(cfg.IncludeDir) < 1 {
+		return problems
+	}
+	if !isDir(cfg.IncludeDir) {
+		return append(problems, configFile+": include_dir "+cfg.IncludeDir+" is not a directory")
+	}
+
+	files := []string{}
+	filepath.Walk(cfg.IncludeDir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			problems = append(problems, path+": "+err.Error())
+			return nil
+		}
+		if filepath.Ext(path) == ".yml" || filepath.Ext(path) == ".yaml" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) == 0 {
+		return append(problems, configFile+": could not find any cluster settings matching "+cfg.IncludeDir+"**/*.(yml|yaml)")
+	}
+	sort.Strings(files)
+
+	settings := make(map[string]clusterSetting)
+	// only clusters without problems can be matched against the sample hosts
+	matchable := make(map[string]clusterSetting)
+	clusterFiles := make(map[string]string)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			problems = append(problems, file+": "+err.Error())
+			continue
+		}
+		var cs map[string]clusterSetting
+		if err := yaml.UnmarshalStrict(data, &cs); err != nil {
+			problems = append(problems, file+": "+err.Error())
+			if _, unknownFields := err.(*yaml.TypeError); !unknownFields {
+				continue
+			}
+			// fall back to the lenient decoding to validate the known settings anyway
+			cs = nil
+			yaml.Unmarshal(data, &cs)
+		}
+		names := make([]string, 0, len(cs))
+		for name := range cs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			csetting := cs[name]
+			if previous, ok := clusterFiles[name]; ok {
+				problems = append(problems, file+": cluster "+name+": already defined in file "+previous)
+				continue
+			}
+			clusterFiles[name] = file
+			settingProblems := validateClusterSetting(&csetting)
+			if len(settingProblems) == 0 {
+				matchable[name] = csetting
+			}
+			for _, problem := range append(settingProblems, lintClusterSetting(csetting)...) {
+				problems = append(problems, file+": cluster "+name+": "+problem)
+			}
+			settings[name] = csetting
+		}
+	}
+	if err := validateClusterDependencies(settings); err != nil {
+		problems = append(problems, cfg.IncludeDir+": "+err.Error())
+	}
+	if hosts, err := readSampleHostsFile(cfg.SampleHostsFile); err != nil {
+		problems = append(problems, configFile+": "+err.Error())
+	} else if _, err := findClusterOverlaps(matchable, hosts); err != nil {
+		problems = append(problems, cfg.SampleHostsFile+": "+err.Error())
+	}
+	return problems
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hookActionExec    = "exec"
+	hookActionWebhook = "webhook"
+)
+
+// defaultWebhookSignatureHeader carries the HMAC-SHA256 signature of the webhook payload as sha256=<hex>
+const defaultWebhookSignatureHeader = "X-Goahead-Signature"
+
+// hookAction is an entry of reboot_goahead_actions, reboot_completion_actions or the scripts of reboot_completion_panic_actions.
+// It is either a shell command like before or a webhook that POSTs a JSON payload.
+type hookAction struct {
+	Type            string            `yaml:"type" json:"type"`
+	Command         string            `yaml:"command" json:"command,omitempty"`
+	URL             string            `yaml:"url" json:"url,omitempty"`
+	Method          string            `yaml:"method" json:"method,omitempty"`
+	Headers         map[string]string `yaml:"headers" json:"headers,omitempty"`
+	Payload         string            `yaml:"payload" json:"payload,omitempty"`
+	HMACSecret      string            `yaml:"hmac_secret" json:"-"`
+	SignatureHeader string            `yaml:"signature_header" json:"signature_header,omitempty"`
+	Timeout         time.Duration     `yaml:"timeout" json:"timeout,omitempty"`
+	Retries         int               `yaml:"retries" json:"retries,omitempty"`
+	RetryBackoff    time.Duration     `yaml:"retry_backoff" json:"retry_backoff,omitempty"`
+}
+
+// hookActionFields is hookAction without its methods to unmarshal the structured form
+type hookActionFields hookAction
+
+// UnmarshalYAML accepts a shell command as well as a structured action with a type
+func (a *hookAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		*a = hookAction{Type: hookActionExec, Command: command}
+		return nil
+	}
+	var fields hookActionFields
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	*a = hookAction(fields)
+	return nil
+}
+
+// MarshalJSON returns the shell command of exec actions like in the cluster config and never the hmac_secret of webhooks
+func (a hookAction) MarshalJSON() ([]byte, error) {
+	if a.actionType() == hookActionExec {
+		return json.Marshal(a.Command)
+	}
+	return json.Marshal(hookActionFields(a))
+}
+
+// UnmarshalJSON accepts the shell command or the structured action returned by MarshalJSON
+func (a *hookAction) UnmarshalJSON(data []byte) error {
+	var command string
+	if err := json.Unmarshal(data, &command); err == nil {
+		*a = hookAction{Type: hookActionExec, Command: command}
+		return nil
+	}
+	var fields hookActionFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*a = hookAction(fields)
+	return nil
+}
+
+func (a hookAction) actionType() string {
+	if len(a.Type) < 1 {
+		return hookActionExec
+	}
+	return a.Type
+}
+
+// String describes the action for log messages
+func (a hookAction) String() string {
+	if a.actionType() == hookActionWebhook {
+		return "webhook " + a.URL
+	}
+	return a.Command
+}
+
+// templates returns every setting of the webhook that is a Go template
+func (a hookAction) templates() []string {
+	templates := []string{a.URL, a.Payload}
+	for _, value := range a.Headers {
+		templates = append(templates, value)
+	}
+	return templates
+}
+
+// validate returns the problem of the action that prevents goahead from executing it
+func (a hookAction) validate() error {
+	switch a.actionType() {
+	case hookActionExec:
+		if len(a.Command) < 1 {
+			return errors.New("action of type exec needs a command")
+		}
+	case hookActionWebhook:
+		if len(a.URL) < 1 {
+			return errors.New("action of type webhook needs an url")
+		}
+	default:
+		return errors.New("unknown action type " + a.Type + " Use exec or webhook")
+	}
+	if a.Timeout < 0 || a.Retries < 0 || a.RetryBackoff < 0 {
+		return errors.New("timeout, retries and retry_backoff of action " + a.String() + " must not be negative")
+	}
+	for _, tmpl := range a.templates() {
+		if _, err := parseWebhookTemplate(tmpl); err != nil {
+			return errors.New("action " + a.String() + " has an invalid template " + tmpl + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// actionCommands returns the shell commands of the exec actions
+func actionCommands(actions []hookAction) []string {
+	commands := []string{}
+	for _, a := range actions {
+		if a.actionType() == hookActionExec {
+			commands = append(commands, a.Command)
+		}
+	}
+	return commands
+}
+
+// executeAction executes the shell command or sends the webhook of the action and returns the rendered command or URL and its result
+func executeAction(hook string, a hookAction, d hookData, timeout time.Duration, allowFail bool, logger *logrus.Entry) (string, ExecResult) {
+	if a.Timeout > 0 {
+		timeout = a.Timeout
+	}
+	if a.actionType() == hookActionWebhook {
+		return sendWebhook(hook, a, d, timeout, logger)
+	}
+	return executeHook(hook, a.Command, d, timeout, allowFail, logger)
+}
+
+// sendWebhook sends the rendered payload, which defaults to the hook data as JSON, to the webhook URL once and limits the request by the timeout.
+// The job queue retries network errors, HTTP 429 and HTTP 5xx responses, every other failure is marked as permanent.
+func sendWebhook(hook string, a hookAction, d hookData, timeout time.Duration, logger *logrus.Entry) (string, ExecResult) {
+	d.Hook = hook
+	url, err := renderWebhookTemplate(a.URL, d)
+	if err != nil {
+		logger.Error(err.Error())
+		return a.URL, ExecResult{returnCode: 1, output: err.Error(), permanent: true}
+	}
+	payload, err := webhookPayload(a, d)
+	if err != nil {
+		logger.Error("Could not create payload of webhook " + url + " " + err.Error())
+		return url, ExecResult{returnCode: 1, output: err.Error(), permanent: true}
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	names := make([]string, 0, len(a.Headers))
+	for name := range a.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, err := renderWebhookTemplate(a.Headers[name], d)
+		if err != nil {
+			logger.Error(err.Error())
+			return url, ExecResult{returnCode: 1, output: err.Error(), permanent: true}
+		}
+		headers[name] = value
+	}
+	if len(a.HMACSecret) > 0 {
+		mac := hmac.New(sha256.New, []byte(a.HMACSecret))
+		mac.Write(payload)
+		signatureHeader := a.SignatureHeader
+		if len(signatureHeader) < 1 {
+			signatureHeader = defaultWebhookSignatureHeader
+		}
+		headers[signatureHeader] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	method := a.Method
+	if len(method) < 1 {
+		method = http.MethodPost
+	}
+
+	logger.Info("Sending webhook " + method + " " + url)
+	before := time.Now()
+	defer func() { hookDurations.observe(time.Since(before), hook) }()
+	er := sendWebhookRequest(method, url, headers, payload, timeout)
+	if er.timedOut {
+		hookTimeouts.inc(hook)
+	}
+	if er.returnCode != 0 {
+		logger.Warn("sendWebhook(): webhook failed: " + url + " " + er.output)
+	}
+	return url, er
+}
+
+// webhookPayload renders the payload template and checks that it is valid JSON
+func webhookPayload(a hookAction, d hookData) ([]byte, error) {
+	if len(a.Payload) < 1 {
+		return json.Marshal(d)
+	}
+	payload, err := renderWebhookTemplate(a.Payload, d)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid([]byte(payload)) {
+		return nil, errors.New("rendered payload is not valid JSON: " + payload)
+	}
+	return []byte(payload), nil
+}
+
+// sendWebhookRequest sends a single webhook request and returns its result
+func sendWebhookRequest(method string, url string, headers map[string]string, payload []byte, timeout time.Duration) ExecResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return ExecResult{returnCode: 1, output: err.Error(), permanent: true}
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return ExecResult{returnCode: execTimeoutReturnCode, output: err.Error(), timedOut: true, timeout: timeout}
+		}
+		return ExecResult{returnCode: 1, output: err.Error()}
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxExecOutput))
+	er := ExecResult{returnCode: 0, output: string(body)}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		er.returnCode = 1
+		er.output = "HTTP " + strconv.Itoa(resp.StatusCode) + ": " + string(body)
+		er.permanent = resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500
+	}
+	return er
+}